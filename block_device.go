@@ -3,87 +3,133 @@ package kvm
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
-	"time"
+	"path/filepath"
+	"strconv"
 
 	"github.com/pojntfx/go-nbd/pkg/client"
 	"github.com/pojntfx/go-nbd/pkg/server"
 )
 
+// remoteImageBackend serves the remote media mounted on a LUN
 type remoteImageBackend struct {
+	lun int
 }
 
-func (r remoteImageBackend) ReadAt(p []byte, off int64) (n int, err error) {
+// readSource reads the mounted media itself, without the writes kept in the
+// overlay of a writable disk
+func (r remoteImageBackend) readSource(p []byte, off int64) (n int, err error) {
 	virtualMediaStateMutex.RLock()
-	logger.Debugf("currentVirtualMediaState is %v", currentVirtualMediaState)
+	mounted := virtualMediaLuns[r.lun]
+	logger.Debugf("virtual media state of LUN %d is %v", r.lun, mounted.state)
 	logger.Debugf("read size: %d, off: %d", len(p), off)
-	if currentVirtualMediaState == nil {
+	if mounted.state == nil {
+		virtualMediaStateMutex.RUnlock()
 		return 0, errors.New("image not mounted")
 	}
-	source := currentVirtualMediaState.Source
-	mountedImageSize := currentVirtualMediaState.Size
+	source := mounted.state.Source
+	mountedImageSize := mounted.state.Size
 	virtualMediaStateMutex.RUnlock()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
 	readLen := int64(len(p))
 	if off+readLen > mountedImageSize {
 		readLen = mountedImageSize - off
 	}
+	if mounted.image != nil {
+		return mounted.image.ReadAt(p, off)
+	}
 	var data []byte
 	if source == WebRTC {
-		data, err = webRTCDiskReader.Read(ctx, off, readLen)
+		// the reader times out and retries each request itself
+		data, err = webRTCDiskReader.Read(context.Background(), off, readLen)
 		if err != nil {
 			return 0, err
 		}
 		n = copy(p, data)
 		return n, nil
 	} else if source == HTTP {
-		return httpRangeReader.ReadAt(p, off)
+		return mounted.httpRangeReader.ReadAt(p, off)
 	} else {
 		return 0, errors.New("unknown image source")
 	}
 }
 
+func (r remoteImageBackend) ReadAt(p []byte, off int64) (n int, err error) {
+	virtualMediaStateMutex.RLock()
+	overlay := virtualMediaLuns[r.lun].overlay
+	virtualMediaStateMutex.RUnlock()
+	if overlay != nil {
+		return overlay.ReadAt(p, off)
+	}
+	return r.readSource(p, off)
+}
+
 func (r remoteImageBackend) WriteAt(p []byte, off int64) (n int, err error) {
-	return 0, errors.New("not supported")
+	virtualMediaStateMutex.RLock()
+	overlay := virtualMediaLuns[r.lun].overlay
+	virtualMediaStateMutex.RUnlock()
+	if overlay == nil {
+		return 0, errors.New("not supported")
+	}
+	return overlay.WriteAt(p, off)
 }
 
 func (r remoteImageBackend) Size() (int64, error) {
-	virtualMediaStateMutex.Lock()
-	defer virtualMediaStateMutex.Unlock()
-	if currentVirtualMediaState == nil {
+	virtualMediaStateMutex.RLock()
+	defer virtualMediaStateMutex.RUnlock()
+	if virtualMediaLuns[r.lun].state == nil {
 		return 0, errors.New("no virtual media state")
 	}
-	return currentVirtualMediaState.Size, nil
+	return virtualMediaLuns[r.lun].state.Size, nil
 }
 
 func (r remoteImageBackend) Sync() error {
-	return nil
+	virtualMediaStateMutex.RLock()
+	overlay := virtualMediaLuns[r.lun].overlay
+	virtualMediaStateMutex.RUnlock()
+	if overlay == nil {
+		return nil
+	}
+	return overlay.Sync()
 }
 
-const nbdSocketPath = "/var/run/nbd.socket"
-const nbdDevicePath = "/dev/nbd0"
+const (
+	// bigger requests let the WebRTC reader fetch more chunks in parallel
+	nbdMaxRequestSize = 512 * 1024
+	nbdReadAheadSize  = 512 * 1024
+)
 
+// NBDDevice with index N uses /dev/nbdN, one per LUN with remote media
 type NBDDevice struct {
+	index      int
+	writable   bool
 	listener   net.Listener
 	serverConn net.Conn
 	clientConn net.Conn
 	dev        *os.File
 }
 
-func NewNBDDevice() *NBDDevice {
-	return &NBDDevice{}
+func NewNBDDevice(index int, writable bool) *NBDDevice {
+	return &NBDDevice{index: index, writable: writable}
+}
+
+func (d *NBDDevice) devicePath() string {
+	return fmt.Sprintf("/dev/nbd%d", d.index)
+}
+
+func (d *NBDDevice) socketPath() string {
+	return fmt.Sprintf("/var/run/nbd%d.socket", d.index)
 }
 
 func (d *NBDDevice) Start() error {
 	var err error
 
+	nbdDevicePath := d.devicePath()
 	if _, err := os.Stat(nbdDevicePath); os.IsNotExist(err) {
-		return errors.New("NBD device does not exist")
+		return fmt.Errorf("NBD device %s does not exist", nbdDevicePath)
 	}
 
 	d.dev, err = os.Open(nbdDevicePath)
@@ -91,6 +137,7 @@ func (d *NBDDevice) Start() error {
 		return err
 	}
 
+	nbdSocketPath := d.socketPath()
 	// Remove the socket file if it already exists
 	if _, err := os.Stat(nbdSocketPath); err == nil {
 		if err := os.Remove(nbdSocketPath); err != nil {
@@ -124,15 +171,17 @@ func (d *NBDDevice) runServerConn() {
 			{
 				Name:        "jetkvm",
 				Description: "",
-				Backend:     &remoteImageBackend{},
+				Backend:     &remoteImageBackend{lun: d.index},
 			},
 		},
 		&server.Options{
-			ReadOnly:           true,
+			ReadOnly:           !d.writable,
 			MinimumBlockSize:   uint32(1024),
 			PreferredBlockSize: uint32(4 * 1024),
-			MaximumBlockSize:   uint32(16 * 1024),
-			SupportsMultiConn:  false,
+			MaximumBlockSize:   uint32(nbdMaxRequestSize),
+			// one connection per device, the overlay and the read cache
+			// aren't kept coherent across several
+			SupportsMultiConn: false,
 		})
 	log.Println("nbd server exited:", err)
 }
@@ -145,6 +194,22 @@ func (d *NBDDevice) runClientConn() {
 	log.Println("nbd client exited:", err)
 }
 
+// setQueueLimits raises the request size and readahead of the block device,
+// the defaults split reads into many small round trips
+func (d *NBDDevice) setQueueLimits() {
+	queuePath := fmt.Sprintf("/sys/block/nbd%d/queue", d.index)
+	limits := map[string]int{
+		"max_sectors_kb": nbdMaxRequestSize / 1024,
+		"read_ahead_kb":  nbdReadAheadSize / 1024,
+	}
+	for name, value := range limits {
+		err := os.WriteFile(filepath.Join(queuePath, name), []byte(strconv.Itoa(value)), 0644)
+		if err != nil {
+			logger.Warnf("failed to set %s of %s: %v", name, d.devicePath(), err)
+		}
+	}
+}
+
 func (d *NBDDevice) Close() {
 	if d.dev != nil {
 		err := client.Disconnect(d.dev)
@@ -199,6 +199,7 @@ func handleSessionRequest(ctx context.Context, c *websocket.Conn, req WebRTCSess
 		return err
 	}
 	if currentSession != nil {
+		releaseStuckKeys("session replaced")
 		writeJSONRPCEvent("otherSessionConnected", nil, currentSession)
 		peerConn := currentSession.peerConnection
 		go func() {
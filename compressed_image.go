@@ -0,0 +1,571 @@
+package kvm
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	CompressionGzip  = "gzip"
+	CompressionXz    = "xz"
+	CompressionZstd  = "zstd"
+	CompressionBzip2 = "bzip2"
+)
+
+var compressionExtensions = []struct {
+	extension string
+	format    string
+}{
+	{".gz", CompressionGzip},
+	{".xz", CompressionXz},
+	{".zst", CompressionZstd},
+	{".bz2", CompressionBzip2},
+}
+
+const (
+	// frames are decoded whole, bigger ones would need too much memory
+	maxSeekableFrameSize = 32 * 1024 * 1024
+	// decoded frames kept for the reads that follow
+	seekableFrameCacheSize = 32 * 1024 * 1024
+)
+
+var errImageNotSeekable = errors.New("compressed image has no index for random access")
+
+// imageCompression returns the compression format of an image by its name
+// and the name of the decompressed image
+func imageCompression(filename string) (string, string) {
+	lower := strings.ToLower(filename)
+	for _, c := range compressionExtensions {
+		if strings.HasSuffix(lower, c.extension) && len(filename) > len(c.extension) {
+			return c.format, filename[:len(filename)-len(c.extension)]
+		}
+	}
+	return "", filename
+}
+
+// urlFilename is the name of the file a url points to
+func urlFilename(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	return path.Base(parsed.Path)
+}
+
+// mountCompressedStorageFile mounts seekable images directly through NBD,
+// other images are decompressed into storage first and mounted once done
+func mountCompressedStorageFile(filename string, compression string, mode VirtualMediaMode, lun int) error {
+	file, err := os.Open(filepath.Join(imagesFolder, filename))
+	if err != nil {
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to get file info: %w", err)
+	}
+	image, err := openSeekableImage(file, fileInfo.Size(), compression, file)
+	if errors.Is(err, errImageNotSeekable) {
+		file.Close()
+		_, decompressedName := imageCompression(filename)
+		if _, err := os.Stat(filepath.Join(imagesFolder, decompressedName)); err == nil {
+			return rpcMountWithStorage(decompressedName, mode, lun)
+		}
+		if err := checkVirtualMediaLunFree(lun); err != nil {
+			return err
+		}
+		_, err = startStorageDecompress(filename, false, &pendingMount{lun: lun, mode: mode})
+		return err
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open compressed image: %w", err)
+	}
+	err = reserveVirtualMediaLun(lun, virtualMediaLun{
+		state: &VirtualMediaState{
+			Source:      Storage,
+			Mode:        mode,
+			Filename:    filename,
+			Size:        image.Size(),
+			Compression: compression,
+		},
+		image: image,
+	})
+	if err != nil {
+		image.Close()
+		return err
+	}
+	return mountRemoteImage(lun, mode)
+}
+
+// downloadAndMount stores a decompressed copy of a url that can't be read at
+// random and mounts it once the download is done, it returns the download
+// when one was started
+func downloadAndMount(rawUrl string, size int64, mode VirtualMediaMode, lun int) (*StorageDownload, error) {
+	_, decompressedName := imageCompression(urlFilename(rawUrl))
+	decompressedName, err := sanitizeFilename(decompressedName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filepath.Join(imagesFolder, decompressedName)); err == nil {
+		return nil, rpcMountWithStorage(decompressedName, mode, lun)
+	}
+	if err := checkVirtualMediaLunFree(lun); err != nil {
+		return nil, err
+	}
+	err = checkStorageSpace(size)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("%s can't be read at random, downloading it into storage", rawUrl)
+	return startDecompressedDownload(rawUrl, decompressedName, &pendingMount{lun: lun, mode: mode})
+}
+
+// decompressedSize is the least space an image needs once decompressed, as
+// far as its headers tell, and its compressed size when they don't
+func decompressedSize(r io.ReaderAt, size int64, format string) int64 {
+	var known int64
+	switch format {
+	case CompressionXz:
+		// the index covers single stream images, seekable or not
+		if frames, _, err := readXzIndex(r, size); err == nil && len(frames) > 0 {
+			last := frames[len(frames)-1]
+			known = last.offset + last.size
+		}
+	case CompressionZstd:
+		if frames, err := readZstdSeekTable(r, size); err == nil && len(frames) > 0 {
+			last := frames[len(frames)-1]
+			known = last.offset + last.size
+			break
+		}
+		// only the first frame, there may be more
+		header := make([]byte, zstd.HeaderMaxSize)
+		n, _ := r.ReadAt(header, 0)
+		var frameHeader zstd.Header
+		if frameHeader.Decode(header[:n]) == nil && frameHeader.HasFCS {
+			known = int64(frameHeader.FrameContentSize)
+		}
+	case CompressionGzip:
+		// the trailer holds the size modulo 4 GiB, one below the compressed
+		// size has most likely wrapped around and tells nothing
+		trailer := make([]byte, 4)
+		if size > 18 && readFullAt(r, trailer, size-4) == nil {
+			if isize := int64(binary.LittleEndian.Uint32(trailer)); isize >= size {
+				known = isize
+			}
+		}
+	}
+	if known > 0 {
+		return known
+	}
+	return size
+}
+
+// newDecompressReader decompresses a whole stream, for formats and images
+// that can't be read at random
+func newDecompressReader(format string, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionXz:
+		reader, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(reader), nil
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case CompressionBzip2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %s", format)
+}
+
+// seekableFrame is an independently compressed part of an image
+type seekableFrame struct {
+	compressedOffset int64
+	compressedSize   int64
+	offset           int64
+	size             int64
+	unpaddedSize     int64 // xz blocks only, without the padding
+}
+
+type decodedFrame struct {
+	index int
+	data  []byte
+}
+
+// seekableImage reads a compressed image at random by decoding only the
+// frames a read touches, seekable zstd and multi-block xz list their frames
+type seekableImage struct {
+	source io.ReaderAt
+	closer io.Closer
+	frames []seekableFrame
+	size   int64
+	decode func(compressed []byte, frame seekableFrame) ([]byte, error)
+	zstd   *zstd.Decoder
+
+	cache       map[int]*list.Element
+	lru         *list.List
+	cachedBytes int64
+	lock        sync.Mutex
+}
+
+// openSeekableImage returns errImageNotSeekable for images that have to be
+// decompressed in one go, closer is closed along with the image
+func openSeekableImage(source io.ReaderAt, compressedSize int64, format string, closer io.Closer) (*seekableImage, error) {
+	image := &seekableImage{
+		source: source,
+		closer: closer,
+		cache:  make(map[int]*list.Element),
+		lru:    list.New(),
+	}
+	var err error
+	switch format {
+	case CompressionZstd:
+		image.frames, err = readZstdSeekTable(source, compressedSize)
+		if err != nil {
+			return nil, err
+		}
+		image.zstd, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxSeekableFrameSize))
+		if err != nil {
+			return nil, err
+		}
+		image.decode = func(compressed []byte, frame seekableFrame) ([]byte, error) {
+			return image.zstd.DecodeAll(compressed, make([]byte, 0, frame.size))
+		}
+	case CompressionXz:
+		var streamHeader []byte
+		image.frames, streamHeader, err = readXzIndex(source, compressedSize)
+		if err != nil {
+			return nil, err
+		}
+		image.decode = func(compressed []byte, frame seekableFrame) ([]byte, error) {
+			return decodeXzBlock(streamHeader, compressed, frame)
+		}
+	default:
+		return nil, errImageNotSeekable
+	}
+
+	if len(image.frames) == 0 {
+		return nil, errors.New("compressed image is empty")
+	}
+	for _, frame := range image.frames {
+		if frame.size > maxSeekableFrameSize {
+			image.Close()
+			return nil, fmt.Errorf("%w, its frames of %d bytes are too big", errImageNotSeekable, frame.size)
+		}
+	}
+	last := image.frames[len(image.frames)-1]
+	image.size = last.offset + last.size
+	return image, nil
+}
+
+func (s *seekableImage) Size() int64 {
+	return s.size
+}
+
+func (s *seekableImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	end := min(off+int64(len(p)), s.size)
+	index := sort.Search(len(s.frames), func(i int) bool {
+		return s.frames[i].offset+s.frames[i].size > off
+	})
+	n := 0
+	for pos := off; pos < end; index++ {
+		data, err := s.frameLocked(index)
+		if err != nil {
+			return n, err
+		}
+		frame := s.frames[index]
+		n += copy(p[n:end-off], data[pos-frame.offset:])
+		pos = frame.offset + frame.size
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *seekableImage) frameLocked(index int) ([]byte, error) {
+	if element, ok := s.cache[index]; ok {
+		s.lru.MoveToFront(element)
+		return element.Value.(*decodedFrame).data, nil
+	}
+	frame := s.frames[index]
+	compressed := make([]byte, frame.compressedSize)
+	err := readFullAt(s.source, compressed, frame.compressedOffset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read frame %d: %w", index, err)
+	}
+	data, err := s.decode(compressed, frame)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress frame %d: %w", index, err)
+	}
+	if int64(len(data)) != frame.size {
+		return nil, fmt.Errorf("frame %d decompressed to %d bytes instead of %d", index, len(data), frame.size)
+	}
+
+	s.cache[index] = s.lru.PushFront(&decodedFrame{index: index, data: data})
+	s.cachedBytes += int64(len(data))
+	for s.cachedBytes > seekableFrameCacheSize && s.lru.Len() > 1 {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		evicted := oldest.Value.(*decodedFrame)
+		delete(s.cache, evicted.index)
+		s.cachedBytes -= int64(len(evicted.data))
+	}
+	return data, nil
+}
+
+func (s *seekableImage) Close() error {
+	if s.zstd != nil {
+		s.zstd.Close()
+	}
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// readFullAt fills p, a full read that ends the source is no error
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+const (
+	zstdSkippableFrameMagic = 0x184D2A5E
+	zstdSeekableMagic       = 0x8F92EAB1
+)
+
+// readZstdSeekTable reads the seek table the zstd seekable format appends in
+// a skippable frame
+func readZstdSeekTable(r io.ReaderAt, size int64) ([]seekableFrame, error) {
+	footer := make([]byte, 9)
+	if size < int64(len(footer))+8 {
+		return nil, errImageNotSeekable
+	}
+	if err := readFullAt(r, footer, size-int64(len(footer))); err != nil {
+		return nil, fmt.Errorf("failed to read seek table footer: %w", err)
+	}
+	if binary.LittleEndian.Uint32(footer[5:9]) != zstdSeekableMagic {
+		return nil, errImageNotSeekable
+	}
+	frameCount := int64(binary.LittleEndian.Uint32(footer[0:4]))
+	descriptor := footer[4]
+	if descriptor&0x7C != 0 {
+		return nil, errors.New("invalid zstd seek table descriptor")
+	}
+	entrySize := int64(8)
+	if descriptor&0x80 != 0 {
+		entrySize = 12
+	}
+	tableSize := frameCount * entrySize
+	tableStart := size - int64(len(footer)) - tableSize
+	frameStart := tableStart - 8
+	if frameStart < 0 {
+		return nil, errors.New("invalid zstd seek table size")
+	}
+
+	table := make([]byte, 8+tableSize)
+	if err := readFullAt(r, table, frameStart); err != nil {
+		return nil, fmt.Errorf("failed to read seek table: %w", err)
+	}
+	if binary.LittleEndian.Uint32(table[0:4]) != zstdSkippableFrameMagic ||
+		int64(binary.LittleEndian.Uint32(table[4:8])) != tableSize+int64(len(footer)) {
+		return nil, errors.New("invalid zstd seek table frame")
+	}
+
+	frames := make([]seekableFrame, 0, frameCount)
+	var compressedOffset, offset int64
+	for i := int64(0); i < frameCount; i++ {
+		entry := table[8+i*entrySize:]
+		frame := seekableFrame{
+			compressedOffset: compressedOffset,
+			compressedSize:   int64(binary.LittleEndian.Uint32(entry[0:4])),
+			offset:           offset,
+			size:             int64(binary.LittleEndian.Uint32(entry[4:8])),
+		}
+		compressedOffset += frame.compressedSize
+		offset += frame.size
+		if frame.size > 0 {
+			frames = append(frames, frame)
+		}
+	}
+	if compressedOffset != frameStart {
+		return nil, errors.New("zstd seek table doesn't match the image")
+	}
+	return frames, nil
+}
+
+var xzHeaderMagic = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+
+// xzCheckSize is the size of the check after each block by check type
+func xzCheckSize(checkType byte) int64 {
+	switch {
+	case checkType == 0:
+		return 0
+	case checkType <= 3:
+		return 4
+	case checkType <= 6:
+		return 8
+	case checkType <= 9:
+		return 16
+	case checkType <= 12:
+		return 32
+	}
+	return 64
+}
+
+// readXzIndex lists the blocks of a single stream xz image from the index at
+// its end, xz -T and --block-size write one block per chunk of the input
+func readXzIndex(r io.ReaderAt, size int64) ([]seekableFrame, []byte, error) {
+	header := make([]byte, 12)
+	if size < 32 {
+		return nil, nil, errImageNotSeekable
+	}
+	if err := readFullAt(r, header, 0); err != nil {
+		return nil, nil, fmt.Errorf("failed to read xz header: %w", err)
+	}
+	if !bytes.Equal(header[:6], xzHeaderMagic) {
+		return nil, nil, errors.New("not an xz image")
+	}
+
+	// stream padding after the footer is made of zeros
+	end := size
+	footer := make([]byte, 12)
+	for {
+		if end < 24 {
+			return nil, nil, errors.New("invalid xz image")
+		}
+		if err := readFullAt(r, footer, end-12); err != nil {
+			return nil, nil, fmt.Errorf("failed to read xz footer: %w", err)
+		}
+		if !bytes.Equal(footer[8:12], []byte{0, 0, 0, 0}) {
+			break
+		}
+		end -= 4
+	}
+	if string(footer[10:12]) != "YZ" || crc32.ChecksumIEEE(footer[4:10]) != binary.LittleEndian.Uint32(footer[0:4]) {
+		return nil, nil, errors.New("invalid xz footer")
+	}
+	if !bytes.Equal(footer[8:10], header[6:8]) {
+		return nil, nil, errImageNotSeekable
+	}
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	indexStart := end - 12 - indexSize
+	if indexStart < 12 {
+		return nil, nil, errors.New("invalid xz index size")
+	}
+	index := make([]byte, indexSize)
+	if err := readFullAt(r, index, indexStart); err != nil {
+		return nil, nil, fmt.Errorf("failed to read xz index: %w", err)
+	}
+	if index[0] != 0 || crc32.ChecksumIEEE(index[:indexSize-4]) != binary.LittleEndian.Uint32(index[indexSize-4:]) {
+		return nil, nil, errors.New("invalid xz index")
+	}
+
+	records := bytes.NewReader(index[1 : indexSize-4])
+	count, err := binary.ReadUvarint(records)
+	if err != nil {
+		return nil, nil, errors.New("invalid xz index")
+	}
+	frames := make([]seekableFrame, 0, min(count, 1<<16))
+	compressedOffset := int64(len(header))
+	var offset int64
+	for i := uint64(0); i < count; i++ {
+		unpaddedSize, err := binary.ReadUvarint(records)
+		if err != nil {
+			return nil, nil, errors.New("invalid xz index")
+		}
+		uncompressedSize, err := binary.ReadUvarint(records)
+		if err != nil {
+			return nil, nil, errors.New("invalid xz index")
+		}
+		frame := seekableFrame{
+			compressedOffset: compressedOffset,
+			compressedSize:   (int64(unpaddedSize) + 3) &^ 3,
+			offset:           offset,
+			size:             int64(uncompressedSize),
+			unpaddedSize:     int64(unpaddedSize),
+		}
+		if int64(unpaddedSize) <= xzCheckSize(header[7]&0x0F) {
+			return nil, nil, errors.New("invalid xz block size")
+		}
+		compressedOffset += frame.compressedSize
+		offset += frame.size
+		frames = append(frames, frame)
+	}
+	// anything else before the index means concatenated streams
+	if compressedOffset != indexStart {
+		return nil, nil, errImageNotSeekable
+	}
+	return frames, header, nil
+}
+
+// decodeXzBlock wraps a single block in a stream of its own with a matching
+// index, so the xz reader can decode it without the rest of the image
+func decodeXzBlock(streamHeader []byte, block []byte, frame seekableFrame) ([]byte, error) {
+	index := []byte{0}
+	index = binary.AppendUvarint(index, 1)
+	index = binary.AppendUvarint(index, uint64(frame.unpaddedSize))
+	index = binary.AppendUvarint(index, uint64(frame.size))
+	for len(index)%4 != 0 {
+		index = append(index, 0)
+	}
+	index = binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+
+	footer := make([]byte, 12)
+	binary.LittleEndian.PutUint32(footer[4:8], uint32(len(index)/4-1))
+	copy(footer[8:10], streamHeader[6:8])
+	binary.LittleEndian.PutUint32(footer[0:4], crc32.ChecksumIEEE(footer[4:10]))
+	copy(footer[10:12], "YZ")
+
+	stream := make([]byte, 0, len(streamHeader)+len(block)+len(index)+len(footer))
+	stream = append(stream, streamHeader...)
+	stream = append(stream, block...)
+	stream = append(stream, index...)
+	stream = append(stream, footer...)
+	reader, err := xz.ReaderConfig{SingleStream: true}.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, frame.size)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,386 @@
+package kvm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const testFrameSize = 64 * 1024
+
+// testImageData is compressible but not trivially so, and ends with a
+// partial frame
+func testImageData() []byte {
+	random := rand.New(rand.NewSource(1))
+	data := make([]byte, 5*testFrameSize+1234)
+	for i := range data {
+		data[i] = byte(i/512) ^ byte(random.Intn(4))
+	}
+	return data
+}
+
+// seekableZstd compresses data in frames of frameSize and appends the seek
+// table of the zstd seekable format
+func seekableZstd(t *testing.T, data []byte, frameSize int, checksums bool) []byte {
+	t.Helper()
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	var image, table []byte
+	frameCount := 0
+	for start := 0; start < len(data); start += frameSize {
+		chunk := data[start:min(start+frameSize, len(data))]
+		frame := encoder.EncodeAll(chunk, nil)
+		image = append(image, frame...)
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(frame)))
+		table = binary.LittleEndian.AppendUint32(table, uint32(len(chunk)))
+		if checksums {
+			table = binary.LittleEndian.AppendUint32(table, 0)
+		}
+		frameCount++
+	}
+	descriptor := byte(0)
+	if checksums {
+		descriptor = 0x80
+	}
+	footer := binary.LittleEndian.AppendUint32(nil, uint32(frameCount))
+	footer = append(footer, descriptor)
+	footer = binary.LittleEndian.AppendUint32(footer, zstdSeekableMagic)
+
+	image = binary.LittleEndian.AppendUint32(image, zstdSkippableFrameMagic)
+	image = binary.LittleEndian.AppendUint32(image, uint32(len(table)+len(footer)))
+	image = append(image, table...)
+	return append(image, footer...)
+}
+
+// multiBlockXz compresses data into a single xz stream with one block per
+// blockSize bytes
+func multiBlockXz(t *testing.T, data []byte, blockSize int64) []byte {
+	t.Helper()
+	var image bytes.Buffer
+	writer, err := xz.WriterConfig{BlockSize: blockSize}.NewWriter(&image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return image.Bytes()
+}
+
+func assertFrames(t *testing.T, frames []seekableFrame, dataSize int, frameSize int) {
+	t.Helper()
+	expected := (dataSize + frameSize - 1) / frameSize
+	if len(frames) != expected {
+		t.Fatalf("got %d frames, want %d", len(frames), expected)
+	}
+	for i, frame := range frames {
+		size := int64(min(frameSize, dataSize-i*frameSize))
+		if frame.offset != int64(i*frameSize) || frame.size != size {
+			t.Fatalf("frame %d: offset %d size %d, want %d %d", i, frame.offset, frame.size, i*frameSize, size)
+		}
+		if i > 0 && frame.compressedOffset != frames[i-1].compressedOffset+frames[i-1].compressedSize {
+			t.Fatalf("frame %d doesn't follow the previous one", i)
+		}
+	}
+}
+
+func TestReadZstdSeekTable(t *testing.T) {
+	data := testImageData()
+	for _, checksums := range []bool{false, true} {
+		image := seekableZstd(t, data, testFrameSize, checksums)
+		frames, err := readZstdSeekTable(bytes.NewReader(image), int64(len(image)))
+		if err != nil {
+			t.Fatalf("checksums %v: %v", checksums, err)
+		}
+		assertFrames(t, frames, len(data), testFrameSize)
+		if frames[0].compressedOffset != 0 {
+			t.Fatalf("first frame at %d", frames[0].compressedOffset)
+		}
+	}
+}
+
+func TestReadZstdSeekTableRejectsCorruptTables(t *testing.T) {
+	data := testImageData()
+	image := seekableZstd(t, data, testFrameSize, false)
+	footer := len(image) - 9
+	tests := []struct {
+		name     string
+		corrupt  func(image []byte) []byte
+		seekable bool
+	}{
+		{
+			name: "plain zstd",
+			corrupt: func([]byte) []byte {
+				encoder, _ := zstd.NewWriter(nil)
+				defer encoder.Close()
+				return encoder.EncodeAll(data, nil)
+			},
+		},
+		{
+			name:    "truncated",
+			corrupt: func(image []byte) []byte { return image[:len(image)-1] },
+		},
+		{
+			name:     "reserved descriptor bits",
+			corrupt:  func(image []byte) []byte { image[footer+4] = 0x04; return image },
+			seekable: true,
+		},
+		{
+			name: "frame count bigger than the image",
+			corrupt: func(image []byte) []byte {
+				binary.LittleEndian.PutUint32(image[footer:], 1<<24)
+				return image
+			},
+			seekable: true,
+		},
+		{
+			name: "wrong skippable frame size",
+			corrupt: func(image []byte) []byte {
+				tableFrame := footer - 6*8 - 8
+				binary.LittleEndian.PutUint32(image[tableFrame+4:], 1)
+				return image
+			},
+			seekable: true,
+		},
+		{
+			name: "frame sizes not matching the image",
+			corrupt: func(image []byte) []byte {
+				firstEntry := footer - 6*8
+				binary.LittleEndian.PutUint32(image[firstEntry:], 100)
+				return image
+			},
+			seekable: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			corrupted := test.corrupt(bytes.Clone(image))
+			_, err := readZstdSeekTable(bytes.NewReader(corrupted), int64(len(corrupted)))
+			if err == nil {
+				t.Fatal("corrupt table accepted")
+			}
+			if errors.Is(err, errImageNotSeekable) == test.seekable {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadXzIndex(t *testing.T) {
+	data := testImageData()
+	image := multiBlockXz(t, data, testFrameSize)
+	frames, header, err := readXzIndex(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFrames(t, frames, len(data), testFrameSize)
+	if !bytes.Equal(header, image[:12]) {
+		t.Fatal("stream header not returned")
+	}
+
+	// stream padding after the footer
+	padded := append(bytes.Clone(image), 0, 0, 0, 0, 0, 0, 0, 0)
+	frames, _, err = readXzIndex(bytes.NewReader(padded), int64(len(padded)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertFrames(t, frames, len(data), testFrameSize)
+}
+
+func TestReadXzIndexFallsBackForConcatenatedStreams(t *testing.T) {
+	data := testImageData()
+	half := len(data) / 2
+	image := append(multiBlockXz(t, data[:half], testFrameSize), multiBlockXz(t, data[half:], testFrameSize)...)
+	_, _, err := readXzIndex(bytes.NewReader(image), int64(len(image)))
+	if !errors.Is(err, errImageNotSeekable) {
+		t.Fatalf("got %v, want errImageNotSeekable", err)
+	}
+
+	// the whole image still decompresses in one go
+	reader, err := newDecompressReader(CompressionXz, bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	decompressed, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(decompressed, data) {
+		t.Fatalf("concatenated streams not decompressed: %v", err)
+	}
+}
+
+func TestReadXzIndexRejectsCorruptIndex(t *testing.T) {
+	image := multiBlockXz(t, testImageData(), testFrameSize)
+	tests := map[string]func(image []byte) []byte{
+		"not xz":        func(image []byte) []byte { image[0] = 0; return image },
+		"footer magic":  func(image []byte) []byte { image[len(image)-1] = 'X'; return image },
+		"footer crc":    func(image []byte) []byte { image[len(image)-12] ^= 0xFF; return image },
+		"index crc":     func(image []byte) []byte { image[len(image)-13] ^= 0xFF; return image },
+		"stream flags":  func(image []byte) []byte { image[7] ^= 0x01; return image },
+		"truncated":     func(image []byte) []byte { return image[:len(image)-5] },
+		"too small":     func(image []byte) []byte { return image[:20] },
+		"only the tail": func(image []byte) []byte { return append(image[:12], image[len(image)-12:]...) },
+	}
+	for name, corrupt := range tests {
+		corrupted := corrupt(bytes.Clone(image))
+		_, _, err := readXzIndex(bytes.NewReader(corrupted), int64(len(corrupted)))
+		if err == nil {
+			t.Errorf("%s: corrupt index accepted", name)
+		}
+	}
+}
+
+func TestDecodeXzBlock(t *testing.T) {
+	data := testImageData()
+	image := multiBlockXz(t, data, testFrameSize)
+	frames, header, err := readXzIndex(bytes.NewReader(image), int64(len(image)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range frames {
+		block := image[frame.compressedOffset : frame.compressedOffset+frame.compressedSize]
+		decoded, err := decodeXzBlock(header, block, frame)
+		if err != nil {
+			t.Fatalf("block %d: %v", i, err)
+		}
+		if !bytes.Equal(decoded, data[frame.offset:frame.offset+frame.size]) {
+			t.Fatalf("block %d decoded wrong", i)
+		}
+	}
+
+	corrupted := bytes.Clone(image[frames[1].compressedOffset : frames[1].compressedOffset+frames[1].compressedSize])
+	corrupted[len(corrupted)/2] ^= 0xFF
+	if _, err := decodeXzBlock(header, corrupted, frames[1]); err == nil {
+		t.Fatal("corrupt block decoded")
+	}
+}
+
+func TestSeekableImageReadAt(t *testing.T) {
+	data := testImageData()
+	images := map[string][]byte{
+		CompressionZstd: seekableZstd(t, data, testFrameSize, false),
+		CompressionXz:   multiBlockXz(t, data, testFrameSize),
+	}
+	reads := []struct {
+		name   string
+		offset int64
+		length int
+	}{
+		{"first bytes", 0, 512},
+		{"inside a frame", testFrameSize + 100, 1000},
+		{"across a frame boundary", testFrameSize - 10, 20},
+		{"across several frames", testFrameSize / 2, 3 * testFrameSize},
+		{"last partial frame", 5 * testFrameSize, 1234},
+		{"into the last partial frame", 5*testFrameSize - 100, 200},
+		{"whole image", 0, len(data)},
+	}
+	for format, compressed := range images {
+		t.Run(format, func(t *testing.T) {
+			image, err := openSeekableImage(bytes.NewReader(compressed), int64(len(compressed)), format, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer image.Close()
+			if image.Size() != int64(len(data)) {
+				t.Fatalf("size: got %d, want %d", image.Size(), len(data))
+			}
+			for _, read := range reads {
+				p := make([]byte, read.length)
+				n, err := image.ReadAt(p, read.offset)
+				if err != nil || n != read.length {
+					t.Fatalf("%s: read %d bytes: %v", read.name, n, err)
+				}
+				if !bytes.Equal(p, data[read.offset:read.offset+int64(read.length)]) {
+					t.Fatalf("%s: wrong data", read.name)
+				}
+			}
+
+			p := make([]byte, 100)
+			n, err := image.ReadAt(p, int64(len(data))-40)
+			if n != 40 || err != io.EOF || !bytes.Equal(p[:n], data[len(data)-40:]) {
+				t.Fatalf("read past the end: got %d, %v", n, err)
+			}
+			if n, err := image.ReadAt(p, int64(len(data))); n != 0 || err != io.EOF {
+				t.Fatalf("read at the end: got %d, %v", n, err)
+			}
+		})
+	}
+}
+
+func TestSeekableImageReportsCorruptFrames(t *testing.T) {
+	data := testImageData()
+	compressed := seekableZstd(t, data, testFrameSize, false)
+	frames, err := readZstdSeekTable(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := frames[1]
+	compressed[second.compressedOffset+second.compressedSize/2] ^= 0xFF
+
+	image, err := openSeekableImage(bytes.NewReader(compressed), int64(len(compressed)), CompressionZstd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer image.Close()
+	p := make([]byte, 100)
+	if _, err := image.ReadAt(p, 0); err != nil {
+		t.Fatalf("intact frame: %v", err)
+	}
+	if _, err := image.ReadAt(p, second.offset); err == nil {
+		t.Fatal("corrupt frame read without error")
+	}
+}
+
+func TestOpenSeekableImageRejectsOtherFormats(t *testing.T) {
+	for _, format := range []string{CompressionGzip, CompressionBzip2} {
+		_, err := openSeekableImage(bytes.NewReader(nil), 0, format, nil)
+		if !errors.Is(err, errImageNotSeekable) {
+			t.Errorf("%s: got %v, want errImageNotSeekable", format, err)
+		}
+	}
+}
+
+func TestDecompressedSize(t *testing.T) {
+	data := testImageData()
+	zstdImage := seekableZstd(t, data, testFrameSize, false)
+	xzImage := multiBlockXz(t, data, testFrameSize)
+	var gzipImage bytes.Buffer
+	writer := gzip.NewWriter(&gzipImage)
+	writer.Write(data)
+	writer.Close()
+	// a trailer that wrapped around 4 GiB is smaller than the compressed data
+	wrapped := bytes.Clone(gzipImage.Bytes())
+	binary.LittleEndian.PutUint32(wrapped[len(wrapped)-4:], 10)
+
+	tests := []struct {
+		name   string
+		format string
+		image  []byte
+		size   int64
+	}{
+		{"seekable zstd", CompressionZstd, zstdImage, int64(len(data))},
+		{"multi-block xz", CompressionXz, xzImage, int64(len(data))},
+		{"gzip", CompressionGzip, gzipImage.Bytes(), int64(len(data))},
+		{"gzip over 4 GiB", CompressionGzip, wrapped, int64(len(wrapped))},
+		{"bzip2", CompressionBzip2, []byte("BZh9 not really"), 15},
+	}
+	for _, test := range tests {
+		size := decompressedSize(bytes.NewReader(test.image), int64(len(test.image)), test.format)
+		if size != test.size {
+			t.Errorf("%s: got %d, want %d", test.name, size, test.size)
+		}
+	}
+}
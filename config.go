@@ -12,16 +12,26 @@ type WakeOnLanDevice struct {
 }
 
 type Config struct {
-	CloudURL          string            `json:"cloud_url"`
-	CloudToken        string            `json:"cloud_token"`
-	GoogleIdentity    string            `json:"google_identity"`
-	JigglerEnabled    bool              `json:"jiggler_enabled"`
-	AutoUpdateEnabled bool              `json:"auto_update_enabled"`
-	IncludePreRelease bool              `json:"include_pre_release"`
-	HashedPassword    string            `json:"hashed_password"`
-	LocalAuthToken    string            `json:"local_auth_token"`
-	LocalAuthMode     string            `json:"localAuthMode"` //TODO: fix it with migration
-	WakeOnLanDevices  []WakeOnLanDevice `json:"wake_on_lan_devices"`
+	CloudURL            string               `json:"cloud_url"`
+	CloudToken          string               `json:"cloud_token"`
+	GoogleIdentity      string               `json:"google_identity"`
+	JigglerEnabled      bool                 `json:"jiggler_enabled"`
+	AutoUpdateEnabled   bool                 `json:"auto_update_enabled"`
+	IncludePreRelease   bool                 `json:"include_pre_release"`
+	HashedPassword      string               `json:"hashed_password"`
+	LocalAuthToken      string               `json:"local_auth_token"`
+	LocalAuthMode       string               `json:"localAuthMode"` //TODO: fix it with migration
+	WakeOnLanDevices    []WakeOnLanDevice    `json:"wake_on_lan_devices"`
+	KeyboardMode        string               `json:"keyboard_mode"`
+	KeyReleaseTimeout   int                  `json:"key_release_timeout"` // seconds, 0 disables the watchdog
+	UsbDevices          *UsbDevices          `json:"usb_devices"`         // nil uses the defaults
+	UsbIdentityProfile  string               `json:"usb_identity_profile"`
+	UsbIdentityProfiles []UsbIdentityProfile `json:"usb_identity_profiles"`
+	UsbNetwork          *UsbNetworkConfig    `json:"usb_network"`                   // nil uses the defaults
+	MediaDiskCacheSize  int                  `json:"media_disk_cache_size"`         // MiB per LUN, 0 disables the disk cache of HTTP media
+	VirtualMedia        []SavedVirtualMedia  `json:"virtual_media"`                 // mounted again at startup
+	Storage             *StorageSettings     `json:"storage"`                       // nil uses the defaults
+	TouchscreenEnabled  bool                 `json:"touchscreen_enabled,omitempty"` // replaced by UsbDevices, migrated on load
 }
 
 const configPath = "/userdata/kvm_config.json"
@@ -29,6 +39,7 @@ const configPath = "/userdata/kvm_config.json"
 var defaultConfig = &Config{
 	CloudURL:          "https://api.jetkvm.com",
 	AutoUpdateEnabled: true, // Set a default value
+	KeyboardMode:      KeyboardModeBoot,
 }
 
 var config *Config
@@ -53,9 +64,23 @@ func LoadConfig() {
 		return
 	}
 
+	migrateConfig(&loadedConfig)
 	config = &loadedConfig
 }
 
+// migrateConfig moves settings of older versions to where they are kept now
+func migrateConfig(loadedConfig *Config) {
+	if loadedConfig.TouchscreenEnabled {
+		devices := defaultUsbDevices
+		if loadedConfig.UsbDevices != nil {
+			devices = *loadedConfig.UsbDevices
+		}
+		devices.Touchscreen = true
+		loadedConfig.UsbDevices = &devices
+		loadedConfig.TouchscreenEnabled = false
+	}
+}
+
 func SaveConfig() error {
 	file, err := os.Create(configPath)
 	if err != nil {
@@ -0,0 +1,225 @@
+package kvm
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpLeaseTime = 24 * time.Hour
+)
+
+const (
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpDecline  = 4
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+)
+
+const (
+	dhcpOptionSubnetMask    = 1
+	dhcpOptionRequestedIP   = 50
+	dhcpOptionLeaseTime     = 51
+	dhcpOptionMessageType   = 53
+	dhcpOptionServerID      = 54
+	dhcpOptionRenewalTime   = 58
+	dhcpOptionRebindingTime = 59
+	dhcpOptionEnd           = 255
+	dhcpOptionPad           = 0
+)
+
+var dhcpMagicCookie = []byte{99, 130, 83, 99}
+
+// the fixed BOOTP header up to and including the magic cookie
+const dhcpHeaderLength = 240
+
+// dhcpServer hands out a single address on a point-to-point link, there is
+// only ever one client on the other end of a USB cable. No router or DNS is
+// offered, so the host keeps using its own network for everything else.
+type dhcpServer struct {
+	serverAddr netip.Addr
+	clientAddr netip.Addr
+	prefixBits int
+	conn       net.PacketConn
+}
+
+func startDhcpServer(ifname string, serverAddr netip.Addr, clientAddr netip.Addr, prefixBits int) (*dhcpServer, error) {
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				sockErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifname)
+				if sockErr == nil {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_BROADCAST, 1)
+				}
+				if sockErr == nil {
+					sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp4", fmt.Sprintf(":%d", dhcpServerPort))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for DHCP on %s: %w", ifname, err)
+	}
+	server := &dhcpServer{
+		serverAddr: serverAddr,
+		clientAddr: clientAddr,
+		prefixBits: prefixBits,
+		conn:       conn,
+	}
+	go server.serve()
+	return server, nil
+}
+
+func (s *dhcpServer) Close() error {
+	return s.conn.Close()
+}
+
+func (s *dhcpServer) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warnf("DHCP server stopped: %v", err)
+			}
+			return
+		}
+		reply, err := s.handle(buf[:n])
+		if err != nil {
+			logger.Debugf("ignoring DHCP packet: %v", err)
+			continue
+		}
+		if reply == nil {
+			continue
+		}
+		// the client has no address yet, so always answer with a broadcast
+		_, err = s.conn.WriteTo(reply, &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort})
+		if err != nil {
+			logger.Warnf("failed to send DHCP reply: %v", err)
+		}
+	}
+}
+
+// dhcpOptions parses the options following the magic cookie
+func dhcpOptions(packet []byte) (map[byte][]byte, error) {
+	options := make(map[byte][]byte)
+	for i := dhcpHeaderLength; i < len(packet); {
+		code := packet[i]
+		if code == dhcpOptionEnd {
+			break
+		}
+		if code == dhcpOptionPad {
+			i++
+			continue
+		}
+		if i+1 >= len(packet) {
+			return nil, errors.New("truncated option")
+		}
+		length := int(packet[i+1])
+		if i+2+length > len(packet) {
+			return nil, errors.New("truncated option")
+		}
+		options[code] = packet[i+2 : i+2+length]
+		i += 2 + length
+	}
+	return options, nil
+}
+
+// handle returns the reply to a client message, or nil if none is needed
+func (s *dhcpServer) handle(packet []byte) ([]byte, error) {
+	if len(packet) < dhcpHeaderLength {
+		return nil, errors.New("packet too short")
+	}
+	if packet[0] != 1 { // BOOTREQUEST
+		return nil, errors.New("not a request")
+	}
+	if string(packet[236:240]) != string(dhcpMagicCookie) {
+		return nil, errors.New("missing magic cookie")
+	}
+	options, err := dhcpOptions(packet)
+	if err != nil {
+		return nil, err
+	}
+	messageType := options[dhcpOptionMessageType]
+	if len(messageType) != 1 {
+		return nil, errors.New("missing message type")
+	}
+
+	switch messageType[0] {
+	case dhcpDiscover:
+		return s.reply(packet, dhcpOffer), nil
+	case dhcpRequest:
+		if serverID, ok := options[dhcpOptionServerID]; ok && len(serverID) == 4 && netip.AddrFrom4([4]byte(serverID)) != s.serverAddr {
+			// the client picked another server
+			return nil, nil
+		}
+		requested, ok := options[dhcpOptionRequestedIP]
+		if !ok && !netip.AddrFrom4([4]byte(packet[12:16])).IsUnspecified() {
+			requested = packet[12:16] // ciaddr when renewing
+		}
+		if len(requested) == 4 && netip.AddrFrom4([4]byte(requested)) != s.clientAddr {
+			return s.reply(packet, dhcpNak), nil
+		}
+		logger.Infof("USB network host leased %s", s.clientAddr)
+		return s.reply(packet, dhcpAck), nil
+	case dhcpDecline, dhcpRelease:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported message type %d", messageType[0])
+}
+
+func (s *dhcpServer) reply(request []byte, messageType byte) []byte {
+	reply := make([]byte, dhcpHeaderLength, 300)
+	reply[0] = 2                       // BOOTREPLY
+	reply[1] = request[1]              // htype
+	reply[2] = request[2]              // hlen
+	copy(reply[4:8], request[4:8])     // xid
+	copy(reply[10:12], request[10:12]) // flags
+	copy(reply[28:44], request[28:44]) // chaddr
+	copy(reply[236:240], dhcpMagicCookie)
+
+	serverAddr := s.serverAddr.As4()
+	reply = append(reply, dhcpOptionMessageType, 1, messageType)
+	reply = append(reply, dhcpOptionServerID, 4)
+	reply = append(reply, serverAddr[:]...)
+	if messageType == dhcpNak {
+		return append(reply, dhcpOptionEnd)
+	}
+
+	clientAddr := s.clientAddr.As4()
+	copy(reply[16:20], clientAddr[:]) // yiaddr
+	copy(reply[20:24], serverAddr[:]) // siaddr
+
+	mask := net.CIDRMask(s.prefixBits, 32)
+	reply = append(reply, dhcpOptionSubnetMask, 4)
+	reply = append(reply, mask...)
+	reply = appendDhcpDuration(reply, dhcpOptionLeaseTime, dhcpLeaseTime)
+	reply = appendDhcpDuration(reply, dhcpOptionRenewalTime, dhcpLeaseTime/2)
+	reply = appendDhcpDuration(reply, dhcpOptionRebindingTime, dhcpLeaseTime*7/8)
+	return append(reply, dhcpOptionEnd)
+}
+
+func appendDhcpDuration(options []byte, code byte, duration time.Duration) []byte {
+	options = append(options, code, 4)
+	return binary.BigEndian.AppendUint32(options, uint32(duration.Seconds()))
+}
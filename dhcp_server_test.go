@@ -0,0 +1,255 @@
+package kvm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+var (
+	testDhcpServerAddr = netip.MustParseAddr("172.16.55.1")
+	testDhcpClientAddr = netip.MustParseAddr("172.16.55.2")
+	testDhcpMac        = []byte{0x02, 0x4a, 0x4b, 0x56, 0x4d, 0x01}
+)
+
+// dhcpPacket builds a client message, options are appended as given
+func dhcpPacket(mac []byte, ciaddr netip.Addr, options ...[]byte) []byte {
+	packet := make([]byte, dhcpHeaderLength)
+	packet[0] = 1 // BOOTREQUEST
+	packet[1] = 1 // ethernet
+	packet[2] = 6
+	binary.BigEndian.PutUint32(packet[4:8], 0x1234abcd)
+	packet[10] = 0x80 // broadcast flag
+	if ciaddr.IsValid() {
+		addr := ciaddr.As4()
+		copy(packet[12:16], addr[:])
+	}
+	copy(packet[28:44], mac)
+	copy(packet[236:240], dhcpMagicCookie)
+	for _, option := range options {
+		packet = append(packet, option...)
+	}
+	return append(packet, dhcpOptionEnd)
+}
+
+func dhcpOption(code byte, value ...byte) []byte {
+	return append([]byte{code, byte(len(value))}, value...)
+}
+
+func dhcpAddrOption(code byte, addr netip.Addr) []byte {
+	value := addr.As4()
+	return dhcpOption(code, value[:]...)
+}
+
+func TestDhcpOptions(t *testing.T) {
+	packet := dhcpPacket(testDhcpMac, netip.Addr{},
+		[]byte{dhcpOptionPad, dhcpOptionPad},
+		dhcpOption(dhcpOptionMessageType, dhcpDiscover),
+		dhcpOption(12, 'h', 'o', 's', 't'),
+	)
+	// anything after the end option is ignored
+	packet = append(packet, dhcpOptionMessageType, 1, dhcpRequest)
+	options, err := dhcpOptions(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(options[dhcpOptionMessageType], []byte{dhcpDiscover}) || string(options[12]) != "host" {
+		t.Fatalf("got %v", options)
+	}
+
+	for _, truncated := range [][]byte{
+		{dhcpOptionMessageType},
+		{dhcpOptionMessageType, 4, 1},
+	} {
+		packet := append(dhcpPacket(testDhcpMac, netip.Addr{})[:dhcpHeaderLength], truncated...)
+		if _, err := dhcpOptions(packet); err == nil {
+			t.Errorf("truncated option %v accepted", truncated)
+		}
+	}
+}
+
+func TestDhcpServerHandle(t *testing.T) {
+	server := &dhcpServer{
+		serverAddr: testDhcpServerAddr,
+		clientAddr: testDhcpClientAddr,
+		prefixBits: 30,
+	}
+	otherMac := []byte{0x02, 0x4a, 0x4b, 0x56, 0x4d, 0x02}
+	tests := []struct {
+		name    string
+		packet  []byte
+		reply   byte // message type, 0 for no reply
+		mac     []byte
+		invalid bool
+	}{
+		{
+			name:   "discover",
+			packet: dhcpPacket(testDhcpMac, netip.Addr{}, dhcpOption(dhcpOptionMessageType, dhcpDiscover)),
+			reply:  dhcpOffer,
+			mac:    testDhcpMac,
+		},
+		{
+			name: "request after offer",
+			packet: dhcpPacket(testDhcpMac, netip.Addr{},
+				dhcpOption(dhcpOptionMessageType, dhcpRequest),
+				dhcpAddrOption(dhcpOptionServerID, testDhcpServerAddr),
+				dhcpAddrOption(dhcpOptionRequestedIP, testDhcpClientAddr)),
+			reply: dhcpAck,
+			mac:   testDhcpMac,
+		},
+		{
+			name: "renewal from ciaddr",
+			packet: dhcpPacket(testDhcpMac, testDhcpClientAddr,
+				dhcpOption(dhcpOptionMessageType, dhcpRequest)),
+			reply: dhcpAck,
+			mac:   testDhcpMac,
+		},
+		{
+			name: "reboot asking for the old lease",
+			packet: dhcpPacket(testDhcpMac, netip.Addr{},
+				dhcpOption(dhcpOptionMessageType, dhcpRequest),
+				dhcpAddrOption(dhcpOptionRequestedIP, testDhcpClientAddr)),
+			reply: dhcpAck,
+			mac:   testDhcpMac,
+		},
+		{
+			// the only address goes to whoever is on the other end of the cable
+			name:   "discover from another mac",
+			packet: dhcpPacket(otherMac, netip.Addr{}, dhcpOption(dhcpOptionMessageType, dhcpDiscover)),
+			reply:  dhcpOffer,
+			mac:    otherMac,
+		},
+		{
+			name: "request for another address",
+			packet: dhcpPacket(testDhcpMac, netip.Addr{},
+				dhcpOption(dhcpOptionMessageType, dhcpRequest),
+				dhcpAddrOption(dhcpOptionRequestedIP, netip.MustParseAddr("192.168.1.20"))),
+			reply: dhcpNak,
+			mac:   testDhcpMac,
+		},
+		{
+			name: "request to another server",
+			packet: dhcpPacket(testDhcpMac, netip.Addr{},
+				dhcpOption(dhcpOptionMessageType, dhcpRequest),
+				dhcpAddrOption(dhcpOptionServerID, netip.MustParseAddr("192.168.1.1")),
+				dhcpAddrOption(dhcpOptionRequestedIP, testDhcpClientAddr)),
+		},
+		{
+			name:   "release",
+			packet: dhcpPacket(testDhcpMac, testDhcpClientAddr, dhcpOption(dhcpOptionMessageType, dhcpRelease)),
+		},
+		{
+			name:    "no message type",
+			packet:  dhcpPacket(testDhcpMac, netip.Addr{}),
+			invalid: true,
+		},
+		{
+			name:    "unsupported message type",
+			packet:  dhcpPacket(testDhcpMac, netip.Addr{}, dhcpOption(dhcpOptionMessageType, 8)),
+			invalid: true,
+		},
+		{
+			name: "reply instead of request",
+			packet: func() []byte {
+				packet := dhcpPacket(testDhcpMac, netip.Addr{}, dhcpOption(dhcpOptionMessageType, dhcpDiscover))
+				packet[0] = 2
+				return packet
+			}(),
+			invalid: true,
+		},
+		{
+			name: "no magic cookie",
+			packet: func() []byte {
+				packet := dhcpPacket(testDhcpMac, netip.Addr{}, dhcpOption(dhcpOptionMessageType, dhcpDiscover))
+				packet[236] = 0
+				return packet
+			}(),
+			invalid: true,
+		},
+		{
+			name:    "too short",
+			packet:  make([]byte, 100),
+			invalid: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply, err := server.handle(test.packet)
+			if test.invalid {
+				if err == nil {
+					t.Fatal("invalid packet accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.reply == 0 {
+				if reply != nil {
+					t.Fatal("unexpected reply")
+				}
+				return
+			}
+			if reply == nil {
+				t.Fatal("no reply")
+			}
+			assertDhcpReply(t, server, test.packet, reply, test.reply, test.mac)
+		})
+	}
+}
+
+func assertDhcpReply(t *testing.T, server *dhcpServer, request []byte, reply []byte, messageType byte, mac []byte) {
+	t.Helper()
+	if reply[0] != 2 {
+		t.Fatal("not a BOOTREPLY")
+	}
+	if !bytes.Equal(reply[4:8], request[4:8]) || !bytes.Equal(reply[10:12], request[10:12]) {
+		t.Fatal("transaction id or flags not echoed")
+	}
+	if !bytes.Equal(reply[28:34], mac) {
+		t.Fatalf("chaddr: got %x", reply[28:34])
+	}
+	options, err := dhcpOptions(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(options[dhcpOptionMessageType], []byte{messageType}) {
+		t.Fatalf("message type: got %v, want %d", options[dhcpOptionMessageType], messageType)
+	}
+	serverAddr := server.serverAddr.As4()
+	if !bytes.Equal(options[dhcpOptionServerID], serverAddr[:]) {
+		t.Fatalf("server id: got %v", options[dhcpOptionServerID])
+	}
+	if messageType == dhcpNak {
+		if _, ok := options[dhcpOptionLeaseTime]; ok {
+			t.Fatal("NAK with a lease")
+		}
+		return
+	}
+
+	clientAddr := server.clientAddr.As4()
+	if !bytes.Equal(reply[16:20], clientAddr[:]) {
+		t.Fatalf("yiaddr: got %v", reply[16:20])
+	}
+	if !bytes.Equal(options[dhcpOptionSubnetMask], []byte{255, 255, 255, 252}) {
+		t.Fatalf("subnet mask: got %v", options[dhcpOptionSubnetMask])
+	}
+	durations := map[byte]uint32{
+		dhcpOptionLeaseTime:     86400,
+		dhcpOptionRenewalTime:   43200,
+		dhcpOptionRebindingTime: 75600,
+	}
+	for code, seconds := range durations {
+		if value := options[code]; len(value) != 4 || binary.BigEndian.Uint32(value) != seconds {
+			t.Fatalf("option %d: got %v, want %d", code, value, seconds)
+		}
+	}
+	// no router or DNS, the host keeps its own network
+	for _, code := range []byte{3, 6} {
+		if _, ok := options[code]; ok {
+			t.Fatalf("unexpected option %d", code)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	hidDeviceKeyboard      = "keyboard"
+	hidDeviceAbsMouse      = "absMouse"
+	hidDeviceRelMouse      = "relMouse"
+	hidDeviceConsumer      = "consumer"
+	hidDeviceSystemControl = "systemControl"
+	hidDeviceTouchscreen   = "touchscreen"
+)
+
+// hidPressedAt holds the time of the last report for every device that
+// currently has a key or button held on the host
+var hidPressedAt = make(map[string]time.Time)
+var hidPressedLock = sync.Mutex{}
+
+func setHidPressed(device string, pressed bool) {
+	hidPressedLock.Lock()
+	defer hidPressedLock.Unlock()
+	if pressed {
+		hidPressedAt[device] = time.Now()
+	} else {
+		delete(hidPressedAt, device)
+	}
+}
+
+func anyKeyPressed(modifier uint8, keys []uint8) bool {
+	if modifier != 0 {
+		return true
+	}
+	for _, key := range keys {
+		if key != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseAllKeys sends an empty report to every device still holding a key
+// or button, so nothing stays latched on the host
+func releaseAllKeys() error {
+	hidPressedLock.Lock()
+	devices := make([]string, 0, len(hidPressedAt))
+	for device := range hidPressedAt {
+		devices = append(devices, device)
+	}
+	hidPressedLock.Unlock()
+
+	var errs []error
+	for _, device := range devices {
+		var err error
+		switch device {
+		case hidDeviceKeyboard:
+			err = rpcKeyboardReport(0, []uint8{})
+		case hidDeviceAbsMouse:
+			mouseLock.Lock()
+			x, y := lastAbsMouseX, lastAbsMouseY
+			mouseLock.Unlock()
+			err = rpcAbsMouseReport(x, y, 0)
+		case hidDeviceRelMouse:
+			err = rpcRelMouseReport(0, 0, 0)
+		case hidDeviceConsumer:
+			err = rpcConsumerReport(0)
+		case hidDeviceSystemControl:
+			err = rpcSystemControlReport(0)
+		case hidDeviceTouchscreen:
+			err = liftAllTouchContacts()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to release %s: %w", device, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func releaseStuckKeys(reason string) {
+	go func() {
+		hidPressedLock.Lock()
+		pressed := len(hidPressedAt)
+		hidPressedLock.Unlock()
+		if pressed == 0 {
+			return
+		}
+		usbLogger.Infof("releasing all keys: %s", reason)
+		err := releaseAllKeys()
+		if err != nil {
+			usbLogger.Warnf("failed to release keys: %v", err)
+		}
+	}()
+}
+
+func rpcReleaseAllKeys() error {
+	return releaseAllKeys()
+}
+
+func rpcGetKeyReleaseTimeout() int {
+	return config.KeyReleaseTimeout
+}
+
+func rpcSetKeyReleaseTimeout(seconds int) error {
+	if seconds < 0 {
+		return fmt.Errorf("invalid key release timeout: %d", seconds)
+	}
+	config.KeyReleaseTimeout = seconds
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+func init() {
+	go runKeyReleaseWatchdog()
+}
+
+func runKeyReleaseWatchdog() {
+	for {
+		time.Sleep(1 * time.Second)
+		if config == nil || config.KeyReleaseTimeout <= 0 {
+			continue
+		}
+		timeout := time.Duration(config.KeyReleaseTimeout) * time.Second
+		hidPressedLock.Lock()
+		stuck := false
+		for _, pressedAt := range hidPressedAt {
+			if time.Since(pressedAt) > timeout {
+				stuck = true
+				break
+			}
+		}
+		hidPressedLock.Unlock()
+		if stuck {
+			releaseStuckKeys(fmt.Sprintf("held longer than %v", timeout))
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/diskfs/go-diskfs/filesystem/fat32"
+	"github.com/diskfs/go-diskfs/filesystem/iso9660"
+)
+
+// the ISO workspace holds links to the files, it must be on the same file
+// system as imagesFolder
+const imageBuildFolder = "/userdata/jetkvm/image_build"
+
+const (
+	ImageFormatFAT32   = "fat32"
+	ImageFormatISO9660 = "iso9660"
+)
+
+const (
+	defaultImageLabel = "JETKVM"
+	fatClusterSize    = 4096
+	// FAT32 needs enough clusters to not be mistaken for FAT16
+	fatMinImageSize = 64 * 1024 * 1024
+)
+
+// builds share the workspace and may use a lot of space, one at a time
+var imageBuildLock = sync.Mutex{}
+
+// rpcBuildStorageImage packs stored files into a new FAT32 or ISO9660 image
+// that can be mounted like any other image
+func rpcBuildStorageImage(filename string, format string, files []string, label string) error {
+	filename, err := sanitizeStoragePath(filename)
+	if err != nil {
+		return err
+	}
+	if format != ImageFormatFAT32 && format != ImageFormatISO9660 {
+		return fmt.Errorf("unsupported image format: %s", format)
+	}
+	if len(files) == 0 {
+		return errors.New("no files to put into the image")
+	}
+	sources := make([]string, 0, len(files))
+	seen := make(map[string]bool)
+	totalSize := int64(0)
+	for _, file := range files {
+		file, err := sanitizeStoragePath(file)
+		if err != nil {
+			return err
+		}
+		if file == filename || strings.HasSuffix(file, ".incomplete") || isStorageFileBusy(file) {
+			return fmt.Errorf("file can't be put into the image: %s", file)
+		}
+		// files end up in the root of the image, where names ignore case
+		name := strings.ToLower(filepath.Base(file))
+		if seen[name] {
+			return fmt.Errorf("more than one file is named %s", filepath.Base(file))
+		}
+		seen[name] = true
+		fileInfo, err := os.Stat(filepath.Join(imagesFolder, file))
+		if err != nil {
+			return fmt.Errorf("failed to get file info: %w", err)
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return fmt.Errorf("not a file: %s", file)
+		}
+		sources = append(sources, file)
+		totalSize += fileInfo.Size()
+	}
+
+	imageBuildLock.Lock()
+	defer imageBuildLock.Unlock()
+	targetPath := filepath.Join(imagesFolder, filename)
+	if _, err := os.Stat(targetPath); err == nil {
+		return fmt.Errorf("file already exists: %s", filename)
+	}
+	if isStorageFileBusy(filename) {
+		return fmt.Errorf("file is already being written: %s", filename)
+	}
+
+	err = os.MkdirAll(filepath.Dir(targetPath), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create folder: %w", err)
+	}
+	incompletePath := targetPath + ".incomplete"
+	file, err := os.Create(incompletePath)
+	if err != nil {
+		return fmt.Errorf("failed to create image: %w", err)
+	}
+	defer file.Close()
+
+	logger.Infof("building %s image %s from %d files", format, filename, len(sources))
+	if format == ImageFormatFAT32 {
+		err = buildFATImage(file, sources, totalSize, label)
+	} else {
+		err = buildISOImage(file, sources, totalSize, label)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		os.Remove(incompletePath)
+		return fmt.Errorf("failed to build image: %w", err)
+	}
+	err = os.Rename(incompletePath, targetPath)
+	if err != nil {
+		os.Remove(incompletePath)
+		return fmt.Errorf("failed to rename image: %w", err)
+	}
+	go computeStorageFileChecksum(filename)
+	return nil
+}
+
+// imageLabel turns a label into what the file systems accept: upper case
+// letters, digits and underscores
+func imageLabel(label string, maxLength int) string {
+	label = strings.ToUpper(strings.TrimSpace(label))
+	if label == "" {
+		label = defaultImageLabel
+	}
+	label = strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, label)
+	if len(label) > maxLength {
+		label = label[:maxLength]
+	}
+	return label
+}
+
+func fatImageSize(sources []string, totalSize int64) int64 {
+	// every file wastes up to a cluster, directory entries and both FATs
+	// take a few percent on top
+	size := totalSize + int64(len(sources)+1)*fatClusterSize
+	size += size/32 + 8*1024*1024
+	size = (size + 1024*1024 - 1) / (1024 * 1024) * 1024 * 1024
+	return max(size, fatMinImageSize)
+}
+
+func buildFATImage(file *os.File, sources []string, totalSize int64, label string) error {
+	size := fatImageSize(sources, totalSize)
+	err := checkStorageSpace(size)
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	fs, err := fat32.Create(file, size, 0, 512, imageLabel(label, 11))
+	if err != nil {
+		return fmt.Errorf("failed to create FAT32 file system: %w", err)
+	}
+	for _, source := range sources {
+		err = copyIntoFAT(fs, source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyIntoFAT(fs *fat32.FileSystem, source string) error {
+	in, err := os.Open(filepath.Join(imagesFolder, source))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", source, err)
+	}
+	defer in.Close()
+	out, err := fs.OpenFile("/"+filepath.Base(source), os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return fmt.Errorf("failed to create %s in the image: %w", source, err)
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s into the image: %w", source, err)
+	}
+	return nil
+}
+
+func buildISOImage(file *os.File, sources []string, totalSize int64, label string) error {
+	err := checkStorageSpace(totalSize)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(imageBuildFolder, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create build folder: %w", err)
+	}
+	workspace, err := os.MkdirTemp(imageBuildFolder, "iso")
+	if err != nil {
+		return fmt.Errorf("failed to create workspace: %w", err)
+	}
+	// finalizing removes the workspace, but not when failing before
+	defer os.RemoveAll(workspace)
+	for _, source := range sources {
+		// links instead of copies, the files are only read
+		err = os.Link(filepath.Join(imagesFolder, source), filepath.Join(workspace, filepath.Base(source)))
+		if err != nil {
+			return fmt.Errorf("failed to add %s: %w", source, err)
+		}
+	}
+	fs, err := iso9660.Create(file, 0, 0, 2048, workspace)
+	if err != nil {
+		return fmt.Errorf("failed to create ISO9660 file system: %w", err)
+	}
+	// Rock Ridge keeps long and mixed case names for Linux hosts
+	err = fs.Finalize(iso9660.FinalizeOptions{
+		RockRidge:        true,
+		VolumeIdentifier: imageLabel(label, 32),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write ISO9660 file system: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,336 @@
+package kvm
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metadata records live outside imagesFolder so they don't show up as images
+const imageMetadataFolder = "/userdata/jetkvm/image_metadata"
+
+const (
+	ImageTypeISO9660 = "iso9660"
+	ImageTypeGPT     = "gpt"
+	ImageTypeMBR     = "mbr"
+	ImageTypeFAT     = "fat"
+)
+
+const isoSectorSize = 2048
+
+// ImageInfo is what the first sectors of an image tell about it
+type ImageInfo struct {
+	Type        string `json:"type,omitempty"`
+	VolumeLabel string `json:"volumeLabel,omitempty"`
+	Bootable    bool   `json:"bootable"`
+}
+
+// imageMetadataRecord is cached per file, it is stale once size or
+// modification time change
+type imageMetadataRecord struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	SHA256  string    `json:"sha256,omitempty"`
+	ImageInfo
+}
+
+var imageMetadataLock = sync.Mutex{}
+
+// efiSystemPartitionGUID C12A7328-F81F-11D2-BA4B-00A0C93EC93B as stored on disk
+var efiSystemPartitionGUID = []byte{
+	0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11,
+	0xba, 0x4b, 0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b,
+}
+
+// detectImageInfo recognizes ISO9660 (hybrid ISOs included), GPT and MBR
+// partition tables and raw FAT file systems
+func detectImageInfo(r io.ReaderAt) ImageInfo {
+	if info, ok := detectISO9660(r); ok {
+		return info
+	}
+	sector := make([]byte, 512)
+	n, _ := r.ReadAt(sector, 0)
+	if n < len(sector) || sector[510] != 0x55 || sector[511] != 0xAA {
+		return ImageInfo{}
+	}
+	if info, ok := detectFAT(sector); ok {
+		return info
+	}
+	if info, ok := detectGPT(r); ok {
+		return info
+	}
+	info := ImageInfo{Type: ImageTypeMBR}
+	for i := 0; i < 4; i++ {
+		if sector[446+i*16] == 0x80 {
+			info.Bootable = true
+		}
+	}
+	return info
+}
+
+func detectISO9660(r io.ReaderAt) (ImageInfo, bool) {
+	info := ImageInfo{}
+	found := false
+	descriptor := make([]byte, isoSectorSize)
+	// volume descriptors start at sector 16 and end with a terminator
+	for sector := int64(16); sector < 48; sector++ {
+		n, _ := r.ReadAt(descriptor, sector*isoSectorSize)
+		if n < len(descriptor) || string(descriptor[1:6]) != "CD001" {
+			break
+		}
+		switch descriptor[0] {
+		case 0: // boot record
+			if strings.HasPrefix(string(descriptor[7:39]), "EL TORITO SPECIFICATION") {
+				info.Bootable = true
+			}
+		case 1: // primary volume descriptor
+			found = true
+			info.Type = ImageTypeISO9660
+			info.VolumeLabel = strings.TrimSpace(strings.Trim(string(descriptor[40:72]), "\x00"))
+		case 255:
+			return info, found
+		}
+	}
+	return info, found
+}
+
+func detectFAT(sector []byte) (ImageInfo, bool) {
+	// boot sectors of file systems start with a jump
+	if sector[0] != 0xEB && sector[0] != 0xE9 {
+		return ImageInfo{}, false
+	}
+	bytesPerSector := binary.LittleEndian.Uint16(sector[11:13])
+	if bytesPerSector < 512 || bytesPerSector > 4096 || bytesPerSector&(bytesPerSector-1) != 0 {
+		return ImageInfo{}, false
+	}
+	var label string
+	switch {
+	case bytes.HasPrefix(sector[82:90], []byte("FAT32")):
+		label = string(sector[71:82])
+	case bytes.HasPrefix(sector[54:62], []byte("FAT")):
+		label = string(sector[43:54])
+	default:
+		return ImageInfo{}, false
+	}
+	label = strings.TrimSpace(label)
+	if label == "NO NAME" {
+		label = ""
+	}
+	// formatters write boot code even for data volumes, so bootability of
+	// raw FAT isn't reported
+	return ImageInfo{Type: ImageTypeFAT, VolumeLabel: label}, true
+}
+
+func detectGPT(r io.ReaderAt) (ImageInfo, bool) {
+	header := make([]byte, 92)
+	n, _ := r.ReadAt(header, 512)
+	if n < len(header) || string(header[0:8]) != "EFI PART" {
+		return ImageInfo{}, false
+	}
+	info := ImageInfo{Type: ImageTypeGPT}
+	entriesLBA := int64(binary.LittleEndian.Uint64(header[72:80]))
+	entryCount := min(binary.LittleEndian.Uint32(header[80:84]), 128)
+	entrySize := int64(binary.LittleEndian.Uint32(header[84:88]))
+	if entrySize < 128 || entrySize > 4096 {
+		return info, true
+	}
+	entry := make([]byte, entrySize)
+	for i := int64(0); i < int64(entryCount); i++ {
+		n, _ := r.ReadAt(entry, entriesLBA*512+i*entrySize)
+		if n < len(entry) {
+			break
+		}
+		// an EFI system partition makes it bootable on UEFI hosts
+		if bytes.Equal(entry[0:16], efiSystemPartitionGUID) {
+			info.Bootable = true
+			break
+		}
+	}
+	return info, true
+}
+
+func imageMetadataPath(filename string) string {
+	return filepath.Join(imageMetadataFolder, filename+".json")
+}
+
+func readImageMetadataRecord(filename string, fileInfo os.FileInfo) *imageMetadataRecord {
+	recordJSON, err := os.ReadFile(imageMetadataPath(filename))
+	if err != nil {
+		return nil
+	}
+	var record imageMetadataRecord
+	if json.Unmarshal(recordJSON, &record) != nil {
+		return nil
+	}
+	if record.Size != fileInfo.Size() || !record.ModTime.Equal(fileInfo.ModTime()) {
+		return nil
+	}
+	return &record
+}
+
+func writeImageMetadataRecord(filename string, record *imageMetadataRecord) {
+	err := os.MkdirAll(filepath.Dir(imageMetadataPath(filename)), 0755)
+	if err == nil {
+		var recordJSON []byte
+		recordJSON, err = json.Marshal(record)
+		if err == nil {
+			err = os.WriteFile(imageMetadataPath(filename), recordJSON, 0644)
+		}
+	}
+	if err != nil {
+		logger.Warnf("failed to save metadata of %s: %v", filename, err)
+	}
+}
+
+// removeImageMetadata removes the record of a file or the records of a folder
+func removeImageMetadata(filename string) {
+	imageMetadataLock.Lock()
+	defer imageMetadataLock.Unlock()
+	os.Remove(imageMetadataPath(filename))
+	os.RemoveAll(filepath.Join(imageMetadataFolder, filename))
+}
+
+// renameImageMetadata follows a file or folder that was moved, records
+// stay valid as renaming keeps size and modification time
+func renameImageMetadata(from string, to string) {
+	imageMetadataLock.Lock()
+	defer imageMetadataLock.Unlock()
+	err := os.MkdirAll(filepath.Dir(imageMetadataPath(to)), 0755)
+	if err != nil {
+		return
+	}
+	os.Rename(imageMetadataPath(from), imageMetadataPath(to))
+	os.Rename(filepath.Join(imageMetadataFolder, from), filepath.Join(imageMetadataFolder, to))
+}
+
+// getImageMetadata returns the cached metadata of a stored image, detecting
+// the image type if needed. Checksums are only computed on request.
+func getImageMetadata(filename string, fileInfo os.FileInfo) *imageMetadataRecord {
+	imageMetadataLock.Lock()
+	defer imageMetadataLock.Unlock()
+	if record := readImageMetadataRecord(filename, fileInfo); record != nil {
+		return record
+	}
+	file, err := os.Open(filepath.Join(imagesFolder, filename))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	record := &imageMetadataRecord{
+		Size:      fileInfo.Size(),
+		ModTime:   fileInfo.ModTime(),
+		ImageInfo: detectImageInfo(file),
+	}
+	writeImageMetadataRecord(filename, record)
+	return record
+}
+
+// setStorageFileChecksum caches a checksum computed while the file was
+// written, e.g. by a download
+func setStorageFileChecksum(filename string, sha256sum string) {
+	fileInfo, err := os.Stat(filepath.Join(imagesFolder, filename))
+	if err != nil {
+		return
+	}
+	record := getImageMetadata(filename, fileInfo)
+	if record == nil {
+		return
+	}
+	imageMetadataLock.Lock()
+	defer imageMetadataLock.Unlock()
+	record.SHA256 = sha256sum
+	writeImageMetadataRecord(filename, record)
+}
+
+func hashStorageFile(filename string) (string, os.FileInfo, error) {
+	file, err := os.Open(filepath.Join(imagesFolder, filename))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, file)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read file: %w", err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), fileInfo, nil
+}
+
+// computeStorageFileChecksum hashes a file that was just stored, it runs in
+// the background as large images take a while
+func computeStorageFileChecksum(filename string) {
+	sum, _, err := hashStorageFile(filename)
+	if err != nil {
+		logger.Warnf("failed to hash %s: %v", filename, err)
+		return
+	}
+	setStorageFileChecksum(filename, sum)
+}
+
+const (
+	VerificationMatch       = "match"
+	VerificationMismatch    = "mismatch"
+	VerificationNoReference = "noReference" // no checksum was recorded, nothing was compared
+)
+
+type StorageFileVerification struct {
+	SHA256   string `json:"sha256"`
+	Expected string `json:"expected,omitempty"` // checksum cached when the file was stored
+	Status   string `json:"status"`
+	Matches  bool   `json:"matches"`
+}
+
+// rpcVerifyStorageFile hashes the file again and compares the result with the
+// cached checksum, the file must be unchanged since it was stored
+func rpcVerifyStorageFile(filename string) (*StorageFileVerification, error) {
+	filename, err := sanitizeStoragePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	imageMetadataLock.Lock()
+	recordJSON, err := os.ReadFile(imageMetadataPath(filename))
+	imageMetadataLock.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read metadata of %s: %w", filename, err)
+	}
+	var record imageMetadataRecord
+	if recordJSON != nil {
+		if err := json.Unmarshal(recordJSON, &record); err != nil {
+			return nil, fmt.Errorf("failed to parse metadata of %s: %w", filename, err)
+		}
+	}
+
+	sum, fileInfo, err := hashStorageFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	verification := &StorageFileVerification{SHA256: sum, Expected: record.SHA256}
+	if record.SHA256 == "" {
+		// nothing to compare with yet, remember it for the next time
+		setStorageFileChecksum(filename, sum)
+		verification.Status = VerificationNoReference
+		return verification, nil
+	}
+	verification.Matches = sum == record.SHA256
+	verification.Status = VerificationMatch
+	if !verification.Matches {
+		verification.Status = VerificationMismatch
+		logger.Warnf("checksum of %s changed from %s to %s", filename, record.SHA256, sum)
+	} else if record.Size != fileInfo.Size() || !record.ModTime.Equal(fileInfo.ModTime()) {
+		setStorageFileChecksum(filename, sum)
+	}
+	return verification, nil
+}
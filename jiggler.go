@@ -27,12 +27,11 @@ func runJiggler() {
 	for {
 		if jigglerEnabled {
 			if time.Since(lastUserInput) > 20*time.Second {
-				//TODO: change to rel mouse
-				err := rpcAbsMouseReport(1, 1, 0)
+				err := rpcRelMouseReport(1, 1, 0)
 				if err != nil {
 					logger.Warnf("Failed to jiggle mouse: %v", err)
 				}
-				err = rpcAbsMouseReport(0, 0, 0)
+				err = rpcRelMouseReport(-1, -1, 0)
 				if err != nil {
 					logger.Warnf("Failed to reset mouse position: %v", err)
 				}
@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"slices"
 
 	"github.com/pion/webrtc/v4"
 )
@@ -114,6 +115,7 @@ func onRPCMessage(message webrtc.DataChannelMessage, session *Session) {
 		writeJSONRPCResponse(errorResponse, session)
 		return
 	}
+	recordMacroEvent(request.Method, request.Params)
 
 	response := JSONRPCResponse{
 		JSONRPC: "2.0",
@@ -337,12 +339,27 @@ func callRPCHandler(handler RPCHandler, params map[string]interface{}) (interfac
 		paramName := paramNames[i]
 		paramValue, ok := params[paramName]
 		if !ok {
-			return nil, errors.New("missing parameter: " + paramName)
+			if !slices.Contains(handler.Optional, paramName) {
+				return nil, errors.New("missing parameter: " + paramName)
+			}
+			args[i] = reflect.Zero(paramType)
+			continue
 		}
 
 		convertedValue := reflect.ValueOf(paramValue)
 		if !convertedValue.Type().ConvertibleTo(paramType) {
-			if paramType.Kind() == reflect.Slice && (convertedValue.Kind() == reflect.Slice || convertedValue.Kind() == reflect.Array) {
+			if paramType.Kind() == reflect.Slice && paramType.Elem().Kind() == reflect.Struct && convertedValue.Kind() == reflect.Slice {
+				jsonData, err := json.Marshal(convertedValue.Interface())
+				if err != nil {
+					return nil, fmt.Errorf("failed to marshal slice to JSON: %v", err)
+				}
+
+				newSlice := reflect.New(paramType).Interface()
+				if err := json.Unmarshal(jsonData, newSlice); err != nil {
+					return nil, fmt.Errorf("failed to unmarshal JSON into slice: %v", err)
+				}
+				args[i] = reflect.ValueOf(newSlice).Elem()
+			} else if paramType.Kind() == reflect.Slice && (convertedValue.Kind() == reflect.Slice || convertedValue.Kind() == reflect.Array) {
 				newSlice := reflect.MakeSlice(paramType, convertedValue.Len(), convertedValue.Len())
 				for j := 0; j < convertedValue.Len(); j++ {
 					elemValue := convertedValue.Index(j)
@@ -413,11 +430,12 @@ func callRPCHandler(handler RPCHandler, params map[string]interface{}) (interfac
 }
 
 type RPCHandler struct {
-	Func   interface{}
-	Params []string
+	Func     interface{}
+	Params   []string
+	Optional []string // params that are zero when left out, for params added later
 }
 
-func rpcSetMassStorageMode(mode string) (string, error) {
+func rpcSetMassStorageMode(mode string, lun int) (string, error) {
 	log.Printf("[jsonrpc.go:rpcSetMassStorageMode] Setting mass storage mode to: %s", mode)
 	var cdrom bool
 	if mode == "cdrom" {
@@ -427,9 +445,13 @@ func rpcSetMassStorageMode(mode string) (string, error) {
 		return "", fmt.Errorf("invalid mode: %s", mode)
 	}
 
-	log.Printf("[jsonrpc.go:rpcSetMassStorageMode] Setting mass storage mode to: %s", mode)
+	if err := checkMassStorageLun(lun); err != nil {
+		return "", err
+	}
 
-	err := setMassStorageMode(cdrom)
+	log.Printf("[jsonrpc.go:rpcSetMassStorageMode] Setting mass storage mode of LUN %d to: %s", lun, mode)
+
+	err := setMassStorageMode(lun, cdrom)
 	if err != nil {
 		return "", fmt.Errorf("failed to set mass storage mode: %w", err)
 	}
@@ -437,11 +459,14 @@ func rpcSetMassStorageMode(mode string) (string, error) {
 	log.Printf("[jsonrpc.go:rpcSetMassStorageMode] Mass storage mode set to %s", mode)
 
 	// Get the updated mode after setting
-	return rpcGetMassStorageMode()
+	return rpcGetMassStorageMode(lun)
 }
 
-func rpcGetMassStorageMode() (string, error) {
-	cdrom, err := getMassStorageMode()
+func rpcGetMassStorageMode(lun int) (string, error) {
+	if err := checkMassStorageLun(lun); err != nil {
+		return "", err
+	}
+	cdrom, err := getMassStorageMode(lun)
 	if err != nil {
 		return "", fmt.Errorf("failed to get mass storage mode: %w", err)
 	}
@@ -514,12 +539,28 @@ var rpcHandlers = map[string]RPCHandler{
 	"deregisterDevice":       {Func: rpcDeregisterDevice},
 	"getCloudState":          {Func: rpcGetCloudState},
 	"keyboardReport":         {Func: rpcKeyboardReport, Params: []string{"modifier", "keys"}},
+	"getKeyboardLedState":    {Func: rpcGetKeyboardLedState},
+	"getKeyboardMode":        {Func: rpcGetKeyboardMode},
+	"setKeyboardMode":        {Func: rpcSetKeyboardMode, Params: []string{"mode"}},
+	"getKeyboardLayouts":     {Func: rpcGetKeyboardLayouts},
+	"executeTextPaste":       {Func: rpcExecuteTextPaste, Params: []string{"text", "layout", "delay"}},
+	"cancelTextPaste":        {Func: rpcCancelTextPaste},
+	"getTextPasteState":      {Func: rpcGetTextPasteState},
 	"absMouseReport":         {Func: rpcAbsMouseReport, Params: []string{"x", "y", "buttons"}},
-	"wheelReport":            {Func: rpcWheelReport, Params: []string{"wheelY"}},
+	"relMouseReport":         {Func: rpcRelMouseReport, Params: []string{"dx", "dy", "buttons"}},
+	"wheelReport":            {Func: rpcWheelReport, Params: []string{"wheelY", "wheelX"}, Optional: []string{"wheelX"}},
+	"consumerReport":         {Func: rpcConsumerReport, Params: []string{"usage"}},
+	"systemControlReport":    {Func: rpcSystemControlReport, Params: []string{"usage"}},
+	"touchReport":            {Func: rpcTouchReport, Params: []string{"contacts"}},
+	"getTouchscreenState":    {Func: rpcGetTouchscreenState},
+	"setTouchscreenState":    {Func: rpcSetTouchscreenState, Params: []string{"enabled"}},
+	"releaseAllKeys":         {Func: rpcReleaseAllKeys},
+	"getKeyReleaseTimeout":   {Func: rpcGetKeyReleaseTimeout},
+	"setKeyReleaseTimeout":   {Func: rpcSetKeyReleaseTimeout, Params: []string{"seconds"}},
 	"getVideoState":          {Func: rpcGetVideoState},
 	"getUSBState":            {Func: rpcGetUSBState},
-	"unmountImage":           {Func: rpcUnmountImage},
-	"rpcMountBuiltInImage":   {Func: rpcMountBuiltInImage, Params: []string{"filename"}},
+	"unmountImage":           {Func: rpcUnmountImage, Params: []string{"lun"}, Optional: []string{"lun"}},
+	"rpcMountBuiltInImage":   {Func: rpcMountBuiltInImage, Params: []string{"filename", "lun"}, Optional: []string{"lun"}},
 	"setJigglerState":        {Func: rpcSetJigglerState, Params: []string{"enabled"}},
 	"getJigglerState":        {Func: rpcGetJigglerState},
 	"sendWOLMagicPacket":     {Func: rpcSendWOLMagicPacket, Params: []string{"macAddress"}},
@@ -537,21 +578,53 @@ var rpcHandlers = map[string]RPCHandler{
 	"setDevModeState":        {Func: rpcSetDevModeState, Params: []string{"enabled"}},
 	"getSSHKeyState":         {Func: rpcGetSSHKeyState},
 	"setSSHKeyState":         {Func: rpcSetSSHKeyState, Params: []string{"sshKey"}},
-	"setMassStorageMode":     {Func: rpcSetMassStorageMode, Params: []string{"mode"}},
-	"getMassStorageMode":     {Func: rpcGetMassStorageMode},
+	"setMassStorageMode":     {Func: rpcSetMassStorageMode, Params: []string{"mode", "lun"}, Optional: []string{"lun"}},
+	"getMassStorageMode":     {Func: rpcGetMassStorageMode, Params: []string{"lun"}, Optional: []string{"lun"}},
 	"isUpdatePending":        {Func: rpcIsUpdatePending},
 	"getUsbEmulationState":   {Func: rpcGetUsbEmulationState},
 	"setUsbEmulationState":   {Func: rpcSetUsbEmulationState, Params: []string{"enabled"}},
 	"checkMountUrl":          {Func: rpcCheckMountUrl, Params: []string{"url"}},
 	"getVirtualMediaState":   {Func: rpcGetVirtualMediaState},
+	"getVirtualMediaStates":  {Func: rpcGetVirtualMediaStates},
 	"getStorageSpace":        {Func: rpcGetStorageSpace},
-	"mountWithHTTP":          {Func: rpcMountWithHTTP, Params: []string{"url", "mode"}},
-	"mountWithWebRTC":        {Func: rpcMountWithWebRTC, Params: []string{"filename", "size", "mode"}},
-	"mountWithStorage":       {Func: rpcMountWithStorage, Params: []string{"filename", "mode"}},
+	"mountWithHTTP":          {Func: rpcMountWithHTTP, Params: []string{"url", "mode", "lun"}, Optional: []string{"lun"}},
+	"mountWithWebRTC":        {Func: rpcMountWithWebRTC, Params: []string{"filename", "size", "mode", "lun"}, Optional: []string{"lun"}},
+	"mountWithStorage":       {Func: rpcMountWithStorage, Params: []string{"filename", "mode", "lun"}, Optional: []string{"lun"}},
+	"getMediaOverlay":        {Func: rpcGetMediaOverlay, Params: []string{"lun"}},
+	"discardMediaOverlay":    {Func: rpcDiscardMediaOverlay, Params: []string{"lun"}},
+	"commitMediaOverlay":     {Func: rpcCommitMediaOverlay, Params: []string{"lun", "filename"}},
+	"getMediaDiskCacheSize":  {Func: rpcGetMediaDiskCacheSize},
+	"setMediaDiskCacheSize":  {Func: rpcSetMediaDiskCacheSize, Params: []string{"sizeMB"}},
 	"listStorageFiles":       {Func: rpcListStorageFiles},
 	"deleteStorageFile":      {Func: rpcDeleteStorageFile, Params: []string{"filename"}},
-	"startStorageFileUpload": {Func: rpcStartStorageFileUpload, Params: []string{"filename", "size"}},
+	"renameStorageFile":      {Func: rpcRenameStorageFile, Params: []string{"from", "to"}},
+	"createStorageFolder":    {Func: rpcCreateStorageFolder, Params: []string{"folder"}},
+	"getStorageSettings":     {Func: rpcGetStorageSettings},
+	"setStorageSettings":     {Func: rpcSetStorageSettings, Params: []string{"settings"}},
+	"cleanupStorage":         {Func: rpcCleanupStorage},
+	"downloadStorageFile":    {Func: rpcDownloadStorageFile, Params: []string{"url", "filename", "sha256"}},
+	"listDownloads":          {Func: rpcListDownloads},
+	"cancelDownload":         {Func: rpcCancelDownload, Params: []string{"id"}},
+	"decompressStorageFile":  {Func: rpcDecompressStorageFile, Params: []string{"filename", "removeSource"}, Optional: []string{"removeSource"}},
+	"buildStorageImage":      {Func: rpcBuildStorageImage, Params: []string{"filename", "format", "files", "label"}},
+	"verifyStorageFile":      {Func: rpcVerifyStorageFile, Params: []string{"filename"}},
+	"startStorageFileUpload": {Func: rpcStartStorageFileUpload, Params: []string{"filename", "size", "sha256"}, Optional: []string{"sha256"}},
 	"getWakeOnLanDevices":    {Func: rpcGetWakeOnLanDevices},
 	"setWakeOnLanDevices":    {Func: rpcSetWakeOnLanDevices, Params: []string{"params"}},
 	"resetConfig":            {Func: rpcResetConfig},
+	"getUsbIdentityProfiles": {Func: rpcGetUsbIdentityProfiles},
+	"setUsbIdentityProfiles": {Func: rpcSetUsbIdentityProfiles, Params: []string{"params"}},
+	"getUsbIdentityProfile":  {Func: rpcGetUsbIdentityProfile},
+	"setUsbIdentityProfile":  {Func: rpcSetUsbIdentityProfile, Params: []string{"name"}},
+	"getUsbDevices":          {Func: rpcGetUsbDevices},
+	"setUsbDevices":          {Func: rpcSetUsbDevices, Params: []string{"devices"}},
+	"getUsbNetworkConfig":    {Func: rpcGetUsbNetworkConfig},
+	"setUsbNetworkConfig":    {Func: rpcSetUsbNetworkConfig, Params: []string{"config"}},
+	"startMacroRecording":    {Func: rpcStartMacroRecording, Params: []string{"name", "overwrite"}, Optional: []string{"overwrite"}},
+	"stopMacroRecording":     {Func: rpcStopMacroRecording},
+	"playMacro":              {Func: rpcPlayMacro, Params: []string{"name", "speed"}},
+	"stopMacroPlayback":      {Func: rpcStopMacroPlayback},
+	"getMacroState":          {Func: rpcGetMacroState},
+	"listMacros":             {Func: rpcListMacros},
+	"deleteMacro":            {Func: rpcDeleteMacro, Params: []string{"name"}},
 }
@@ -0,0 +1,286 @@
+package kvm
+
+import "sort"
+
+const (
+	modifierLeftShift = 0x02
+	modifierRightAlt  = 0x40 // AltGr on international layouts
+)
+
+const (
+	keyEnter = 0x28
+	keyTab   = 0x2b
+	keySpace = 0x2c
+)
+
+type keyStroke struct {
+	Modifier uint8
+	Key      uint8
+}
+
+// layoutKey describes what a single key produces on its own, with shift and
+// with AltGr. Zero runes mean the combination produces nothing useful.
+type layoutKey struct {
+	Key    uint8
+	Normal rune
+	Shift  rune
+	AltGr  rune
+}
+
+type keyboardLayout struct {
+	Keys []layoutKey
+	// DeadKeys maps the accent character to the stroke that arms it
+	DeadKeys map[rune]keyStroke
+	// Composed maps a character to the dead key and base character typing it
+	Composed map[rune][2]rune
+}
+
+// qwertyLetters returns the letter keys of a latin layout, overrides move a
+// letter to a different key position
+func qwertyLetters(overrides map[rune]uint8) []layoutKey {
+	keys := make([]layoutKey, 0, 26)
+	for i := 0; i < 26; i++ {
+		letter := rune('a' + i)
+		key := uint8(0x04 + i)
+		if override, ok := overrides[letter]; ok {
+			key = override
+		}
+		keys = append(keys, layoutKey{Key: key, Normal: letter, Shift: letter - 'a' + 'A'})
+	}
+	return keys
+}
+
+func composeTable(dead rune, pairs string) map[rune][2]rune {
+	table := make(map[rune][2]rune)
+	runes := []rune(pairs)
+	for i := 0; i+1 < len(runes); i += 2 {
+		table[runes[i]] = [2]rune{dead, runes[i+1]}
+	}
+	return table
+}
+
+func mergeComposeTables(tables ...map[rune][2]rune) map[rune][2]rune {
+	merged := make(map[rune][2]rune)
+	for _, table := range tables {
+		for k, v := range table {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+var keyboardLayouts = map[string]*keyboardLayout{
+	"en-US": {
+		Keys: append(qwertyLetters(nil), []layoutKey{
+			{Key: 0x1e, Normal: '1', Shift: '!'},
+			{Key: 0x1f, Normal: '2', Shift: '@'},
+			{Key: 0x20, Normal: '3', Shift: '#'},
+			{Key: 0x21, Normal: '4', Shift: '$'},
+			{Key: 0x22, Normal: '5', Shift: '%'},
+			{Key: 0x23, Normal: '6', Shift: '^'},
+			{Key: 0x24, Normal: '7', Shift: '&'},
+			{Key: 0x25, Normal: '8', Shift: '*'},
+			{Key: 0x26, Normal: '9', Shift: '('},
+			{Key: 0x27, Normal: '0', Shift: ')'},
+			{Key: 0x2d, Normal: '-', Shift: '_'},
+			{Key: 0x2e, Normal: '=', Shift: '+'},
+			{Key: 0x2f, Normal: '[', Shift: '{'},
+			{Key: 0x30, Normal: ']', Shift: '}'},
+			{Key: 0x31, Normal: '\\', Shift: '|'},
+			{Key: 0x33, Normal: ';', Shift: ':'},
+			{Key: 0x34, Normal: '\'', Shift: '"'},
+			{Key: 0x35, Normal: '`', Shift: '~'},
+			{Key: 0x36, Normal: ',', Shift: '<'},
+			{Key: 0x37, Normal: '.', Shift: '>'},
+			{Key: 0x38, Normal: '/', Shift: '?'},
+		}...),
+	},
+	"en-GB": {
+		Keys: append(qwertyLetters(nil), []layoutKey{
+			{Key: 0x1e, Normal: '1', Shift: '!'},
+			{Key: 0x1f, Normal: '2', Shift: '"'},
+			{Key: 0x20, Normal: '3', Shift: '£'},
+			{Key: 0x21, Normal: '4', Shift: '$', AltGr: '€'},
+			{Key: 0x22, Normal: '5', Shift: '%'},
+			{Key: 0x23, Normal: '6', Shift: '^'},
+			{Key: 0x24, Normal: '7', Shift: '&'},
+			{Key: 0x25, Normal: '8', Shift: '*'},
+			{Key: 0x26, Normal: '9', Shift: '('},
+			{Key: 0x27, Normal: '0', Shift: ')'},
+			{Key: 0x2d, Normal: '-', Shift: '_'},
+			{Key: 0x2e, Normal: '=', Shift: '+'},
+			{Key: 0x2f, Normal: '[', Shift: '{'},
+			{Key: 0x30, Normal: ']', Shift: '}'},
+			{Key: 0x32, Normal: '#', Shift: '~'},
+			{Key: 0x33, Normal: ';', Shift: ':'},
+			{Key: 0x34, Normal: '\'', Shift: '@'},
+			{Key: 0x35, Normal: '`', Shift: '¬'},
+			{Key: 0x36, Normal: ',', Shift: '<'},
+			{Key: 0x37, Normal: '.', Shift: '>'},
+			{Key: 0x38, Normal: '/', Shift: '?'},
+			{Key: 0x64, Normal: '\\', Shift: '|'},
+		}...),
+	},
+	"de-DE": {
+		Keys: append(qwertyLetters(map[rune]uint8{'y': 0x1d, 'z': 0x1c}), []layoutKey{
+			{Key: 0x14, AltGr: '@'},
+			{Key: 0x08, AltGr: '€'},
+			{Key: 0x10, AltGr: 'µ'},
+			{Key: 0x1e, Normal: '1', Shift: '!'},
+			{Key: 0x1f, Normal: '2', Shift: '"', AltGr: '²'},
+			{Key: 0x20, Normal: '3', Shift: '§', AltGr: '³'},
+			{Key: 0x21, Normal: '4', Shift: '$'},
+			{Key: 0x22, Normal: '5', Shift: '%'},
+			{Key: 0x23, Normal: '6', Shift: '&'},
+			{Key: 0x24, Normal: '7', Shift: '/', AltGr: '{'},
+			{Key: 0x25, Normal: '8', Shift: '(', AltGr: '['},
+			{Key: 0x26, Normal: '9', Shift: ')', AltGr: ']'},
+			{Key: 0x27, Normal: '0', Shift: '=', AltGr: '}'},
+			{Key: 0x2d, Normal: 'ß', Shift: '?', AltGr: '\\'},
+			{Key: 0x2f, Normal: 'ü', Shift: 'Ü'},
+			{Key: 0x30, Normal: '+', Shift: '*', AltGr: '~'},
+			{Key: 0x32, Normal: '#', Shift: '\''},
+			{Key: 0x33, Normal: 'ö', Shift: 'Ö'},
+			{Key: 0x34, Normal: 'ä', Shift: 'Ä'},
+			{Key: 0x35, Shift: '°'},
+			{Key: 0x36, Normal: ',', Shift: ';'},
+			{Key: 0x37, Normal: '.', Shift: ':'},
+			{Key: 0x38, Normal: '-', Shift: '_'},
+			{Key: 0x64, Normal: '<', Shift: '>', AltGr: '|'},
+		}...),
+		DeadKeys: map[rune]keyStroke{
+			'^': {Key: 0x35},
+			'´': {Key: 0x2e},
+			'`': {Modifier: modifierLeftShift, Key: 0x2e},
+		},
+		Composed: mergeComposeTables(
+			composeTable('´', "áaéeíióoúuýyÁAÉEÍIÓOÚUÝY"),
+			composeTable('`', "àaèeìiòoùuÀAÈEÌIÒOÙU"),
+			composeTable('^', "âaêeîiôoûuÂAÊEÎIÔOÛU"),
+		),
+	},
+	"fr-FR": {
+		Keys: append(qwertyLetters(map[rune]uint8{'a': 0x14, 'q': 0x04, 'z': 0x1a, 'w': 0x1d, 'm': 0x33}), []layoutKey{
+			{Key: 0x08, AltGr: '€'},
+			{Key: 0x1e, Normal: '&', Shift: '1'},
+			{Key: 0x1f, Normal: 'é', Shift: '2'},
+			{Key: 0x20, Normal: '"', Shift: '3', AltGr: '#'},
+			{Key: 0x21, Normal: '\'', Shift: '4', AltGr: '{'},
+			{Key: 0x22, Normal: '(', Shift: '5', AltGr: '['},
+			{Key: 0x23, Normal: '-', Shift: '6', AltGr: '|'},
+			{Key: 0x24, Normal: 'è', Shift: '7'},
+			{Key: 0x25, Normal: '_', Shift: '8', AltGr: '\\'},
+			{Key: 0x26, Normal: 'ç', Shift: '9', AltGr: '^'},
+			{Key: 0x27, Normal: 'à', Shift: '0', AltGr: '@'},
+			{Key: 0x2d, Normal: ')', Shift: '°', AltGr: ']'},
+			{Key: 0x2e, Normal: '=', Shift: '+', AltGr: '}'},
+			{Key: 0x30, Normal: '$', Shift: '£', AltGr: '¤'},
+			{Key: 0x32, Normal: '*', Shift: 'µ'},
+			{Key: 0x34, Normal: 'ù', Shift: '%'},
+			{Key: 0x35, Normal: '²'},
+			{Key: 0x10, Normal: ',', Shift: '?'},
+			{Key: 0x36, Normal: ';', Shift: '.'},
+			{Key: 0x37, Normal: ':', Shift: '/'},
+			{Key: 0x38, Normal: '!', Shift: '§'},
+			{Key: 0x64, Normal: '<', Shift: '>'},
+		}...),
+		DeadKeys: map[rune]keyStroke{
+			'^': {Key: 0x2f},
+			'¨': {Modifier: modifierLeftShift, Key: 0x2f},
+			'~': {Modifier: modifierRightAlt, Key: 0x1f},
+			'`': {Modifier: modifierRightAlt, Key: 0x24},
+		},
+		Composed: mergeComposeTables(
+			composeTable('^', "âaêeîiôoûuÂAÊEÎIÔOÛU"),
+			composeTable('¨', "äaëeïiöoüuÿyÄAËEÏIÖOÜU"),
+			composeTable('~', "ãaõoñnÃAÕOÑN"),
+			composeTable('`', "ìiòoÀAÈEÌIÒOÙU"),
+		),
+	},
+	"ja": {
+		Keys: append(qwertyLetters(nil), []layoutKey{
+			{Key: 0x1e, Normal: '1', Shift: '!'},
+			{Key: 0x1f, Normal: '2', Shift: '"'},
+			{Key: 0x20, Normal: '3', Shift: '#'},
+			{Key: 0x21, Normal: '4', Shift: '$'},
+			{Key: 0x22, Normal: '5', Shift: '%'},
+			{Key: 0x23, Normal: '6', Shift: '&'},
+			{Key: 0x24, Normal: '7', Shift: '\''},
+			{Key: 0x25, Normal: '8', Shift: '('},
+			{Key: 0x26, Normal: '9', Shift: ')'},
+			{Key: 0x27, Normal: '0'},
+			{Key: 0x2d, Normal: '-', Shift: '='},
+			{Key: 0x2e, Normal: '^', Shift: '~'},
+			{Key: 0x89, Normal: '¥', Shift: '|'}, // International3 (Yen)
+			{Key: 0x2f, Normal: '@', Shift: '`'},
+			{Key: 0x30, Normal: '[', Shift: '{'},
+			{Key: 0x32, Normal: ']', Shift: '}'},
+			{Key: 0x33, Normal: ';', Shift: '+'},
+			{Key: 0x34, Normal: ':', Shift: '*'},
+			{Key: 0x36, Normal: ',', Shift: '<'},
+			{Key: 0x37, Normal: '.', Shift: '>'},
+			{Key: 0x38, Normal: '/', Shift: '?'},
+			{Key: 0x87, Normal: '\\', Shift: '_'}, // International1 (Ro)
+		}...),
+	},
+}
+
+var keyboardLayoutStrokes = make(map[string]map[rune][]keyStroke)
+
+func init() {
+	for name, layout := range keyboardLayouts {
+		keyboardLayoutStrokes[name] = layout.strokes()
+	}
+}
+
+// strokes flattens the layout into the key sequence needed for every
+// character it can type
+func (l *keyboardLayout) strokes() map[rune][]keyStroke {
+	strokes := map[rune][]keyStroke{
+		'\n': {{Key: keyEnter}},
+		'\t': {{Key: keyTab}},
+		' ':  {{Key: keySpace}},
+	}
+	for _, key := range l.Keys {
+		if key.Normal != 0 {
+			strokes[key.Normal] = []keyStroke{{Key: key.Key}}
+		}
+		if key.Shift != 0 {
+			strokes[key.Shift] = []keyStroke{{Modifier: modifierLeftShift, Key: key.Key}}
+		}
+		if key.AltGr != 0 {
+			strokes[key.AltGr] = []keyStroke{{Modifier: modifierRightAlt, Key: key.Key}}
+		}
+	}
+	for char, composed := range l.Composed {
+		if _, ok := strokes[char]; ok {
+			continue
+		}
+		dead, ok := l.DeadKeys[composed[0]]
+		if !ok {
+			continue
+		}
+		base, ok := strokes[composed[1]]
+		if !ok {
+			continue
+		}
+		strokes[char] = append([]keyStroke{dead}, base...)
+	}
+	// a dead key followed by space types the accent itself
+	for char, dead := range l.DeadKeys {
+		if _, ok := strokes[char]; ok {
+			continue
+		}
+		strokes[char] = []keyStroke{dead, {Key: keySpace}}
+	}
+	return strokes
+}
+
+func rpcGetKeyboardLayouts() []string {
+	names := make([]string, 0, len(keyboardLayouts))
+	for name := range keyboardLayouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,365 @@
+package kvm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const macrosFolder = "/userdata/jetkvm/macros"
+
+// maxMacroEvents bounds a recording that is never stopped, mouse moves alone
+// come in at up to 60 per second
+const maxMacroEvents = 100000
+
+// macroHandlers are the RPC methods captured while recording, replaying a
+// macro calls them again with the recorded params
+var macroHandlers = map[string]RPCHandler{
+	"keyboardReport":      {Func: rpcKeyboardReport, Params: []string{"modifier", "keys"}},
+	"absMouseReport":      {Func: rpcAbsMouseReport, Params: []string{"x", "y", "buttons"}},
+	"relMouseReport":      {Func: rpcRelMouseReport, Params: []string{"dx", "dy", "buttons"}},
+	"wheelReport":         {Func: rpcWheelReport, Params: []string{"wheelY", "wheelX"}, Optional: []string{"wheelX"}},
+	"consumerReport":      {Func: rpcConsumerReport, Params: []string{"usage"}},
+	"systemControlReport": {Func: rpcSystemControlReport, Params: []string{"usage"}},
+	"touchReport":         {Func: rpcTouchReport, Params: []string{"contacts"}},
+}
+
+type MacroEvent struct {
+	Time   int64                  `json:"time"` // milliseconds since the recording started
+	Method string                 `json:"method"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+type Macro struct {
+	Name      string       `json:"name"`
+	CreatedAt time.Time    `json:"createdAt"`
+	Duration  int64        `json:"duration"`
+	Events    []MacroEvent `json:"events"`
+}
+
+type MacroInfo struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	Duration  int64     `json:"duration"`
+	Events    int       `json:"events"`
+	Truncated bool      `json:"truncated,omitempty"` // events past maxMacroEvents were dropped
+}
+
+type MacroState struct {
+	Recording bool   `json:"recording"`
+	Playing   bool   `json:"playing"`
+	Name      string `json:"name,omitempty"`
+}
+
+var macroLock = sync.Mutex{}
+var recordingMacro *Macro
+var recordingStartedAt time.Time
+var recordingOverwrite bool
+var recordingTruncated bool
+var playingMacro string
+var macroPlaybackCancel context.CancelFunc
+
+func getMacroState() MacroState {
+	state := MacroState{}
+	if recordingMacro != nil {
+		state.Recording = true
+		state.Name = recordingMacro.Name
+	} else if playingMacro != "" {
+		state.Playing = true
+		state.Name = playingMacro
+	}
+	return state
+}
+
+func triggerMacroStateUpdate() {
+	macroLock.Lock()
+	state := getMacroState()
+	macroLock.Unlock()
+	go func() {
+		if currentSession == nil {
+			return
+		}
+		writeJSONRPCEvent("macroState", state, currentSession)
+	}()
+}
+
+func macroFilePath(name string) (string, error) {
+	sanitized, err := sanitizeFilename(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(macrosFolder, sanitized+".json"), nil
+}
+
+// recordMacroEvent is called for every successful RPC, it only keeps HID reports
+func recordMacroEvent(method string, params map[string]interface{}) {
+	if _, ok := macroHandlers[method]; !ok {
+		return
+	}
+	macroLock.Lock()
+	defer macroLock.Unlock()
+	if recordingMacro == nil {
+		return
+	}
+	if len(recordingMacro.Events) >= maxMacroEvents {
+		if !recordingTruncated {
+			logger.Warnf("macro %s reached %d events, dropping the rest", recordingMacro.Name, maxMacroEvents)
+			recordingTruncated = true
+		}
+		return
+	}
+	recordingMacro.Events = append(recordingMacro.Events, MacroEvent{
+		Time:   time.Since(recordingStartedAt).Milliseconds(),
+		Method: method,
+		Params: params,
+	})
+}
+
+// rpcStartMacroRecording refuses names of saved macros unless overwrite is
+// set, overwrite is optional
+func rpcStartMacroRecording(name string, overwrite bool) error {
+	name, err := sanitizeFilename(name)
+	if err != nil {
+		return err
+	}
+	filePath, err := macroFilePath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filePath); err == nil && !overwrite {
+		return fmt.Errorf("macro already exists: %s", name)
+	}
+	macroLock.Lock()
+	if recordingMacro != nil {
+		macroLock.Unlock()
+		return errors.New("a macro is already being recorded")
+	}
+	if playingMacro != "" {
+		macroLock.Unlock()
+		return errors.New("can't record while a macro is playing")
+	}
+	recordingStartedAt = time.Now()
+	recordingOverwrite = overwrite
+	recordingTruncated = false
+	recordingMacro = &Macro{
+		Name:      name,
+		CreatedAt: recordingStartedAt,
+		Events:    make([]MacroEvent, 0),
+	}
+	macroLock.Unlock()
+	triggerMacroStateUpdate()
+	return nil
+}
+
+func rpcStopMacroRecording() (*MacroInfo, error) {
+	macroLock.Lock()
+	macro := recordingMacro
+	overwrite := recordingOverwrite
+	truncated := recordingTruncated
+	recordingMacro = nil
+	macroLock.Unlock()
+	if macro == nil {
+		return nil, errors.New("no macro is being recorded")
+	}
+	triggerMacroStateUpdate()
+	macro.Duration = time.Since(recordingStartedAt).Milliseconds()
+
+	filePath, err := macroFilePath(macro.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(macrosFolder, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create macros folder: %w", err)
+	}
+	data, err := json.Marshal(macro)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode macro: %w", err)
+	}
+	// another macro of the same name may have been saved in the meantime
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if !overwrite {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(filePath, flags, 0644)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("macro already exists: %s", macro.Name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save macro: %w", err)
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filePath)
+		return nil, fmt.Errorf("failed to save macro: %w", err)
+	}
+	logger.Infof("recorded macro %s with %d events", macro.Name, len(macro.Events))
+	return &MacroInfo{
+		Name:      macro.Name,
+		CreatedAt: macro.CreatedAt,
+		Duration:  macro.Duration,
+		Events:    len(macro.Events),
+		Truncated: truncated,
+	}, nil
+}
+
+func loadMacro(name string) (*Macro, error) {
+	filePath, err := macroFilePath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("macro does not exist: %s", name)
+		}
+		return nil, fmt.Errorf("failed to read macro: %w", err)
+	}
+	var macro Macro
+	if err := json.Unmarshal(data, &macro); err != nil {
+		return nil, fmt.Errorf("failed to parse macro: %w", err)
+	}
+	return &macro, nil
+}
+
+// rpcPlayMacro replays a macro in the background, speed scales the recorded
+// timing (2 plays twice as fast), 0 keeps the original timing
+func rpcPlayMacro(name string, speed float64) error {
+	if speed < 0 {
+		return fmt.Errorf("invalid playback speed: %v", speed)
+	}
+	if speed == 0 {
+		speed = 1
+	}
+	macro, err := loadMacro(name)
+	if err != nil {
+		return err
+	}
+
+	macroLock.Lock()
+	if recordingMacro != nil {
+		macroLock.Unlock()
+		return errors.New("can't play while a macro is being recorded")
+	}
+	if playingMacro != "" {
+		macroLock.Unlock()
+		return errors.New("another macro is playing")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	playingMacro = macro.Name
+	macroPlaybackCancel = cancel
+	macroLock.Unlock()
+	triggerMacroStateUpdate()
+
+	go func() {
+		defer func() {
+			cancel()
+			macroLock.Lock()
+			playingMacro = ""
+			macroPlaybackCancel = nil
+			macroLock.Unlock()
+			triggerMacroStateUpdate()
+		}()
+		err := runMacro(ctx, macro, speed)
+		if err != nil {
+			logger.Warnf("macro %s playback stopped: %v", macro.Name, err)
+		}
+		// the recording may end with keys or buttons still held
+		if err := releaseAllKeys(); err != nil {
+			logger.Warnf("failed to release keys after macro %s: %v", macro.Name, err)
+		}
+	}()
+	return nil
+}
+
+func runMacro(ctx context.Context, macro *Macro, speed float64) error {
+	startedAt := time.Now()
+	for _, event := range macro.Events {
+		handler, ok := macroHandlers[event.Method]
+		if !ok {
+			return fmt.Errorf("unsupported method in macro: %s", event.Method)
+		}
+		due := time.Duration(float64(event.Time) * float64(time.Millisecond) / speed)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(startedAt.Add(due))):
+		}
+		if _, err := callRPCHandler(handler, event.Params); err != nil {
+			return fmt.Errorf("%s failed: %w", event.Method, err)
+		}
+	}
+	return nil
+}
+
+func rpcStopMacroPlayback() error {
+	macroLock.Lock()
+	defer macroLock.Unlock()
+	if macroPlaybackCancel == nil {
+		return errors.New("no macro is playing")
+	}
+	macroPlaybackCancel()
+	return nil
+}
+
+func rpcGetMacroState() MacroState {
+	macroLock.Lock()
+	defer macroLock.Unlock()
+	return getMacroState()
+}
+
+func rpcListMacros() ([]MacroInfo, error) {
+	files, err := os.ReadDir(macrosFolder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []MacroInfo{}, nil
+		}
+		return nil, fmt.Errorf("failed to read macros folder: %w", err)
+	}
+
+	macros := make([]MacroInfo, 0)
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		macro, err := loadMacro(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil {
+			logger.Warnf("skipping macro %s: %v", file.Name(), err)
+			continue
+		}
+		macros = append(macros, MacroInfo{
+			Name:      macro.Name,
+			CreatedAt: macro.CreatedAt,
+			Duration:  macro.Duration,
+			Events:    len(macro.Events),
+		})
+	}
+	sort.Slice(macros, func(i, j int) bool {
+		return macros[i].Name < macros[j].Name
+	})
+	return macros, nil
+}
+
+func rpcDeleteMacro(name string) error {
+	filePath, err := macroFilePath(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("macro does not exist: %s", name)
+		}
+		return fmt.Errorf("failed to delete macro: %w", err)
+	}
+	return nil
+}
@@ -32,6 +32,8 @@ func Main() {
 	}
 
 	go TimeSyncLoop()
+	go restoreVirtualMedia()
+	go runStorageCleanup()
 
 	StartNativeCtrlSocketServer()
 	StartNativeVideoSocketServer()
@@ -0,0 +1,399 @@
+package kvm
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	mediaCacheChunkSize = 64 * 1024
+	// memory cache of each LUN, 8 MiB
+	mediaCacheMemoryChunks = 128
+	// readahead doubles while the host reads sequentially, up to 2 MiB
+	mediaCacheMinReadahead = 4
+	mediaCacheMaxReadahead = 32
+	// adjacent missing chunks are fetched together, up to 512 KiB per request
+	mediaCacheMaxFetchChunks  = 8
+	mediaCacheParallelFetches = 4
+
+	mediaCacheFolder = "/userdata/jetkvm/media_cache"
+	// limits the disk cache setting, in MiB
+	mediaDiskCacheMaxSize = 4096
+)
+
+type MediaCacheStats struct {
+	Hits         int64 `json:"hits"`     // chunks served from memory or a fetch already running
+	DiskHits     int64 `json:"diskHits"` // chunks served from the disk cache
+	Misses       int64 `json:"misses"`   // chunks the host had to wait for the server for
+	Readahead    int64 `json:"readahead"`
+	Requests     int64 `json:"requests"` // range requests sent to the server
+	FetchedBytes int64 `json:"fetchedBytes"`
+}
+
+// chunkFetch is a range request in flight, readers of the chunk wait on done
+type chunkFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+type cachedChunk struct {
+	index int64
+	data  []byte
+}
+
+// mediaReadCache sits between the NBD device and the HTTP range reader. NBD
+// reads are small, so chunks are fetched in bigger coalesced requests, with
+// readahead while the host reads sequentially.
+type mediaReadCache struct {
+	size       int64
+	chunkCount int64
+
+	chunks   map[int64]*list.Element
+	lru      *list.List
+	inflight map[int64]*chunkFetch
+	disk     *mediaDiskCache
+
+	lastChunk  int64
+	readahead  int64
+	fetchSlots chan struct{}
+	stats      MediaCacheStats
+	closed     bool
+	lock       sync.Mutex
+}
+
+// newMediaReadCache diskCacheBytes of 0 keeps the cache in memory only
+func newMediaReadCache(size int64, diskCachePath string, diskCacheBytes int64) *mediaReadCache {
+	c := &mediaReadCache{
+		size:       size,
+		chunkCount: (size + mediaCacheChunkSize - 1) / mediaCacheChunkSize,
+		chunks:     make(map[int64]*list.Element),
+		lru:        list.New(),
+		inflight:   make(map[int64]*chunkFetch),
+		lastChunk:  -1,
+		fetchSlots: make(chan struct{}, mediaCacheParallelFetches),
+	}
+	if diskCacheBytes >= mediaCacheChunkSize {
+		disk, err := openMediaDiskCache(diskCachePath, diskCacheBytes)
+		if err != nil {
+			logger.Warnf("media disk cache disabled: %v", err)
+		} else {
+			c.disk = disk
+		}
+	}
+	return c
+}
+
+// newLunMediaReadCache uses the disk cache size from the config
+func newLunMediaReadCache(lun int, size int64) *mediaReadCache {
+	diskCachePath := filepath.Join(mediaCacheFolder, fmt.Sprintf("lun%d.cache", lun))
+	return newMediaReadCache(size, diskCachePath, int64(config.MediaDiskCacheSize)*1024*1024)
+}
+
+func (c *mediaReadCache) chunkLength(index int64) int {
+	return int(min(mediaCacheChunkSize, c.size-index*mediaCacheChunkSize))
+}
+
+// Get implements httpreadat.CacheHandler
+func (c *mediaReadCache) Get(p []byte, off int64, fetcher io.ReaderAt) (int, error) {
+	if off >= c.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), c.size)
+	first := off / mediaCacheChunkSize
+	last := (end - 1) / mediaCacheChunkSize
+
+	needed := make([]*chunkFetch, 0, last-first+1)
+	var onDisk []int64
+	c.lock.Lock()
+	// the kernel has several reads in flight, anything close after the
+	// previous read counts as sequential
+	if c.lastChunk >= 0 && first >= c.lastChunk-1 && first <= c.lastChunk+c.readahead+1 {
+		c.readahead = min(max(c.readahead*2, mediaCacheMinReadahead), mediaCacheMaxReadahead)
+	} else {
+		c.readahead = 0
+	}
+	c.lastChunk = last
+
+	var missing []int64
+	for index := first; index <= last; index++ {
+		if element, ok := c.chunks[index]; ok {
+			c.stats.Hits++
+			c.lru.MoveToFront(element)
+			needed = append(needed, &chunkFetch{data: element.Value.(*cachedChunk).data})
+			continue
+		}
+		if fetch := c.inflight[index]; fetch != nil {
+			c.stats.Hits++
+			needed = append(needed, fetch)
+			continue
+		}
+		if c.disk != nil && c.disk.has(index) {
+			c.stats.DiskHits++
+			onDisk = append(onDisk, index)
+			needed = append(needed, &chunkFetch{})
+			continue
+		}
+		c.stats.Misses++
+		fetch := &chunkFetch{done: make(chan struct{})}
+		c.inflight[index] = fetch
+		missing = append(missing, index)
+		needed = append(needed, fetch)
+	}
+	for index := last + 1; index <= min(last+c.readahead, c.chunkCount-1); index++ {
+		if c.chunks[index] != nil || c.inflight[index] != nil || (c.disk != nil && c.disk.has(index)) {
+			continue
+		}
+		c.stats.Readahead++
+		c.inflight[index] = &chunkFetch{done: make(chan struct{})}
+		missing = append(missing, index)
+	}
+	c.startFetchesLocked(missing, fetcher)
+	c.lock.Unlock()
+
+	for _, index := range onDisk {
+		fetch := needed[index-first]
+		fetch.data, fetch.err = c.readFromDisk(index, fetcher)
+	}
+
+	n := 0
+	for i, fetch := range needed {
+		if fetch.done != nil {
+			<-fetch.done
+		}
+		if fetch.err != nil {
+			return n, fetch.err
+		}
+		chunkStart := (first + int64(i)) * mediaCacheChunkSize
+		from := max(off, chunkStart) - chunkStart
+		to := min(end-chunkStart, int64(len(fetch.data)))
+		n += copy(p[n:], fetch.data[from:to])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *mediaReadCache) storeLocked(index int64, data []byte) {
+	if c.closed {
+		return
+	}
+	if element, ok := c.chunks[index]; ok {
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.chunks[index] = c.lru.PushFront(&cachedChunk{index: index, data: data})
+	for c.lru.Len() > mediaCacheMemoryChunks {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.chunks, oldest.Value.(*cachedChunk).index)
+	}
+}
+
+// startFetchesLocked groups runs of adjacent chunks into range requests
+func (c *mediaReadCache) startFetchesLocked(missing []int64, fetcher io.ReaderAt) {
+	for start := 0; start < len(missing); {
+		end := start + 1
+		for end < len(missing) && end-start < mediaCacheMaxFetchChunks && missing[end] == missing[end-1]+1 {
+			end++
+		}
+		run := missing[start:end]
+		fetches := make([]*chunkFetch, len(run))
+		for i, index := range run {
+			fetches[i] = c.inflight[index]
+		}
+		go c.fetchRun(run[0], fetches, fetcher)
+		start = end
+	}
+}
+
+func (c *mediaReadCache) fetchRun(firstIndex int64, fetches []*chunkFetch, fetcher io.ReaderAt) {
+	c.fetchSlots <- struct{}{}
+	start := firstIndex * mediaCacheChunkSize
+	buf := make([]byte, min(int64(len(fetches))*mediaCacheChunkSize, c.size-start))
+	n, err := fetcher.ReadAt(buf, start)
+	<-c.fetchSlots
+	if err == io.EOF && n == len(buf) {
+		err = nil
+	}
+	if err == nil && n < len(buf) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to fetch %d bytes at %d: %w", len(buf), start, err)
+	}
+
+	c.lock.Lock()
+	c.stats.Requests++
+	c.stats.FetchedBytes += int64(n)
+	for i, fetch := range fetches {
+		index := firstIndex + int64(i)
+		delete(c.inflight, index)
+		if err == nil {
+			chunkStart := i * mediaCacheChunkSize
+			fetch.data = make([]byte, c.chunkLength(index))
+			copy(fetch.data, buf[chunkStart:])
+			c.storeLocked(index, fetch.data)
+		}
+		fetch.err = err
+		close(fetch.done)
+	}
+	disk := c.disk
+	closed := c.closed
+	c.lock.Unlock()
+
+	if err == nil && disk != nil && !closed {
+		for i, fetch := range fetches {
+			disk.store(firstIndex+int64(i), fetch.data)
+		}
+	}
+}
+
+// readFromDisk falls back to the server when the chunk was evicted meanwhile
+func (c *mediaReadCache) readFromDisk(index int64, fetcher io.ReaderAt) ([]byte, error) {
+	data, err := c.disk.read(index, c.chunkLength(index))
+	if err != nil {
+		data = make([]byte, c.chunkLength(index))
+		n, err := fetcher.ReadAt(data, index*mediaCacheChunkSize)
+		if err != nil && !(err == io.EOF && n == len(data)) {
+			return nil, fmt.Errorf("failed to fetch chunk %d: %w", index, err)
+		}
+	}
+	c.lock.Lock()
+	c.storeLocked(index, data)
+	c.lock.Unlock()
+	return data, nil
+}
+
+func (c *mediaReadCache) Stats() MediaCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// Close drops the cached data, fetches still running are discarded
+func (c *mediaReadCache) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	c.chunks = make(map[int64]*list.Element)
+	c.lru.Init()
+	if c.disk != nil {
+		c.disk.Close()
+	}
+}
+
+// mediaDiskCache keeps chunks in a file of fixed size in slots, the oldest
+// slot is reused when the file is full
+type mediaDiskCache struct {
+	file     *os.File
+	slots    map[int64]int
+	owners   []int64
+	nextSlot int
+	lock     sync.Mutex
+}
+
+func openMediaDiskCache(path string, sizeBytes int64) (*mediaDiskCache, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create media cache folder: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create media cache file: %w", err)
+	}
+	owners := make([]int64, sizeBytes/mediaCacheChunkSize)
+	for i := range owners {
+		owners[i] = -1
+	}
+	return &mediaDiskCache{
+		file:   file,
+		slots:  make(map[int64]int),
+		owners: owners,
+	}, nil
+}
+
+func (d *mediaDiskCache) has(index int64) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, ok := d.slots[index]
+	return ok
+}
+
+func (d *mediaDiskCache) read(index int64, length int) ([]byte, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	slot, ok := d.slots[index]
+	if !ok {
+		return nil, fmt.Errorf("chunk %d is not in the disk cache", index)
+	}
+	data := make([]byte, length)
+	_, err := d.file.ReadAt(data, int64(slot)*mediaCacheChunkSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media disk cache: %w", err)
+	}
+	return data, nil
+}
+
+func (d *mediaDiskCache) store(index int64, data []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.file == nil {
+		return
+	}
+	if _, ok := d.slots[index]; ok {
+		return
+	}
+	slot := d.nextSlot
+	d.nextSlot = (d.nextSlot + 1) % len(d.owners)
+	if d.owners[slot] >= 0 {
+		delete(d.slots, d.owners[slot])
+		d.owners[slot] = -1
+	}
+	_, err := d.file.WriteAt(data, int64(slot)*mediaCacheChunkSize)
+	if err != nil {
+		// most likely out of space, keep going without the disk cache
+		logger.Warnf("failed to write media disk cache, disabling it: %v", err)
+		d.closeLocked()
+		return
+	}
+	d.slots[index] = slot
+	d.owners[slot] = index
+}
+
+func (d *mediaDiskCache) Close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.closeLocked()
+}
+
+func (d *mediaDiskCache) closeLocked() {
+	if d.file == nil {
+		return
+	}
+	d.file.Close()
+	os.Remove(d.file.Name())
+	d.file = nil
+	d.slots = make(map[int64]int)
+}
+
+func rpcGetMediaDiskCacheSize() int {
+	return config.MediaDiskCacheSize
+}
+
+// rpcSetMediaDiskCacheSize applies to media mounted afterwards
+func rpcSetMediaDiskCacheSize(sizeMB int) error {
+	if sizeMB < 0 || sizeMB > mediaDiskCacheMaxSize {
+		return fmt.Errorf("invalid media disk cache size: %d MiB", sizeMB)
+	}
+	config.MediaDiskCacheSize = sizeMB
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package kvm
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	mountUrlCheckTimeout = 15 * time.Second
+	mountUrlMaxRedirects = 10
+	// enough to reach the ISO9660 primary volume descriptor at sector 16
+	mountUrlSniffLength = 0x8800
+)
+
+// mountUrlProblem is a reason the URL can't be mounted
+type mountUrlProblem string
+
+func (p mountUrlProblem) Error() string {
+	return string(p)
+}
+
+func rpcCheckMountUrl(url string) (*VirtualMediaUrlInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mountUrlCheckTimeout)
+	defer cancel()
+	return checkMountUrl(ctx, url), nil
+}
+
+// checkMountUrl finds out up front whether the NBD device could read the URL,
+// the server has to answer range requests with the total size of the image
+func checkMountUrl(ctx context.Context, rawUrl string) *VirtualMediaUrlInfo {
+	info, err := probeMountUrl(ctx, rawUrl)
+	if err != nil {
+		return &VirtualMediaUrlInfo{Reason: err.Error()}
+	}
+	return info
+}
+
+func probeMountUrl(ctx context.Context, rawUrl string) (*VirtualMediaUrlInfo, error) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.Host == "" {
+		return nil, mountUrlProblem("not a valid URL")
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, mountUrlProblem(fmt.Sprintf("unsupported URL scheme %q, use http or https", parsed.Scheme))
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= mountUrlMaxRedirects {
+				return mountUrlProblem(fmt.Sprintf("more than %d redirects", mountUrlMaxRedirects))
+			}
+			if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+				return mountUrlProblem(fmt.Sprintf("redirected from https to insecure %s", req.URL.Redacted()))
+			}
+			return nil
+		},
+	}
+
+	// HEAD is only advisory, plenty of servers reject it for downloads
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, rawUrl, nil)
+	if err != nil {
+		return nil, mountUrlProblem("not a valid URL")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, describeMountUrlError(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, mountUrlProblem(fmt.Sprintf("server returned %s", resp.Status))
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, mountUrlProblem(fmt.Sprintf("server returned %s, the URL must be readable without logging in", resp.Status))
+	}
+	if resp.StatusCode == http.StatusOK && strings.EqualFold(resp.Header.Get("Accept-Ranges"), "none") {
+		return nil, mountUrlProblem("server does not support range requests (Accept-Ranges: none)")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, rawUrl, nil)
+	if err != nil {
+		return nil, mountUrlProblem("not a valid URL")
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", mountUrlSniffLength-1))
+	resp, err = client.Do(req)
+	if err != nil {
+		return nil, describeMountUrlError(err)
+	}
+	defer resp.Body.Close()
+
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && resp.StatusCode < 300 {
+		if mediaType == "text/html" || mediaType == "application/xhtml+xml" {
+			return nil, mountUrlProblem("server returned a web page instead of an image, check the URL points to the file itself")
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, mountUrlProblem("server ignored the range request and sent the whole file, range requests are required")
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, mountUrlProblem("server refused the range request, the file may be empty")
+	default:
+		return nil, mountUrlProblem(fmt.Sprintf("server returned %s", resp.Status))
+	}
+
+	start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil {
+		return nil, err
+	}
+	if start != 0 {
+		return nil, mountUrlProblem(fmt.Sprintf("server returned the range starting at %d instead of 0", start))
+	}
+
+	head := make([]byte, min(size, mountUrlSniffLength))
+	n, err := io.ReadFull(resp.Body, head)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, mountUrlProblem("timed out reading the start of the image")
+		}
+		return nil, mountUrlProblem(fmt.Sprintf("failed to read the start of the image after %d bytes: %v", n, err))
+	}
+
+	if looksLikeHTML(head) {
+		return nil, mountUrlProblem("server returned a web page instead of an image, check the URL points to the file itself")
+	}
+
+	return &VirtualMediaUrlInfo{
+		Usable:    true,
+		Size:      size,
+		ImageType: sniffImageType(head),
+	}, nil
+}
+
+// parseContentRange returns the first byte and the total size of a
+// "bytes first-last/total" header
+func parseContentRange(header string) (int64, int64, error) {
+	if header == "" {
+		return 0, 0, mountUrlProblem("server sent no Content-Range header with the partial content")
+	}
+	unit, rangeSpec, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(unit, "bytes") {
+		return 0, 0, mountUrlProblem(fmt.Sprintf("invalid Content-Range header %q", header))
+	}
+	byteRange, total, ok := strings.Cut(rangeSpec, "/")
+	if !ok {
+		return 0, 0, mountUrlProblem(fmt.Sprintf("invalid Content-Range header %q", header))
+	}
+	if total == "*" {
+		return 0, 0, mountUrlProblem("server does not report the size of the image")
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, 0, mountUrlProblem(fmt.Sprintf("invalid image size in Content-Range header %q", header))
+	}
+	first, _, ok := strings.Cut(byteRange, "-")
+	start, err := strconv.ParseInt(first, 10, 64)
+	if !ok || err != nil {
+		return 0, 0, mountUrlProblem(fmt.Sprintf("invalid Content-Range header %q", header))
+	}
+	return start, size, nil
+}
+
+func describeMountUrlError(err error) error {
+	var problem mountUrlProblem
+	if errors.As(err, &problem) {
+		return problem
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	var recordHeader tls.RecordHeaderError
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &unknownAuthority):
+		return mountUrlProblem("TLS certificate is signed by an unknown authority")
+	case errors.As(err, &hostname):
+		return mountUrlProblem(fmt.Sprintf("TLS certificate is not valid for %s", hostname.Host))
+	case errors.As(err, &invalid):
+		if invalid.Reason == x509.Expired {
+			return mountUrlProblem("TLS certificate has expired or is not valid yet, check the clock of the device")
+		}
+		return mountUrlProblem(fmt.Sprintf("TLS certificate is invalid: %v", invalid))
+	case errors.As(err, &recordHeader), strings.Contains(err.Error(), "server gave HTTP response to HTTPS client"):
+		return mountUrlProblem("server did not answer with TLS, try http instead of https")
+	case errors.Is(err, context.DeadlineExceeded):
+		return mountUrlProblem("timed out waiting for the server")
+	case errors.As(err, &dnsErr):
+		return mountUrlProblem(fmt.Sprintf("failed to resolve %s", dnsErr.Name))
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return mountUrlProblem(fmt.Sprintf("failed to connect: %v", opErr.Err))
+	}
+	return mountUrlProblem(fmt.Sprintf("request failed: %v", err))
+}
+
+func looksLikeHTML(head []byte) bool {
+	start := bytes.ToLower(bytes.TrimLeft(head[:min(len(head), 512)], " \t\r\n\ufeff"))
+	return bytes.HasPrefix(start, []byte("<!doctype html")) || bytes.HasPrefix(start, []byte("<html"))
+}
+
+// sniffImageType recognizes the image layouts the host can boot from, hybrid
+// ISOs carry a partition table too and are reported as iso9660
+func sniffImageType(head []byte) string {
+	return detectImageInfo(bytes.NewReader(head)).Type
+}
@@ -0,0 +1,181 @@
+package kvm
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testISOImage(size int) []byte {
+	image := make([]byte, size)
+	pvd := image[16*isoSectorSize:]
+	pvd[0] = 1
+	copy(pvd[1:6], "CD001")
+	copy(pvd[40:72], "TEST_ISO")
+	return image
+}
+
+// serveImage answers range requests like a well behaved file server
+func serveImage(image []byte, contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(image))
+	}
+}
+
+func TestCheckMountUrl(t *testing.T) {
+	const imageSize = 1024 * 1024
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		usable    bool
+		size      int64
+		imageType string
+		reason    string
+	}{
+		{
+			name:    "range request",
+			handler: serveImage(make([]byte, imageSize), "application/octet-stream"),
+			usable:  true,
+			size:    imageSize,
+		},
+		{
+			name:      "iso image",
+			handler:   serveImage(testISOImage(imageSize), "application/x-iso9660-image"),
+			usable:    true,
+			size:      imageSize,
+			imageType: ImageTypeISO9660,
+		},
+		{
+			name: "200 without range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/octet-stream")
+				w.Write(make([]byte, imageSize))
+			},
+			reason: "server ignored the range request and sent the whole file, range requests are required",
+		},
+		{
+			name: "accept ranges none",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Accept-Ranges", "none")
+				w.WriteHeader(http.StatusOK)
+			},
+			reason: "server does not support range requests (Accept-Ranges: none)",
+		},
+		{
+			name: "416",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodHead {
+					return
+				}
+				w.Header().Set("Content-Range", "bytes */0")
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			},
+			reason: "server refused the range request, the file may be empty",
+		},
+		{
+			name:    "text/html",
+			handler: serveImage([]byte("<!DOCTYPE html><html><body>Download</body></html>"), "text/html; charset=utf-8"),
+			reason:  "server returned a web page instead of an image, check the URL points to the file itself",
+		},
+		{
+			name:    "html without content type",
+			handler: serveImage(append([]byte("\n<html><body>"), make([]byte, 4096)...), "application/octet-stream"),
+			reason:  "server returned a web page instead of an image, check the URL points to the file itself",
+		},
+		{
+			name: "404",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.NotFound(w, r)
+			},
+			reason: "server returned 404 Not Found",
+		},
+		{
+			name: "403",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusForbidden)
+			},
+			reason: "server returned 403 Forbidden, the URL must be readable without logging in",
+		},
+		{
+			name: "missing Content-Range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusPartialContent)
+			},
+			reason: "server sent no Content-Range header with the partial content",
+		},
+		{
+			name: "unknown size in Content-Range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", "bytes 0-34815/*")
+				w.WriteHeader(http.StatusPartialContent)
+			},
+			reason: "server does not report the size of the image",
+		},
+		{
+			name: "bad Content-Range",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", "items 0-10/100")
+				w.WriteHeader(http.StatusPartialContent)
+			},
+			reason: `invalid Content-Range header "items 0-10/100"`,
+		},
+		{
+			name: "Content-Range not at the start",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", "bytes 512-1023/1048576")
+				w.WriteHeader(http.StatusPartialContent)
+			},
+			reason: "server returned the range starting at 512 instead of 0",
+		},
+		{
+			name: "short body",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Range", "bytes 0-34815/1048576")
+				w.Header().Set("Content-Length", "34816")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(make([]byte, 100))
+			},
+			reason: "failed to read the start of the image after 100 bytes: unexpected EOF",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(test.handler)
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			info := checkMountUrl(ctx, server.URL+"/image.iso")
+			if info.Usable != test.usable {
+				t.Fatalf("usable: got %v (%s), want %v", info.Usable, info.Reason, test.usable)
+			}
+			if info.Reason != test.reason {
+				t.Fatalf("reason: got %q, want %q", info.Reason, test.reason)
+			}
+			if info.Size != test.size {
+				t.Fatalf("size: got %d, want %d", info.Size, test.size)
+			}
+			if info.ImageType != test.imageType {
+				t.Fatalf("image type: got %q, want %q", info.ImageType, test.imageType)
+			}
+		})
+	}
+}
+
+func TestCheckMountUrlRejectsBadUrls(t *testing.T) {
+	tests := map[string]string{
+		"not a url":           "not a valid URL",
+		"ftp://example.com/x": `unsupported URL scheme "ftp", use http or https`,
+	}
+	for rawUrl, reason := range tests {
+		info := checkMountUrl(context.Background(), rawUrl)
+		if info.Usable || info.Reason != reason {
+			t.Errorf("%s: got %+v, want %q", rawUrl, info, reason)
+		}
+	}
+}
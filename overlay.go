@@ -0,0 +1,541 @@
+package kvm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/psanford/httpreadat"
+	"golang.org/x/sys/unix"
+)
+
+var overlaysFolder = "/userdata/jetkvm/overlays"
+
+// overlayBlockSize matches the NBD block size, partial writes to a block not
+// in the overlay yet are merged with the base image first
+const overlayBlockSize = 4096
+
+// OverlayInfo describes the uncommitted writes of a LUN and the image they
+// apply to
+type OverlayInfo struct {
+	Lun          int                `json:"lun"`
+	Source       VirtualMediaSource `json:"source"`
+	Filename     string             `json:"filename,omitempty"`
+	URL          string             `json:"url,omitempty"`
+	Size         int64              `json:"size"` // decompressed size of compressed images
+	Compression  string             `json:"compression,omitempty"`
+	ChangedBytes int64              `json:"changedBytes"`
+}
+
+func (o *OverlayInfo) sameImage(state *VirtualMediaState) bool {
+	return o.Source == state.Source && o.Filename == state.Filename && o.URL == state.URL &&
+		o.Size == state.Size && o.Compression == state.Compression
+}
+
+// mediaState describes the image the overlay applies to, the counterpart of
+// the fields openOverlay takes from the state
+func (o *OverlayInfo) mediaState() *VirtualMediaState {
+	return &VirtualMediaState{
+		Lun:         o.Lun,
+		Source:      o.Source,
+		Filename:    o.Filename,
+		URL:         o.URL,
+		Size:        o.Size,
+		Compression: o.Compression,
+	}
+}
+
+// the bitmap is only rewritten on Sync, blocks mapped since then are
+// appended to the journal before a write is acknowledged
+func overlayPaths(lun int) (infoPath string, dataPath string, bitmapPath string, journalPath string) {
+	base := filepath.Join(overlaysFolder, fmt.Sprintf("lun%d", lun))
+	return base + ".json", base + ".overlay", base + ".bitmap", base + ".journal"
+}
+
+// readOverlayBitmap loads the saved bitmap and replays the journal on top
+func readOverlayBitmap(bitmapPath string, journalPath string, bitmap []byte) error {
+	savedBitmap, err := os.ReadFile(bitmapPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read overlay bitmap: %w", err)
+	}
+	copy(bitmap, savedBitmap)
+	journal, err := os.ReadFile(journalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read overlay journal: %w", err)
+	}
+	// a torn entry at the end was never acknowledged
+	for len(journal) >= 8 {
+		block := binary.BigEndian.Uint64(journal)
+		if block/8 < uint64(len(bitmap)) {
+			bitmap[block/8] |= 1 << (block % 8)
+		}
+		journal = journal[8:]
+	}
+	return nil
+}
+
+// writeFileAtomic replaces a file so that a crash leaves either the old or
+// the new content
+func writeFileAtomic(filePath string, data []byte) error {
+	tmpPath := filePath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(filePath))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// readerAtFunc adapts a read function to io.ReaderAt
+type readerAtFunc func(p []byte, off int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, off int64) (int, error) {
+	return f(p, off)
+}
+
+// cowOverlay keeps writes in a sparse file next to a read-only base image,
+// a bitmap records which blocks were written
+type cowOverlay struct {
+	info       OverlayInfo
+	base       io.ReaderAt
+	baseCloser io.Closer
+	data       *os.File
+	bitmap     []byte
+	bitmapPath string
+	journal    *os.File
+	dirty      bool // the journal has blocks the saved bitmap is missing
+	// bytes mapped since the free space was last checked
+	unchecked int64
+	lock      sync.Mutex
+}
+
+// openOverlay resumes the overlay of the LUN or starts a new one, it refuses
+// to apply the writes of a different image
+func openOverlay(lun int, state *VirtualMediaState, base io.ReaderAt, baseCloser io.Closer) (*cowOverlay, error) {
+	err := os.MkdirAll(overlaysFolder, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create overlays folder: %w", err)
+	}
+	infoPath, dataPath, bitmapPath, journalPath := overlayPaths(lun)
+	blocks := (state.Size + overlayBlockSize - 1) / overlayBlockSize
+	bitmap := make([]byte, (blocks+7)/8)
+
+	info := OverlayInfo{
+		Lun:         lun,
+		Source:      state.Source,
+		Filename:    state.Filename,
+		URL:         state.URL,
+		Size:        state.Size,
+		Compression: state.Compression,
+	}
+	existing, err := readOverlayInfo(lun)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if !existing.sameImage(state) {
+			return nil, fmt.Errorf("LUN %d has uncommitted changes to another image, commit or discard them first", lun)
+		}
+		err = readOverlayBitmap(bitmapPath, journalPath, bitmap)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		infoJSON, err := json.Marshal(info)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(infoPath, infoJSON, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write overlay info: %w", err)
+		}
+	}
+
+	data, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open overlay: %w", err)
+	}
+	// truncating only sets the size, the file stays sparse
+	err = data.Truncate(state.Size)
+	if err != nil {
+		data.Close()
+		return nil, fmt.Errorf("failed to size overlay: %w", err)
+	}
+	journal, err := os.OpenFile(journalPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		data.Close()
+		return nil, fmt.Errorf("failed to open overlay journal: %w", err)
+	}
+
+	overlay := &cowOverlay{
+		info:       info,
+		base:       base,
+		baseCloser: baseCloser,
+		data:       data,
+		bitmap:     bitmap,
+		bitmapPath: bitmapPath,
+		journal:    journal,
+		dirty:      true,
+	}
+	// fold the journal of an earlier run into the bitmap
+	err = overlay.syncLocked()
+	if err != nil {
+		data.Close()
+		journal.Close()
+		return nil, err
+	}
+	return overlay, nil
+}
+
+func (o *cowOverlay) isWritten(block int64) bool {
+	return o.bitmap[block/8]&(1<<(block%8)) != 0
+}
+
+func (o *cowOverlay) ReadAt(p []byte, off int64) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if off >= o.info.Size {
+		return 0, io.EOF
+	}
+	if off+int64(len(p)) > o.info.Size {
+		p = p[:o.info.Size-off]
+	}
+	n := 0
+	for n < len(p) {
+		// read runs of blocks coming from the same file in one go
+		pos := off + int64(n)
+		written := o.isWritten(pos / overlayBlockSize)
+		end := (pos/overlayBlockSize + 1) * overlayBlockSize
+		for end < off+int64(len(p)) && o.isWritten(end/overlayBlockSize) == written {
+			end += overlayBlockSize
+		}
+		if end > off+int64(len(p)) {
+			end = off + int64(len(p))
+		}
+		source := o.base
+		if written {
+			source = o.data
+		}
+		read, err := source.ReadAt(p[n:end-off], pos)
+		n += read
+		if err != nil && !(err == io.EOF && pos+int64(read) == end) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// WriteAt acknowledges a write only once it is durable, the NBD server
+// doesn't pass on flushes, so the host can't ask for that later
+func (o *cowOverlay) WriteAt(p []byte, off int64) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if off+int64(len(p)) > o.info.Size {
+		return 0, errors.New("write beyond the end of the image")
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// the overlay is sparse, it grows with every block written the first time
+	var mapped []uint64
+	for block := off / overlayBlockSize; block <= (off+int64(len(p))-1)/overlayBlockSize; block++ {
+		if !o.isWritten(block) {
+			mapped = append(mapped, uint64(block))
+		}
+	}
+	o.unchecked += int64(len(mapped)) * overlayBlockSize
+	if o.unchecked >= storageSpaceCheckEvery {
+		o.unchecked = 0
+		available, err := storageBytesAvailable()
+		if err == nil && available < storageSpaceCheckEvery {
+			return 0, errors.New("not enough space for the overlay, the storage reserve was reached")
+		}
+	}
+
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		block := pos / overlayBlockSize
+		blockStart := block * overlayBlockSize
+		blockEnd := min(blockStart+overlayBlockSize, o.info.Size)
+		chunk := p[n:min(int64(len(p)), blockEnd-off)]
+
+		if !o.isWritten(block) && (pos != blockStart || pos+int64(len(chunk)) != blockEnd) {
+			buf := make([]byte, blockEnd-blockStart)
+			_, err := o.base.ReadAt(buf, blockStart)
+			if err != nil && err != io.EOF {
+				return n, fmt.Errorf("failed to read base image: %w", err)
+			}
+			copy(buf[pos-blockStart:], chunk)
+			_, err = o.data.WriteAt(buf, blockStart)
+			if err != nil {
+				return n, err
+			}
+		} else {
+			_, err := o.data.WriteAt(chunk, pos)
+			if err != nil {
+				return n, err
+			}
+		}
+		n += len(chunk)
+	}
+
+	// the data must be on disk before the journal points at it
+	err := unix.Fdatasync(int(o.data.Fd()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to sync overlay: %w", err)
+	}
+	if len(mapped) == 0 {
+		return n, nil
+	}
+	entries := make([]byte, 8*len(mapped))
+	for i, block := range mapped {
+		binary.BigEndian.PutUint64(entries[8*i:], block)
+	}
+	_, err = o.journal.Write(entries)
+	if err == nil {
+		err = unix.Fdatasync(int(o.journal.Fd()))
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to write overlay journal: %w", err)
+	}
+	for _, block := range mapped {
+		o.bitmap[block/8] |= 1 << (block % 8)
+	}
+	o.dirty = true
+	return n, nil
+}
+
+// Sync folds the journal into the bitmap, writes are durable without it
+func (o *cowOverlay) Sync() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.syncLocked()
+}
+
+func (o *cowOverlay) syncLocked() error {
+	if !o.dirty {
+		return nil
+	}
+	err := writeFileAtomic(o.bitmapPath, o.bitmap)
+	if err != nil {
+		return fmt.Errorf("failed to write overlay bitmap: %w", err)
+	}
+	// only once the bitmap has everything the journal had
+	err = o.journal.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("failed to reset overlay journal: %w", err)
+	}
+	o.dirty = false
+	return nil
+}
+
+func (o *cowOverlay) Close() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	err := o.syncLocked()
+	o.data.Close()
+	o.journal.Close()
+	if o.baseCloser != nil {
+		o.baseCloser.Close()
+	}
+	return err
+}
+
+func readOverlayInfo(lun int) (*OverlayInfo, error) {
+	infoPath, _, bitmapPath, journalPath := overlayPaths(lun)
+	infoJSON, err := os.ReadFile(infoPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read overlay info: %w", err)
+	}
+	var info OverlayInfo
+	err = json.Unmarshal(infoJSON, &info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse overlay info: %w", err)
+	}
+	blocks := (info.Size + overlayBlockSize - 1) / overlayBlockSize
+	bitmap := make([]byte, (blocks+7)/8)
+	err = readOverlayBitmap(bitmapPath, journalPath, bitmap)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bitmap {
+		info.ChangedBytes += int64(bits.OnesCount8(b)) * overlayBlockSize
+	}
+	return &info, nil
+}
+
+func removeOverlay(lun int) error {
+	infoPath, dataPath, bitmapPath, journalPath := overlayPaths(lun)
+	for _, overlayPath := range []string{dataPath, journalPath, bitmapPath, infoPath} {
+		err := os.Remove(overlayPath)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove overlay: %w", err)
+		}
+	}
+	return nil
+}
+
+// openOverlayBase opens the image an overlay applies to. Media streamed from
+// the browser is only readable while it is mounted.
+func openOverlayBase(lun int, state *VirtualMediaState, rangeReader *httpreadat.RangeReader) (io.ReaderAt, io.Closer, error) {
+	switch state.Source {
+	case Storage:
+		file, err := os.Open(filepath.Join(imagesFolder, state.Filename))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open base image: %w", err)
+		}
+		if state.Compression == "" {
+			return file, file, nil
+		}
+		fileInfo, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to open base image: %w", err)
+		}
+		image, err := openSeekableImage(file, fileInfo.Size(), state.Compression, file)
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to open base image: %w", err)
+		}
+		return image, image, nil
+	case HTTP:
+		if rangeReader == nil {
+			rangeReader = httpreadat.New(state.URL, httpreadat.WithCacheHandler(newMediaReadCache(state.Size, "", 0)))
+		}
+		if state.Compression == "" {
+			return rangeReader, nil, nil
+		}
+		compressedSize, err := rangeReader.Size()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open base image: %w", err)
+		}
+		image, err := openSeekableImage(rangeReader, compressedSize, state.Compression, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open base image: %w", err)
+		}
+		return image, image, nil
+	case WebRTC:
+		return readerAtFunc(remoteImageBackend{lun: lun}.readSource), nil, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported overlay source: %s", state.Source)
+}
+
+func rpcGetMediaOverlay(lun int) (*OverlayInfo, error) {
+	if err := checkMassStorageLun(lun); err != nil {
+		return nil, err
+	}
+	return readOverlayInfo(lun)
+}
+
+func checkOverlayNotMounted(lun int) error {
+	if err := checkMassStorageLun(lun); err != nil {
+		return err
+	}
+	virtualMediaStateMutex.RLock()
+	defer virtualMediaStateMutex.RUnlock()
+	if virtualMediaLuns[lun].overlay != nil {
+		return fmt.Errorf("unmount LUN %d before changing its overlay", lun)
+	}
+	return nil
+}
+
+func rpcDiscardMediaOverlay(lun int) error {
+	if err := checkOverlayNotMounted(lun); err != nil {
+		return err
+	}
+	logger.Infof("discarding overlay of LUN %d", lun)
+	return removeOverlay(lun)
+}
+
+// rpcCommitMediaOverlay writes the base image with the overlay applied
+// to a new file in storage, then drops the overlay
+func rpcCommitMediaOverlay(lun int, filename string) error {
+	if err := checkOverlayNotMounted(lun); err != nil {
+		return err
+	}
+	filename, err := sanitizeStoragePath(filename)
+	if err != nil {
+		return err
+	}
+	targetPath := filepath.Join(imagesFolder, filename)
+	if _, err := os.Stat(targetPath); err == nil {
+		return fmt.Errorf("file already exists: %s", filename)
+	}
+
+	info, err := readOverlayInfo(lun)
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return fmt.Errorf("LUN %d has no overlay", lun)
+	}
+	state := info.mediaState()
+	if state.Source == WebRTC {
+		return errors.New("changes to media streamed from the browser can only be committed while it is mounted")
+	}
+	err = checkStorageSpace(info.Size)
+	if err != nil {
+		return err
+	}
+	base, baseCloser, err := openOverlayBase(lun, state, nil)
+	if err != nil {
+		return err
+	}
+	overlay, err := openOverlay(lun, state, base, baseCloser)
+	if err != nil {
+		if baseCloser != nil {
+			baseCloser.Close()
+		}
+		return err
+	}
+
+	incompletePath := targetPath + ".incomplete"
+	target, err := os.Create(incompletePath)
+	if err != nil {
+		overlay.Close()
+		return fmt.Errorf("failed to create image file: %w", err)
+	}
+	_, err = io.Copy(target, io.NewSectionReader(overlay, 0, info.Size))
+	if err == nil {
+		err = target.Sync()
+	}
+	target.Close()
+	overlay.Close()
+	if err != nil {
+		os.Remove(incompletePath)
+		return fmt.Errorf("failed to write image file: %w", err)
+	}
+	err = os.Rename(incompletePath, targetPath)
+	if err != nil {
+		return fmt.Errorf("failed to rename image file: %w", err)
+	}
+	logger.Infof("committed overlay of LUN %d to %s", lun, filename)
+	return removeOverlay(lun)
+}
@@ -0,0 +1,91 @@
+package kvm
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestStorage points the images and overlays folders to a temporary
+// folder for the duration of the test
+func useTestStorage(t *testing.T) {
+	t.Helper()
+	images, overlays := imagesFolder, overlaysFolder
+	folder := t.TempDir()
+	imagesFolder = filepath.Join(folder, "images")
+	overlaysFolder = filepath.Join(folder, "overlays")
+	t.Cleanup(func() {
+		imagesFolder, overlaysFolder = images, overlays
+	})
+	if err := os.MkdirAll(imagesFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitOverlayOnCompressedImage(t *testing.T) {
+	useTestStorage(t)
+	data := testImageData()
+	err := os.WriteFile(filepath.Join(imagesFolder, "base.img.zst"), seekableZstd(t, data, testFrameSize, false), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &VirtualMediaState{
+		Source:      Storage,
+		Mode:        WritableDisk,
+		Filename:    "base.img.zst",
+		Size:        int64(len(data)),
+		Compression: CompressionZstd,
+	}
+	base, baseCloser, err := openOverlayBase(0, state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay, err := openOverlay(0, state, base, baseCloser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// partial blocks are merged with the decompressed base
+	expected := bytes.Clone(data)
+	for _, off := range []int64{100, testFrameSize - 50, 5*testFrameSize + 1000} {
+		change := bytes.Repeat([]byte{0xAB}, 200)
+		if _, err := overlay.WriteAt(change, off); err != nil {
+			t.Fatal(err)
+		}
+		copy(expected[off:], change)
+	}
+	if err := overlay.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := readOverlayInfo(0)
+	if err != nil || info == nil {
+		t.Fatalf("overlay info: %v", err)
+	}
+	if info.Compression != CompressionZstd {
+		t.Fatalf("compression not recorded: %q", info.Compression)
+	}
+	if !info.sameImage(info.mediaState()) {
+		t.Fatalf("state built from the overlay info doesn't match it: %+v", info.mediaState())
+	}
+	// the same name with another encoding is another image
+	raw := *state
+	raw.Compression = ""
+	if info.sameImage(&raw) {
+		t.Fatal("overlay matches the image without compression")
+	}
+
+	if err := rpcCommitMediaOverlay(0, "committed.img"); err != nil {
+		t.Fatal(err)
+	}
+	committed, err := os.ReadFile(filepath.Join(imagesFolder, "committed.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(committed, expected) {
+		t.Fatal("committed image doesn't match the base with the changes applied")
+	}
+	if info, err := readOverlayInfo(0); err != nil || info != nil {
+		t.Fatalf("overlay not removed: %v %v", info, err)
+	}
+}
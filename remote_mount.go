@@ -2,64 +2,206 @@ package kvm
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// reply frames start with id, status, start offset and length
+	diskReadHeaderSize = 24
+	// browsers drop data channel messages much above 64 KiB
+	diskReadChunkSize   = 32 * 1024
+	diskReadMaxInflight = 8
+	diskReadTimeout     = 5 * time.Second
+	diskReadMaxAttempts = 3
+)
+
+const (
+	diskReadStatusOK = iota
+	diskReadStatusFailed
 )
 
 type RemoteImageReader interface {
 	Read(ctx context.Context, offset int64, size int64) ([]byte, error)
 }
 
+// WebRTCDiskReader reads the file mounted from the browser, several requests
+// can be outstanding and replies are matched by id
 type WebRTCDiskReader struct {
+	mutex    sync.Mutex
+	nextID   uint32
+	pending  map[uint32]*pendingDiskRead
+	inflight chan struct{}
+}
+
+type pendingDiskRead struct {
+	start  uint64
+	length uint64
+	reply  chan diskReadReply
 }
 
-var webRTCDiskReader WebRTCDiskReader
+type diskReadReply struct {
+	data []byte
+	err  error
+}
+
+var webRTCDiskReader = &WebRTCDiskReader{
+	pending:  make(map[uint32]*pendingDiskRead),
+	inflight: make(chan struct{}, diskReadMaxInflight),
+}
 
 func (w *WebRTCDiskReader) Read(ctx context.Context, offset int64, size int64) ([]byte, error) {
 	virtualMediaStateMutex.RLock()
-	if currentVirtualMediaState == nil {
-		virtualMediaStateMutex.RUnlock()
-		return nil, errors.New("image not mounted")
-	}
-	if currentVirtualMediaState.Source != WebRTC {
+	mountedState := webRTCVirtualMediaState()
+	if mountedState == nil {
 		virtualMediaStateMutex.RUnlock()
 		return nil, errors.New("image not mounted from webrtc")
 	}
-	mountedImageSize := currentVirtualMediaState.Size
+	mountedImageSize := mountedState.Size
 	virtualMediaStateMutex.RUnlock()
 	end := offset + size
 	if end > mountedImageSize {
 		end = mountedImageSize
 	}
-	req := DiskReadRequest{
-		Start: uint64(offset),
-		End:   uint64(end),
+	if end <= offset {
+		return []byte{}, nil
 	}
-	jsonBytes, err := json.Marshal(req)
-	if err != nil {
-		return nil, err
+
+	// chunks are requested in parallel, the first error cancels the rest
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	buf := make([]byte, end-offset)
+	var wg sync.WaitGroup
+	var firstErr error
+	var errOnce sync.Once
+	for start := offset; start < end; start += diskReadChunkSize {
+		chunkEnd := min(start+diskReadChunkSize, end)
+		wg.Add(1)
+		go func(start int64, chunkEnd int64) {
+			defer wg.Done()
+			err := w.readChunk(ctx, start, buf[start-offset:chunkEnd-offset])
+			if err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(start, chunkEnd)
 	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return buf, nil
+}
 
-	if currentSession == nil || currentSession.DiskChannel == nil {
-		return nil, errors.New("not active session")
+// readChunk retries requests that time out, e.g. because the browser tab was
+// busy or the reply got lost
+func (w *WebRTCDiskReader) readChunk(ctx context.Context, start int64, p []byte) error {
+	var err error
+	for attempt := 1; attempt <= diskReadMaxAttempts; attempt++ {
+		err = w.request(ctx, start, p)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		logger.Warnf("disk read at %d failed (attempt %d): %v", start, attempt, err)
 	}
+	return err
+}
 
+func (w *WebRTCDiskReader) request(ctx context.Context, start int64, p []byte) error {
+	select {
+	case w.inflight <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-w.inflight }()
+
+	pending := &pendingDiskRead{
+		start:  uint64(start),
+		length: uint64(len(p)),
+		reply:  make(chan diskReadReply, 1),
+	}
+	w.mutex.Lock()
+	w.nextID++
+	id := w.nextID
+	w.pending[id] = pending
+	w.mutex.Unlock()
+	defer func() {
+		w.mutex.Lock()
+		delete(w.pending, id)
+		w.mutex.Unlock()
+	}()
+
+	jsonBytes, err := json.Marshal(DiskReadRequest{
+		ID:    id,
+		Start: pending.start,
+		End:   pending.start + pending.length,
+	})
+	if err != nil {
+		return err
+	}
+	if currentSession == nil || currentSession.DiskChannel == nil {
+		return errors.New("not active session")
+	}
 	logger.Debugf("reading from webrtc %v", string(jsonBytes))
 	err = currentSession.DiskChannel.SendText(string(jsonBytes))
 	if err != nil {
-		return nil, err
-	}
-	buf := make([]byte, 0)
-	for {
-		select {
-		case data := <-diskReadChan:
-			buf = data[16:]
-		case <-ctx.Done():
-			return nil, context.Canceled
-		}
-		if len(buf) >= int(end-offset) {
-			break
+		return err
+	}
+
+	timer := time.NewTimer(diskReadTimeout)
+	defer timer.Stop()
+	select {
+	case reply := <-pending.reply:
+		if reply.err != nil {
+			return reply.err
 		}
+		copy(p, reply.data)
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("no reply to disk read %d within %v", id, diskReadTimeout)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// handleReply passes a reply frame to the request waiting for it, replies to
+// requests that timed out are dropped
+func (w *WebRTCDiskReader) handleReply(frame []byte) {
+	if len(frame) < diskReadHeaderSize {
+		logger.Warnf("disk read reply too short: %d bytes", len(frame))
+		return
+	}
+	id := binary.BigEndian.Uint32(frame[0:4])
+	status := binary.BigEndian.Uint32(frame[4:8])
+	start := binary.BigEndian.Uint64(frame[8:16])
+	length := binary.BigEndian.Uint64(frame[16:24])
+	data := frame[diskReadHeaderSize:]
+
+	w.mutex.Lock()
+	pending := w.pending[id]
+	w.mutex.Unlock()
+	if pending == nil {
+		logger.Debugf("dropping late reply to disk read %d", id)
+		return
+	}
+
+	var reply diskReadReply
+	switch {
+	case status != diskReadStatusOK:
+		reply.err = fmt.Errorf("browser failed to read at %d", start)
+	case start != pending.start || length != pending.length || uint64(len(data)) != length:
+		reply.err = fmt.Errorf("disk read reply %d doesn't match the request", id)
+	default:
+		reply.data = data
+	}
+	select {
+	case pending.reply <- reply:
+	default:
 	}
-	return buf, nil
 }
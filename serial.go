@@ -0,0 +1,149 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/sys/unix"
+)
+
+const serialFunctionName = "acm.usb0"
+
+// serialPort is the gadget tty of the serial channel currently open, only one
+// browser can own the host console at a time
+var serialPort *os.File
+var serialLock = sync.Mutex{}
+
+// serialDevicePath resolves the /dev/ttyGSN node of the ACM function
+func serialDevicePath() (string, error) {
+	if usbGadget == nil {
+		return "", fmt.Errorf("usb gadget is not available")
+	}
+	data, err := os.ReadFile(path.Join(usbGadget.functionPath(serialFunctionName), "port_num"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%s is not enabled", serialFunctionName)
+		}
+		return "", err
+	}
+	return "/dev/ttyGS" + strings.TrimSpace(string(data)), nil
+}
+
+// setSerialRawMode turns off the line discipline of the gadget tty, so bytes
+// pass through unchanged in both directions
+func setSerialRawMode(file *os.File) error {
+	fd := int(file.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return err
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+}
+
+func openSerialPort() (*os.File, error) {
+	devicePath, err := serialDevicePath()
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(devicePath, os.O_RDWR|unix.O_NOCTTY, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", devicePath, err)
+	}
+	err = setSerialRawMode(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to set raw mode on %s: %w", devicePath, err)
+	}
+	return file, nil
+}
+
+func handleSerialChannel(d *webrtc.DataChannel) {
+	// port is set by OnOpen and cleared by OnClose, which pion runs on other
+	// goroutines than OnMessage
+	var port *os.File
+	var portLock sync.Mutex
+	getPort := func() *os.File {
+		portLock.Lock()
+		defer portLock.Unlock()
+		return port
+	}
+
+	d.OnOpen(func() {
+		opened, err := openSerialPort()
+		if err != nil {
+			logger.Errorf("Failed to open serial port: %v", err)
+			d.Close()
+			return
+		}
+		portLock.Lock()
+		port = opened
+		portLock.Unlock()
+
+		serialLock.Lock()
+		if serialPort != nil {
+			logger.Info("closing serial port of the previous channel")
+			serialPort.Close()
+		}
+		serialPort = opened
+		serialLock.Unlock()
+
+		go func(port *os.File) {
+			buf := make([]byte, 1024)
+			for {
+				n, err := port.Read(buf)
+				if err != nil {
+					if err != io.EOF && !errors.Is(err, os.ErrClosed) {
+						logger.Errorf("Failed to read from serial port: %v", err)
+					}
+					break
+				}
+				err = d.Send(buf[:n])
+				if err != nil {
+					logger.Errorf("Failed to send serial output: %v", err)
+					break
+				}
+			}
+			d.Close()
+		}(opened)
+	})
+
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		port := getPort()
+		if port == nil {
+			return
+		}
+		_, err := port.Write(msg.Data)
+		if err != nil && !errors.Is(err, os.ErrClosed) {
+			logger.Errorf("Failed to write to serial port: %v", err)
+		}
+	})
+
+	d.OnClose(func() {
+		portLock.Lock()
+		closing := port
+		port = nil
+		portLock.Unlock()
+		if closing == nil {
+			return
+		}
+		serialLock.Lock()
+		if serialPort == closing {
+			serialPort = nil
+		}
+		serialLock.Unlock()
+		closing.Close()
+	})
+}
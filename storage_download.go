@@ -0,0 +1,731 @@
+package kvm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	downloadIdPrefix = "download_"
+	// resume records live outside imagesFolder so they don't show up as images
+	downloadsFolder       = "/userdata/jetkvm/downloads"
+	downloadMaxAttempts   = 5
+	downloadProgressEvery = 500 * time.Millisecond
+)
+
+const (
+	DownloadStateDownloading = "downloading"
+	DownloadStateVerifying   = "verifying"
+	DownloadStateCompleted   = "completed"
+	DownloadStateFailed      = "failed"
+	DownloadStateCancelled   = "cancelled"
+)
+
+type StorageDownload struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	Filename   string `json:"filename"`
+	SourceFile string `json:"sourceFile,omitempty"` // stored file decompressed instead of a url
+	Decompress string `json:"decompress,omitempty"` // compression undone while storing
+	// SourceFile is deleted once it was decompressed without errors
+	RemoveSource bool      `json:"removeSource,omitempty"`
+	SHA256       string    `json:"sha256,omitempty"`
+	Size         int64     `json:"size"` // 0 until the server tells
+	Downloaded   int64     `json:"downloaded"`
+	State        string    `json:"state"`
+	Error        string    `json:"error,omitempty"`
+	StartedAt    time.Time `json:"startedAt"`
+}
+
+func (d *StorageDownload) finished() bool {
+	return d.State == DownloadStateCompleted || d.State == DownloadStateFailed || d.State == DownloadStateCancelled
+}
+
+// downloadResumeRecord lets a download of the same URL continue the
+// .incomplete file, the validator makes sure the remote file didn't change
+type downloadResumeRecord struct {
+	URL       string `json:"url"`
+	Validator string `json:"validator"` // ETag or Last-Modified
+}
+
+// pendingMount is mounted once the job stored the image
+type pendingMount struct {
+	lun  int
+	mode VirtualMediaMode
+}
+
+type storageDownloadJob struct {
+	state  StorageDownload
+	cancel context.CancelFunc
+	mount  *pendingMount
+}
+
+var storageDownloads = make(map[string]*storageDownloadJob)
+var storageDownloadsLock = sync.Mutex{}
+
+func triggerStorageDownloadUpdate(download StorageDownload) {
+	go func() {
+		if currentSession == nil {
+			return
+		}
+		writeJSONRPCEvent("storageDownloadState", download, currentSession)
+	}()
+}
+
+func updateStorageDownload(id string, update func(*StorageDownload)) {
+	storageDownloadsLock.Lock()
+	job := storageDownloads[id]
+	update(&job.state)
+	state := job.state
+	storageDownloadsLock.Unlock()
+	triggerStorageDownloadUpdate(state)
+}
+
+func downloadResumePath(filename string) string {
+	return filepath.Join(downloadsFolder, filename+".json")
+}
+
+func readDownloadResumeRecord(filename string) *downloadResumeRecord {
+	recordJSON, err := os.ReadFile(downloadResumePath(filename))
+	if err != nil {
+		return nil
+	}
+	var record downloadResumeRecord
+	if json.Unmarshal(recordJSON, &record) != nil {
+		return nil
+	}
+	return &record
+}
+
+func writeDownloadResumeRecord(filename string, record downloadResumeRecord) error {
+	err := os.MkdirAll(filepath.Dir(downloadResumePath(filename)), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create downloads folder: %w", err)
+	}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(downloadResumePath(filename), recordJSON, 0644)
+}
+
+// renameDownloadResumeRecords moves the resume records of the partial
+// downloads in a renamed folder, a renamed file's own record stays with its
+// .incomplete file, which isn't renamed along
+func renameDownloadResumeRecords(from string, to string) {
+	fromFolder := filepath.Join(downloadsFolder, from)
+	if info, err := os.Stat(fromFolder); err != nil || !info.IsDir() {
+		return
+	}
+	toFolder := filepath.Join(downloadsFolder, to)
+	err := os.MkdirAll(filepath.Dir(toFolder), 0755)
+	if err == nil {
+		err = os.Rename(fromFolder, toFolder)
+	}
+	if err != nil {
+		logger.Warnf("failed to move resume records of %s: %v", from, err)
+	}
+}
+
+// storageDownloadClient has no overall timeout, downloads may take hours, but
+// gives up on servers that don't answer
+var storageDownloadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+// isStorageFileBusy reports whether an upload or a running download writes
+// the file
+func isStorageFileBusy(filename string) bool {
+	storageDownloadsLock.Lock()
+	defer storageDownloadsLock.Unlock()
+	return isStorageFileBusyLocked(filename)
+}
+
+// isStorageFileBusyLocked must be called with storageDownloadsLock held
+func isStorageFileBusyLocked(filename string) bool {
+	incompletePath := filepath.Join(imagesFolder, filename) + ".incomplete"
+	pendingUploadsMutex.Lock()
+	for _, upload := range pendingUploads {
+		if upload.File.Name() == incompletePath {
+			pendingUploadsMutex.Unlock()
+			return true
+		}
+	}
+	pendingUploadsMutex.Unlock()
+
+	for _, job := range storageDownloads {
+		if job.state.Filename == filename && !job.state.finished() {
+			return true
+		}
+	}
+	return false
+}
+
+// rpcDownloadStorageFile starts downloading url into the images folder in the
+// background, sha256 is optional
+func rpcDownloadStorageFile(rawUrl string, filename string, sha256sum string) (*StorageDownload, error) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid download url: %s", rawUrl)
+	}
+	filename, err = sanitizeStoragePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	sha256sum, err = normalizeSHA256(sha256sum)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Dir(filepath.Join(imagesFolder, filename)), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create images folder: %w", err)
+	}
+	logger.Infof("downloading %s to %s", rawUrl, filename)
+	return startStorageJob(StorageDownload{
+		URL:      rawUrl,
+		Filename: filename,
+		SHA256:   sha256sum,
+	}, nil)
+}
+
+// startDecompressedDownload downloads a compressed image and stores it
+// decompressed, such downloads start over instead of resuming
+func startDecompressedDownload(rawUrl string, filename string, mount *pendingMount) (*StorageDownload, error) {
+	compression, _ := imageCompression(urlFilename(rawUrl))
+	if compression == "" {
+		return nil, fmt.Errorf("not a compressed image: %s", rawUrl)
+	}
+	err := os.MkdirAll(imagesFolder, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create images folder: %w", err)
+	}
+	logger.Infof("downloading %s decompressed to %s", rawUrl, filename)
+	return startStorageJob(StorageDownload{
+		URL:        rawUrl,
+		Filename:   filename,
+		Decompress: compression,
+	}, mount)
+}
+
+// startStorageDecompress stores a decompressed copy of a stored image next
+// to it, removeSource deletes the compressed image afterwards
+func startStorageDecompress(sourceFile string, removeSource bool, mount *pendingMount) (*StorageDownload, error) {
+	compression, filename := imageCompression(sourceFile)
+	if compression == "" {
+		return nil, fmt.Errorf("not a compressed image: %s", sourceFile)
+	}
+	source, err := os.Open(filepath.Join(imagesFolder, sourceFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	sourceInfo, err := source.Stat()
+	if err != nil {
+		source.Close()
+		return nil, fmt.Errorf("failed to get file info: %w", err)
+	}
+	// the writer stops at the reserve too, this fails early when it's clear
+	// the image won't fit
+	size := decompressedSize(source, sourceInfo.Size(), compression)
+	source.Close()
+	err = checkStorageSpace(size)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("decompressing %s to %s", sourceFile, filename)
+	return startStorageJob(StorageDownload{
+		SourceFile:   sourceFile,
+		Filename:     filename,
+		Decompress:   compression,
+		RemoveSource: removeSource,
+	}, mount)
+}
+
+// rpcDecompressStorageFile stores a decompressed copy of a stored image,
+// removeSource is optional
+func rpcDecompressStorageFile(filename string, removeSource bool) (*StorageDownload, error) {
+	filename, err := sanitizeStoragePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	return startStorageDecompress(filename, removeSource, nil)
+}
+
+// startStorageJob runs a job that writes download.Filename into the images
+// folder in the background
+func startStorageJob(download StorageDownload, mount *pendingMount) (*StorageDownload, error) {
+	// checked and registered under one lock, so two calls can't both pass
+	storageDownloadsLock.Lock()
+	if _, err := os.Stat(filepath.Join(imagesFolder, download.Filename)); err == nil {
+		storageDownloadsLock.Unlock()
+		return nil, fmt.Errorf("file already exists: %s", download.Filename)
+	}
+	if isStorageFileBusyLocked(download.Filename) {
+		storageDownloadsLock.Unlock()
+		return nil, fmt.Errorf("file is already being written: %s", download.Filename)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	download.ID = downloadIdPrefix + uuid.New().String()
+	download.State = DownloadStateDownloading
+	download.StartedAt = time.Now()
+	job := &storageDownloadJob{
+		state:  download,
+		cancel: cancel,
+		mount:  mount,
+	}
+	// a new download of the same file replaces the finished one
+	for id, previous := range storageDownloads {
+		if previous.state.Filename == download.Filename && previous.state.finished() {
+			delete(storageDownloads, id)
+		}
+	}
+	storageDownloads[job.state.ID] = job
+	state := job.state
+	storageDownloadsLock.Unlock()
+
+	go runStorageDownload(ctx, state, mount)
+	triggerStorageDownloadUpdate(state)
+	return &state, nil
+}
+
+func runStorageDownload(ctx context.Context, download StorageDownload, mount *pendingMount) {
+	var err error
+	switch {
+	case download.SourceFile != "":
+		err = decompressStorageFile(ctx, download)
+	case download.Decompress != "":
+		err = downloadDecompressedStorageFile(ctx, download)
+	default:
+		err = downloadStorageFile(ctx, download)
+	}
+	var mountErr error
+	if err == nil && mount != nil {
+		mountErr = rpcMountWithStorage(download.Filename, mount.mode, mount.lun)
+		if mountErr != nil {
+			logger.Warnf("failed to mount %s: %v", download.Filename, mountErr)
+		}
+	}
+	updateStorageDownload(download.ID, func(d *StorageDownload) {
+		switch {
+		case err == nil:
+			d.State = DownloadStateCompleted
+			if mountErr != nil {
+				d.Error = fmt.Sprintf("stored, but failed to mount: %v", mountErr)
+			}
+		case ctx.Err() != nil:
+			d.State = DownloadStateCancelled
+		default:
+			d.State = DownloadStateFailed
+			d.Error = err.Error()
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		logger.Warnf("download of %s failed: %v", download.Filename, err)
+	}
+}
+
+func downloadStorageFile(ctx context.Context, download StorageDownload) error {
+	targetPath := filepath.Join(imagesFolder, download.Filename)
+	incompletePath := targetPath + ".incomplete"
+
+	file, err := os.OpenFile(incompletePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open file for download: %w", err)
+	}
+	defer file.Close()
+
+	// only continue what an earlier download of the same url left behind
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	record := readDownloadResumeRecord(download.Filename)
+	if offset > 0 && (record == nil || record.URL != download.URL || record.Validator == "") {
+		offset = 0
+	}
+	validator := ""
+	if record != nil && offset > 0 {
+		validator = record.Validator
+	}
+
+	hasher := sha256.New()
+	if offset > 0 {
+		_, err = io.Copy(hasher, io.NewSectionReader(file, 0, offset))
+		if err != nil {
+			return fmt.Errorf("failed to hash the partial download: %w", err)
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		offset, validator, err = downloadStorageFileFrom(ctx, download, file, offset, validator, hasher)
+		if err == nil || ctx.Err() != nil || attempt >= downloadMaxAttempts {
+			break
+		}
+		logger.Warnf("download of %s interrupted at %d bytes, retrying: %v", download.Filename, offset, err)
+		select {
+		case <-time.After(time.Duration(attempt) * 2 * time.Second):
+		case <-ctx.Done():
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	if download.SHA256 != "" {
+		updateStorageDownload(download.ID, func(d *StorageDownload) {
+			d.State = DownloadStateVerifying
+		})
+		if sum != download.SHA256 {
+			// the data is wrong, resuming would keep it
+			os.Remove(incompletePath)
+			os.Remove(downloadResumePath(download.Filename))
+			return fmt.Errorf("sha256 mismatch: expected %s, got %s", download.SHA256, sum)
+		}
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync downloaded file: %w", err)
+	}
+	err = os.Rename(incompletePath, targetPath)
+	if err != nil {
+		return fmt.Errorf("failed to rename downloaded file: %w", err)
+	}
+	os.Remove(downloadResumePath(download.Filename))
+	setStorageFileChecksum(download.Filename, sum)
+	logger.Infof("downloaded %s", download.Filename)
+	return nil
+}
+
+// downloadStorageFileFrom fetches the file from offset onwards, it returns
+// how far it got so a retry can continue from there
+func downloadStorageFileFrom(ctx context.Context, download StorageDownload, file *os.File, offset int64, validator string, hasher hash.Hash) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, download.URL, nil)
+	if err != nil {
+		return offset, validator, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// the server sends the whole file if it changed since
+		if validator != "" {
+			req.Header.Set("If-Range", validator)
+		}
+	}
+
+	// the default client times out whole requests, too short for big images
+	resp, err := storageDownloadClient.Do(req)
+	if err != nil {
+		return offset, validator, fmt.Errorf("failed to download: %w", err)
+	}
+	defer resp.Body.Close()
+
+	size := int64(0)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if offset > 0 {
+			logger.Infof("server sent the whole file, restarting download of %s", download.Filename)
+		}
+		offset = 0
+		hasher.Reset()
+		err = file.Truncate(0)
+		if err != nil {
+			return offset, validator, err
+		}
+		size = max(resp.ContentLength, 0)
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return offset, validator, err
+		}
+		if start != offset {
+			return offset, validator, fmt.Errorf("server resumed at %d instead of %d", start, offset)
+		}
+		size = total
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file may already hold everything
+		if _, total, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil && total == offset {
+			updateStorageDownload(download.ID, func(d *StorageDownload) {
+				d.Size = total
+				d.Downloaded = offset
+			})
+			return offset, validator, nil
+		}
+		return offset, validator, fmt.Errorf("server refused to resume at %d", offset)
+	default:
+		return offset, validator, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	if size > 0 {
+		err = checkStorageSpace(size - offset)
+		if err != nil {
+			return offset, validator, err
+		}
+	}
+
+	validator = resp.Header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	err = writeDownloadResumeRecord(download.Filename, downloadResumeRecord{URL: download.URL, Validator: validator})
+	if err != nil {
+		logger.Warnf("failed to save resume record of %s: %v", download.Filename, err)
+	}
+
+	updateStorageDownload(download.ID, func(d *StorageDownload) {
+		d.Size = size
+		d.Downloaded = offset
+	})
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return offset, validator, err
+	}
+	// servers that don't tell the size were not checked up front
+	writer := &storageSpaceWriter{w: file}
+	if size == 0 {
+		writer.unchecked = storageSpaceCheckEvery
+	}
+	buffer := make([]byte, 256*1024)
+	lastProgress := time.Now()
+	for {
+		n, readErr := resp.Body.Read(buffer)
+		if n > 0 {
+			_, err := writer.Write(buffer[:n])
+			if err != nil {
+				return offset, validator, fmt.Errorf("failed to write downloaded data: %w", err)
+			}
+			hasher.Write(buffer[:n])
+			offset += int64(n)
+			if time.Since(lastProgress) >= downloadProgressEvery {
+				downloaded := offset
+				updateStorageDownload(download.ID, func(d *StorageDownload) {
+					d.Downloaded = downloaded
+				})
+				lastProgress = time.Now()
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return offset, validator, fmt.Errorf("download interrupted: %w", readErr)
+		}
+	}
+	downloaded := offset
+	updateStorageDownload(download.ID, func(d *StorageDownload) {
+		d.Downloaded = downloaded
+	})
+	if size > 0 && offset != size {
+		return offset, validator, fmt.Errorf("download ended at %d of %d bytes", offset, size)
+	}
+	return offset, validator, nil
+}
+
+// downloadProgressReader reports how much of the compressed input was read,
+// the decompressed size isn't known in advance
+type downloadProgressReader struct {
+	ctx          context.Context
+	r            io.Reader
+	id           string
+	read         int64
+	lastProgress time.Time
+}
+
+func (p *downloadProgressReader) Read(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if time.Since(p.lastProgress) >= downloadProgressEvery || err == io.EOF {
+		read := p.read
+		updateStorageDownload(p.id, func(d *StorageDownload) {
+			d.Downloaded = read
+		})
+		p.lastProgress = time.Now()
+	}
+	return n, err
+}
+
+// decompressInto writes the decompressed input to the start of file
+func decompressInto(ctx context.Context, download StorageDownload, file *os.File, compressed io.Reader) error {
+	err := file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	progress := &downloadProgressReader{ctx: ctx, r: compressed, id: download.ID, lastProgress: time.Now()}
+	decompressed, err := newDecompressReader(download.Decompress, progress)
+	if err != nil {
+		return fmt.Errorf("failed to decompress: %w", err)
+	}
+	defer decompressed.Close()
+	// the decompressed size isn't known up front
+	_, err = io.Copy(&storageSpaceWriter{w: file}, decompressed)
+	if err != nil {
+		return fmt.Errorf("failed to decompress: %w", err)
+	}
+	return nil
+}
+
+// storeDecompressedFile moves a completely decompressed file in place
+func storeDecompressedFile(file *os.File, download StorageDownload) error {
+	targetPath := filepath.Join(imagesFolder, download.Filename)
+	err := file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync decompressed file: %w", err)
+	}
+	err = os.Rename(file.Name(), targetPath)
+	if err != nil {
+		return fmt.Errorf("failed to rename decompressed file: %w", err)
+	}
+	go computeStorageFileChecksum(download.Filename)
+	logger.Infof("stored decompressed %s", download.Filename)
+	return nil
+}
+
+func decompressStorageFile(ctx context.Context, download StorageDownload) error {
+	source, err := os.Open(filepath.Join(imagesFolder, download.SourceFile))
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer source.Close()
+	sourceInfo, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	updateStorageDownload(download.ID, func(d *StorageDownload) {
+		d.Size = sourceInfo.Size()
+	})
+
+	incompletePath := filepath.Join(imagesFolder, download.Filename) + ".incomplete"
+	file, err := os.Create(incompletePath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+	err = decompressInto(ctx, download, file, source)
+	if err == nil {
+		err = storeDecompressedFile(file, download)
+	}
+	if err != nil {
+		os.Remove(incompletePath)
+		return err
+	}
+	// the decompressors check the integrity of what they read, an image
+	// that decompressed without errors is complete
+	if download.RemoveSource {
+		source.Close()
+		if err := rpcDeleteStorageFile(download.SourceFile); err != nil {
+			logger.Warnf("failed to remove %s after decompressing it: %v", download.SourceFile, err)
+		} else {
+			logger.Infof("removed %s after decompressing it", download.SourceFile)
+		}
+	}
+	return nil
+}
+
+func downloadDecompressedStorageFile(ctx context.Context, download StorageDownload) error {
+	incompletePath := filepath.Join(imagesFolder, download.Filename) + ".incomplete"
+	file, err := os.Create(incompletePath)
+	if err != nil {
+		return fmt.Errorf("failed to open file for download: %w", err)
+	}
+	defer file.Close()
+
+	for attempt := 1; ; attempt++ {
+		err = downloadDecompressedFrom(ctx, download, file)
+		if err == nil || ctx.Err() != nil || attempt >= downloadMaxAttempts {
+			break
+		}
+		logger.Warnf("download of %s interrupted, starting over: %v", download.Filename, err)
+		select {
+		case <-time.After(time.Duration(attempt) * 2 * time.Second):
+		case <-ctx.Done():
+		}
+	}
+	if err == nil {
+		err = storeDecompressedFile(file, download)
+	}
+	if err != nil {
+		// the decompressor state is lost, there is nothing to resume
+		os.Remove(incompletePath)
+	}
+	return err
+}
+
+func downloadDecompressedFrom(ctx context.Context, download StorageDownload, file *os.File) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, download.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := storageDownloadClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to download: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	updateStorageDownload(download.ID, func(d *StorageDownload) {
+		d.Size = max(resp.ContentLength, 0)
+		d.Downloaded = 0
+	})
+	return decompressInto(ctx, download, file, resp.Body)
+}
+
+func rpcListDownloads() []StorageDownload {
+	storageDownloadsLock.Lock()
+	defer storageDownloadsLock.Unlock()
+	downloads := make([]StorageDownload, 0, len(storageDownloads))
+	for _, job := range storageDownloads {
+		downloads = append(downloads, job.state)
+	}
+	sort.Slice(downloads, func(i, j int) bool {
+		return downloads[i].StartedAt.Before(downloads[j].StartedAt)
+	})
+	return downloads
+}
+
+// rpcCancelDownload stops a download, the partial file is kept so the same
+// download can resume later
+func rpcCancelDownload(id string) error {
+	storageDownloadsLock.Lock()
+	defer storageDownloadsLock.Unlock()
+	job, ok := storageDownloads[id]
+	if !ok {
+		return fmt.Errorf("unknown download: %s", id)
+	}
+	if job.state.finished() {
+		return errors.New("download already finished")
+	}
+	job.cancel()
+	return nil
+}
@@ -0,0 +1,297 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	storageCleanupEvery = 6 * time.Hour
+	// writes of unknown size check the space that is left this often
+	storageSpaceCheckEvery = 64 * 1024 * 1024
+)
+
+type StorageSettings struct {
+	ReserveMB       int `json:"reserveMB"`       // kept free on /userdata for the system
+	StaleUploadDays int `json:"staleUploadDays"` // partial uploads untouched this long are removed, 0 keeps them
+}
+
+var defaultStorageSettings = StorageSettings{
+	ReserveMB:       512,
+	StaleUploadDays: 7,
+}
+
+func currentStorageSettings() StorageSettings {
+	if config == nil || config.Storage == nil {
+		return defaultStorageSettings
+	}
+	return *config.Storage
+}
+
+func rpcGetStorageSettings() StorageSettings {
+	return currentStorageSettings()
+}
+
+func rpcSetStorageSettings(settings StorageSettings) error {
+	if settings.ReserveMB < 0 || settings.StaleUploadDays < 0 {
+		return errors.New("storage settings must not be negative")
+	}
+	config.Storage = &settings
+	return SaveConfig()
+}
+
+// sanitizeStoragePath cleans a path below imagesFolder, unlike
+// sanitizeFilename it keeps folders
+func sanitizeStoragePath(storagePath string) (string, error) {
+	cleanPath := filepath.Clean(strings.TrimPrefix(storagePath, "/"))
+	if cleanPath == "." || filepath.IsAbs(cleanPath) {
+		return "", errors.New("invalid filename")
+	}
+	for _, part := range strings.Split(cleanPath, string(filepath.Separator)) {
+		if part == ".." || strings.HasPrefix(part, ".") {
+			return "", errors.New("invalid filename")
+		}
+	}
+	return cleanPath, nil
+}
+
+// storageRelativePath turns a path in imagesFolder back into a storage path
+func storageRelativePath(fullPath string) string {
+	relative, err := filepath.Rel(imagesFolder, fullPath)
+	if err != nil {
+		return filepath.Base(fullPath)
+	}
+	return relative
+}
+
+// storageBytesAvailable is the free space minus the reserve
+func storageBytesAvailable() (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(imagesFolder, &stat)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get storage stats: %v", err)
+	}
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	return max(free-int64(currentStorageSettings().ReserveMB)*1024*1024, 0), nil
+}
+
+// checkStorageSpace fails if writing size more bytes would eat into the reserve
+func checkStorageSpace(size int64) error {
+	available, err := storageBytesAvailable()
+	if err != nil {
+		return err
+	}
+	if size > available {
+		return fmt.Errorf("not enough space: %d bytes needed, %d available", size, available)
+	}
+	return nil
+}
+
+// storageSpaceWriter stops writes of unknown size before they eat into the
+// reserve
+type storageSpaceWriter struct {
+	w         io.Writer
+	unchecked int64
+}
+
+func (s *storageSpaceWriter) Write(p []byte) (int, error) {
+	if s.unchecked >= storageSpaceCheckEvery {
+		s.unchecked = 0
+		available, err := storageBytesAvailable()
+		if err == nil && available < storageSpaceCheckEvery {
+			return 0, errors.New("not enough space, the storage reserve was reached")
+		}
+	}
+	n, err := s.w.Write(p)
+	s.unchecked += int64(n)
+	return n, err
+}
+
+// storageAllocatedSize is the space a file takes, partial uploads may be sparse
+func storageAllocatedSize(info fs.FileInfo) int64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
+
+// isStorageFileMounted reports whether the file or anything in the folder is
+// mounted
+func isStorageFileMounted(storagePath string) bool {
+	virtualMediaStateMutex.RLock()
+	defer virtualMediaStateMutex.RUnlock()
+	for _, mounted := range virtualMediaLuns {
+		if mounted.state == nil || mounted.state.Source != Storage {
+			continue
+		}
+		filename := mounted.state.Filename
+		if filename == storagePath || strings.HasPrefix(filename, storagePath+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStoragePathBusy extends isStorageFileBusy to folders
+func isStoragePathBusy(storagePath string) bool {
+	if isStorageFileMounted(storagePath) {
+		return true
+	}
+	busy := false
+	_ = filepath.WalkDir(filepath.Join(imagesFolder, storagePath), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if isStorageFileBusy(strings.TrimSuffix(storageRelativePath(p), ".incomplete")) {
+			busy = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return busy
+}
+
+func rpcCreateStorageFolder(folder string) error {
+	folder, err := sanitizeStoragePath(folder)
+	if err != nil {
+		return err
+	}
+	fullPath := filepath.Join(imagesFolder, folder)
+	if _, err := os.Stat(fullPath); err == nil {
+		return fmt.Errorf("already exists: %s", folder)
+	}
+	err = os.MkdirAll(fullPath, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create folder: %w", err)
+	}
+	return nil
+}
+
+// rpcRenameStorageFile renames or moves a file or a folder within the storage
+func rpcRenameStorageFile(from string, to string) error {
+	from, err := sanitizeStoragePath(from)
+	if err != nil {
+		return err
+	}
+	to, err = sanitizeStoragePath(to)
+	if err != nil {
+		return err
+	}
+	fromPath := filepath.Join(imagesFolder, from)
+	toPath := filepath.Join(imagesFolder, to)
+	if _, err := os.Stat(fromPath); err != nil {
+		return fmt.Errorf("file does not exist: %s", from)
+	}
+	if _, err := os.Stat(toPath); err == nil {
+		return fmt.Errorf("file already exists: %s", to)
+	}
+	// partial files would be taken over by the next upload or download
+	if strings.HasSuffix(to, ".incomplete") {
+		return fmt.Errorf("names ending in .incomplete are reserved for partial files: %s", to)
+	}
+	if strings.HasPrefix(to, from+string(filepath.Separator)) {
+		return errors.New("can't move a folder into itself")
+	}
+	if isStoragePathBusy(from) {
+		return fmt.Errorf("%s is mounted or being written", from)
+	}
+	err = os.MkdirAll(filepath.Dir(toPath), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create folder: %w", err)
+	}
+	err = os.Rename(fromPath, toPath)
+	if err != nil {
+		return fmt.Errorf("failed to rename: %w", err)
+	}
+	renameImageMetadata(from, to)
+	renameDownloadResumeRecords(from, to)
+	return nil
+}
+
+type StorageFileUsage struct {
+	Filename string `json:"filename"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// storageUsage sums up the space taken in imagesFolder, largest files first
+func storageUsage() (int64, int64, []StorageFileUsage) {
+	var filesBytes, incompleteBytes int64
+	usage := make([]StorageFileUsage, 0)
+	_ = filepath.WalkDir(imagesFolder, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		size := storageAllocatedSize(info)
+		if strings.HasSuffix(p, ".incomplete") {
+			incompleteBytes += size
+		} else {
+			filesBytes += size
+		}
+		usage = append(usage, StorageFileUsage{Filename: storageRelativePath(p), Bytes: size})
+		return nil
+	})
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Bytes > usage[j].Bytes
+	})
+	return filesBytes, incompleteBytes, usage
+}
+
+// rpcCleanupStorage removes partial uploads and downloads nobody continued
+// for StaleUploadDays
+func rpcCleanupStorage() ([]string, error) {
+	days := currentStorageSettings().StaleUploadDays
+	removed := make([]string, 0)
+	if days == 0 {
+		return removed, nil
+	}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	err := filepath.WalkDir(imagesFolder, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".incomplete") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		filename := strings.TrimSuffix(storageRelativePath(p), ".incomplete")
+		if isStorageFileBusy(filename) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			logger.Warnf("failed to remove stale upload %s: %v", p, err)
+			return nil
+		}
+		os.Remove(downloadResumePath(filename))
+		removed = append(removed, storageRelativePath(p))
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to clean up storage: %w", err)
+	}
+	if len(removed) > 0 {
+		logger.Infof("removed stale uploads: %v", removed)
+	}
+	return removed, nil
+}
+
+func runStorageCleanup() {
+	for {
+		_, err := rpcCleanupStorage()
+		if err != nil {
+			logger.Warnf("%v", err)
+		}
+		time.Sleep(storageCleanupEvery)
+	}
+}
@@ -0,0 +1,163 @@
+package kvm
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	errUploadOverrun       = errors.New("upload is larger than the declared size")
+	errUploadChecksum      = errors.New("uploaded file doesn't match its sha256 checksum")
+	errUploadInterrupted   = errors.New("upload ended before the complete file was received")
+	errUploadAlreadyActive = errors.New("upload is already in progress")
+)
+
+// pendingUpload is the state of an upload shared by the data channel and the
+// HTTP path: begin, write until Size is reached, then finish
+type pendingUpload struct {
+	mutex                sync.Mutex
+	id                   string
+	File                 *os.File
+	Size                 int64
+	AlreadyUploadedBytes int64
+	SHA256               string // expected checksum, optional
+	hasher               hash.Hash
+	active               bool
+	finished             bool
+}
+
+var pendingUploads = make(map[string]*pendingUpload)
+var pendingUploadsMutex sync.Mutex
+
+type UploadProgress struct {
+	Size                 int64
+	AlreadyUploadedBytes int64
+	Completed            bool   // the file was verified and stored
+	Error                string // the upload failed
+}
+
+func getPendingUpload(uploadId string) *pendingUpload {
+	pendingUploadsMutex.Lock()
+	defer pendingUploadsMutex.Unlock()
+	return pendingUploads[uploadId]
+}
+
+// begin claims the upload for one transfer and hashes what an earlier
+// transfer already stored
+func (u *pendingUpload) begin() error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.active || u.finished {
+		return errUploadAlreadyActive
+	}
+	hasher := sha256.New()
+	if u.AlreadyUploadedBytes > 0 {
+		_, err := io.Copy(hasher, io.NewSectionReader(u.File, 0, u.AlreadyUploadedBytes))
+		if err != nil {
+			// the partial file stays behind for a new upload to resume
+			u.closeLocked()
+			return fmt.Errorf("failed to hash the partial upload: %w", err)
+		}
+	}
+	u.hasher = hasher
+	u.active = true
+	return nil
+}
+
+// write appends p, nothing of p is written if it goes past Size
+func (u *pendingUpload) write(p []byte) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.finished {
+		return errUploadOverrun
+	}
+	if u.AlreadyUploadedBytes+int64(len(p)) > u.Size {
+		return errUploadOverrun
+	}
+	n, err := u.File.Write(p)
+	u.hasher.Write(p[:n])
+	u.AlreadyUploadedBytes += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write upload data: %w", err)
+	}
+	return nil
+}
+
+func (u *pendingUpload) progress() UploadProgress {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return UploadProgress{Size: u.Size, AlreadyUploadedBytes: u.AlreadyUploadedBytes}
+}
+
+func (u *pendingUpload) complete() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.AlreadyUploadedBytes == u.Size
+}
+
+// closeLocked closes the file and forgets the upload, u.mutex must be held
+func (u *pendingUpload) closeLocked() {
+	u.finished = true
+	u.File.Close()
+	pendingUploadsMutex.Lock()
+	delete(pendingUploads, u.id)
+	pendingUploadsMutex.Unlock()
+}
+
+// finish ends the transfer. A complete upload is verified and renamed, an
+// interrupted one stays behind to be resumed.
+func (u *pendingUpload) finish(transferErr error) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.finished {
+		return transferErr
+	}
+	u.closeLocked()
+
+	incompletePath := u.File.Name()
+	if errors.Is(transferErr, errUploadOverrun) {
+		// the client doesn't send what it announced, none of it can be trusted
+		os.Remove(incompletePath)
+		return transferErr
+	}
+	if u.AlreadyUploadedBytes != u.Size {
+		if transferErr == nil {
+			transferErr = errUploadInterrupted
+		}
+		logger.Warnf("upload of %s stopped at %d of %d bytes: %v", incompletePath, u.AlreadyUploadedBytes, u.Size, transferErr)
+		return transferErr
+	}
+
+	sum := hex.EncodeToString(u.hasher.Sum(nil))
+	if u.SHA256 != "" && sum != u.SHA256 {
+		os.Remove(incompletePath)
+		return fmt.Errorf("%w: expected %s, got %s", errUploadChecksum, u.SHA256, sum)
+	}
+	newName := strings.TrimSuffix(incompletePath, ".incomplete")
+	err := os.Rename(incompletePath, newName)
+	if err != nil {
+		return fmt.Errorf("failed to rename uploaded file: %w", err)
+	}
+	logger.Debugf("successfully renamed uploaded file to: %s", newName)
+	go setStorageFileChecksum(storageRelativePath(newName), sum)
+	return nil
+}
+
+// normalizeSHA256 accepts an empty checksum or 64 hex digits in any case
+func normalizeSHA256(sha256sum string) (string, error) {
+	sha256sum = strings.ToLower(strings.TrimSpace(sha256sum))
+	if sha256sum == "" {
+		return "", nil
+	}
+	if decoded, err := hex.DecodeString(sha256sum); err != nil || len(decoded) != sha256.Size {
+		return "", fmt.Errorf("invalid sha256 checksum: %s", sha256sum)
+	}
+	return sha256sum, nil
+}
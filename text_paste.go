@@ -0,0 +1,162 @@
+package kvm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultTextPasteDelay = 20 * time.Millisecond
+
+type TextPasteState struct {
+	Running   bool   `json:"running"`
+	Layout    string `json:"layout,omitempty"`
+	Total     int    `json:"total"`
+	Sent      int    `json:"sent"`
+	Cancelled bool   `json:"cancelled,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+var textPasteState TextPasteState
+var textPasteCancel context.CancelFunc
+var textPasteLock = sync.Mutex{}
+
+func triggerTextPasteStateUpdate() {
+	textPasteLock.Lock()
+	state := textPasteState
+	textPasteLock.Unlock()
+	go func() {
+		if currentSession == nil {
+			return
+		}
+		writeJSONRPCEvent("textPasteState", state, currentSession)
+	}()
+}
+
+// textToKeyStrokes maps every character of text to the key strokes typing it
+// on the given layout, it fails on the first character the layout can't type
+func textToKeyStrokes(text string, layout string) ([][]keyStroke, error) {
+	strokes, ok := keyboardLayoutStrokes[layout]
+	if !ok {
+		return nil, fmt.Errorf("unknown keyboard layout: %s", layout)
+	}
+	runes := []rune(text)
+	result := make([][]keyStroke, 0, len(runes))
+	for i, char := range runes {
+		// CRLF is typed as a single Enter
+		if char == '\r' {
+			if i+1 < len(runes) && runes[i+1] == '\n' {
+				continue
+			}
+			char = '\n'
+		}
+		charStrokes, ok := strokes[char]
+		if !ok {
+			return nil, fmt.Errorf("character %q at position %d can't be typed with layout %s", char, i, layout)
+		}
+		// the boot keyboard stops at Keyboard Application, keys like the JIS
+		// Yen key need the NKRO keyboard
+		for _, stroke := range charStrokes {
+			if stroke.Key > bootKeyboardMaxUsage && rpcGetKeyboardMode() != KeyboardModeNKRO {
+				return nil, fmt.Errorf("character %q at position %d needs the NKRO keyboard mode", char, i)
+			}
+		}
+		result = append(result, charStrokes)
+	}
+	return result, nil
+}
+
+func rpcExecuteTextPaste(text string, layout string, delay int) error {
+	chars, err := textToKeyStrokes(text, layout)
+	if err != nil {
+		return err
+	}
+	pacing := defaultTextPasteDelay
+	if delay > 0 {
+		pacing = time.Duration(delay) * time.Millisecond
+	}
+
+	textPasteLock.Lock()
+	if textPasteState.Running {
+		textPasteLock.Unlock()
+		return errors.New("another paste is in progress")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	textPasteCancel = cancel
+	textPasteState = TextPasteState{
+		Running: true,
+		Layout:  layout,
+		Total:   len(chars),
+	}
+	textPasteLock.Unlock()
+	triggerTextPasteStateUpdate()
+
+	go runTextPaste(ctx, chars, pacing)
+	return nil
+}
+
+func runTextPaste(ctx context.Context, chars [][]keyStroke, pacing time.Duration) {
+	var pasteErr error
+	lastProgressTime := time.Now()
+	sent := 0
+typing:
+	for _, charStrokes := range chars {
+		for _, stroke := range charStrokes {
+			select {
+			case <-ctx.Done():
+				break typing
+			case <-time.After(pacing):
+			}
+			pasteErr = rpcKeyboardReport(stroke.Modifier, []uint8{stroke.Key})
+			if pasteErr != nil {
+				break typing
+			}
+			time.Sleep(pacing)
+			// always release so repeated characters register as separate presses
+			pasteErr = rpcKeyboardReport(0, []uint8{})
+			if pasteErr != nil {
+				break typing
+			}
+		}
+		sent++
+		if time.Since(lastProgressTime) >= 200*time.Millisecond {
+			textPasteLock.Lock()
+			textPasteState.Sent = sent
+			textPasteLock.Unlock()
+			triggerTextPasteStateUpdate()
+			lastProgressTime = time.Now()
+		}
+	}
+
+	textPasteLock.Lock()
+	textPasteState.Running = false
+	textPasteState.Sent = sent
+	textPasteState.Cancelled = ctx.Err() != nil
+	if pasteErr != nil {
+		logger.Warnf("text paste failed: %v", pasteErr)
+		textPasteState.Error = pasteErr.Error()
+		releaseStuckKeys("text paste failed")
+	}
+	textPasteCancel()
+	textPasteCancel = nil
+	textPasteLock.Unlock()
+	triggerTextPasteStateUpdate()
+}
+
+func rpcCancelTextPaste() error {
+	textPasteLock.Lock()
+	defer textPasteLock.Unlock()
+	if textPasteCancel == nil {
+		return errors.New("no paste in progress")
+	}
+	textPasteCancel()
+	return nil
+}
+
+func rpcGetTextPasteState() TextPasteState {
+	textPasteLock.Lock()
+	defer textPasteLock.Unlock()
+	return textPasteState
+}
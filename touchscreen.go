@@ -0,0 +1,183 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// contacts carried by a single touch report, hosts track more fingers by
+// receiving several reports
+const maxTouchContacts = 5
+
+// logical maximums of the contact identifier and the X/Y axes below
+const (
+	maxTouchContactID  = 0x7F
+	maxTouchCoordinate = 0x7FFF
+)
+
+// touchContactReportDesc describes one finger: tip switch, in range, contact
+// identifier and absolute X/Y in the same 0-32767 range as the mouse
+var touchContactReportDesc = []byte{
+	0x05, 0x0D, //     Usage Page (Digitizer)
+	0x09, 0x22, //     Usage (Finger)
+	0xA1, 0x02, //     Collection (Logical)
+	0x09, 0x42, //         Usage (Tip Switch)
+	0x09, 0x32, //         Usage (In Range)
+	0x15, 0x00, //         Logical Minimum (0)
+	0x25, 0x01, //         Logical Maximum (1)
+	0x75, 0x01, //         Report Size (1)
+	0x95, 0x02, //         Report Count (2)
+	0x81, 0x02, //         Input (Data, Var, Abs)
+	0x95, 0x06, //         Report Count (6)
+	0x81, 0x03, //         Input (Cnst, Var, Abs)
+	0x09, 0x51, //         Usage (Contact Identifier)
+	0x25, 0x7F, //         Logical Maximum (127)
+	0x75, 0x08, //         Report Size (8)
+	0x95, 0x01, //         Report Count (1)
+	0x81, 0x02, //         Input (Data, Var, Abs)
+	0x05, 0x01, //         Usage Page (Generic Desktop Ctrls)
+	0x09, 0x30, //         Usage (X)
+	0x09, 0x31, //         Usage (Y)
+	0x26, 0xFF, 0x7F, //         Logical Maximum (32767)
+	0x75, 0x10, //         Report Size (16)
+	0x95, 0x02, //         Report Count (2)
+	0x81, 0x02, //         Input (Data, Var, Abs)
+	0xC0, //     End Collection
+}
+
+// Multi-touch digitizer report descriptor with report ID. It has no Contact
+// Count Maximum feature report, the hid gadget can't answer GET_FEATURE
+// requests, hosts go by the contact count of each input report instead.
+var TouchscreenReportDesc = buildTouchscreenReportDesc()
+
+func buildTouchscreenReportDesc() []byte {
+	desc := []byte{
+		0x05, 0x0D, // Usage Page (Digitizer)
+		0x09, 0x04, // Usage (Touch Screen)
+		0xA1, 0x01, // Collection (Application)
+
+		// Report ID 1: Contacts
+		0x85, 0x01, //     Report ID (1)
+	}
+	for i := 0; i < maxTouchContacts; i++ {
+		desc = append(desc, touchContactReportDesc...)
+	}
+	return append(desc,
+		0x05, 0x0D, //     Usage Page (Digitizer)
+		0x09, 0x54, //     Usage (Contact Count)
+		0x25, 0x7F, //     Logical Maximum (127)
+		0x75, 0x08, //     Report Size (8)
+		0x95, 0x01, //     Report Count (1)
+		0x81, 0x02, //     Input (Data, Var, Abs)
+
+		0xC0, // End Collection
+	)
+}
+
+// report ID, 6 bytes per contact and the contact count
+const touchReportLength = 1 + 6*maxTouchContacts + 1
+
+type TouchContact struct {
+	ID       uint8 `json:"id"`
+	X        int   `json:"x"`
+	Y        int   `json:"y"`
+	Touching bool  `json:"touching"`
+}
+
+var touchscreenHidFile *os.File
+var touchscreenLock = sync.Mutex{}
+
+// activeTouchContacts are the contacts currently down on the host, kept so
+// they can be lifted when keys get released
+var activeTouchContacts = make(map[uint8]TouchContact)
+
+func rpcTouchReport(contacts []TouchContact) error {
+	if !currentUsbDevices().Touchscreen {
+		return errors.New("touchscreen is not enabled")
+	}
+	if len(contacts) > maxTouchContacts {
+		return fmt.Errorf("too many contacts in a single report: %d", len(contacts))
+	}
+	for _, contact := range contacts {
+		if contact.ID > maxTouchContactID {
+			return fmt.Errorf("invalid contact id: %d", contact.ID)
+		}
+		if contact.X < 0 || contact.X > maxTouchCoordinate || contact.Y < 0 || contact.Y > maxTouchCoordinate {
+			return fmt.Errorf("contact %d is out of range: %d,%d", contact.ID, contact.X, contact.Y)
+		}
+	}
+	touchscreenLock.Lock()
+	defer touchscreenLock.Unlock()
+	if touchscreenHidFile == nil {
+		var err error
+		touchscreenHidFile, err = openHidFile("hid.usb5")
+		if err != nil {
+			return err
+		}
+	}
+
+	report := make([]byte, touchReportLength)
+	report[0] = 1 // Report ID 1
+	for i, contact := range contacts {
+		offset := 1 + i*6
+		if contact.Touching {
+			report[offset] = 0x03 // Tip Switch, In Range
+		}
+		report[offset+1] = contact.ID
+		report[offset+2] = uint8(contact.X)
+		report[offset+3] = uint8(contact.X >> 8)
+		report[offset+4] = uint8(contact.Y)
+		report[offset+5] = uint8(contact.Y >> 8)
+	}
+	report[touchReportLength-1] = uint8(len(contacts))
+
+	resetUserInputTime()
+	_, err := touchscreenHidFile.Write(report)
+	if err != nil {
+		touchscreenHidFile.Close()
+		touchscreenHidFile = nil
+		return err
+	}
+	for _, contact := range contacts {
+		if contact.Touching {
+			activeTouchContacts[contact.ID] = contact
+		} else {
+			delete(activeTouchContacts, contact.ID)
+		}
+	}
+	setHidPressed(hidDeviceTouchscreen, len(activeTouchContacts) > 0)
+	return nil
+}
+
+// liftAllTouchContacts reports every active contact as lifted
+func liftAllTouchContacts() error {
+	touchscreenLock.Lock()
+	contacts := make([]TouchContact, 0, len(activeTouchContacts))
+	for _, contact := range activeTouchContacts {
+		contact.Touching = false
+		contacts = append(contacts, contact)
+	}
+	touchscreenLock.Unlock()
+	for len(contacts) > 0 {
+		n := min(len(contacts), maxTouchContacts)
+		if err := rpcTouchReport(contacts[:n]); err != nil {
+			return err
+		}
+		contacts = contacts[n:]
+	}
+	return nil
+}
+
+func rpcGetTouchscreenState() bool {
+	return currentUsbDevices().Touchscreen
+}
+
+// rpcSetTouchscreenState adds or removes the digitizer function, the host
+// enumerates the new set of interfaces
+func rpcSetTouchscreenState(enabled bool) error {
+	devices := currentUsbDevices()
+	devices.Touchscreen = enabled
+	return rpcSetUsbDevices(devices)
+}
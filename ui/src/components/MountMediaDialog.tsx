@@ -5,7 +5,8 @@ import LogoBlueIcon from "@/assets/logo-blue.svg";
 import LogoWhiteIcon from "@/assets/logo-white.svg";
 import Modal from "@components/Modal";
 import {
-  MountMediaState,
+  findLunMediaState,
+  MOUNT_MEDIA_LUN,
   RemoteVirtualMediaState,
   useMountMediaStore,
   useRTCStore,
@@ -70,12 +71,12 @@ export function Dialog({ setOpen }: { setOpen: (open: boolean) => void }) {
   const [send] = useJsonRpc();
   async function syncRemoteVirtualMediaState() {
     return new Promise((resolve, reject) => {
-      send("getVirtualMediaState", {}, resp => {
+      send("getVirtualMediaStates", {}, resp => {
         if ("error" in resp) {
           reject(new Error(resp.error.message));
         } else {
           setRemoteVirtualMediaState(
-            resp as unknown as MountMediaState["remoteVirtualMediaState"],
+            findLunMediaState(resp.result as unknown as RemoteVirtualMediaState[]),
           );
           resolve(null);
         }
@@ -92,8 +93,16 @@ export function Dialog({ setOpen }: { setOpen: (open: boolean) => void }) {
     console.log(`Mounting ${url} as ${mode}`);
 
     setMountInProgress(true);
-    send("mountWithHTTP", { url, mode }, async resp => {
+    send("mountWithHTTP", { url, mode, lun: MOUNT_MEDIA_LUN }, async resp => {
       if ("error" in resp) triggerError(resp.error.message);
+      // images that can't be read at random are stored first
+      const download =
+        "result" in resp ? (resp.result as { filename: string } | null) : null;
+      if (download) {
+        notifications.success(
+          `Downloading ${download.filename} into storage, it will be mounted once done`,
+        );
+      }
 
       clearMountMediaState();
       syncRemoteVirtualMediaState()
@@ -115,25 +124,29 @@ export function Dialog({ setOpen }: { setOpen: (open: boolean) => void }) {
     console.log(`Mounting ${fileName} as ${mode}`);
 
     setMountInProgress(true);
-    send("mountWithStorage", { filename: fileName, mode }, async resp => {
-      if ("error" in resp) triggerError(resp.error.message);
+    send(
+      "mountWithStorage",
+      { filename: fileName, mode, lun: MOUNT_MEDIA_LUN },
+      async resp => {
+        if ("error" in resp) triggerError(resp.error.message);
 
-      clearMountMediaState();
-      syncRemoteVirtualMediaState()
-        .then(() => {
-          setIsMountMediaDialogOpen(false);
-        })
-        .catch(err => {
-          triggerError(err instanceof Error ? err.message : String(err));
-        })
-        .finally(() => {
-          // We do this beacues the mounting is too fast and the UI gets choppy
-          // and the modal exit animation for like 500ms
-          setTimeout(() => {
-            setMountInProgress(false);
-          }, 500);
-        });
-    });
+        clearMountMediaState();
+        syncRemoteVirtualMediaState()
+          .then(() => {
+            setIsMountMediaDialogOpen(false);
+          })
+          .catch(err => {
+            triggerError(err instanceof Error ? err.message : String(err));
+          })
+          .finally(() => {
+            // We do this beacues the mounting is too fast and the UI gets choppy
+            // and the modal exit animation for like 500ms
+            setTimeout(() => {
+              setMountInProgress(false);
+            }, 500);
+          });
+      },
+    );
 
     clearMountMediaState();
   }
@@ -144,7 +157,7 @@ export function Dialog({ setOpen }: { setOpen: (open: boolean) => void }) {
     setMountInProgress(true);
     send(
       "mountWithWebRTC",
-      { filename: file.name, size: file.size, mode },
+      { filename: file.name, size: file.size, mode, lun: MOUNT_MEDIA_LUN },
       async resp => {
         if ("error" in resp) triggerError(resp.error.message);
 
@@ -673,6 +686,7 @@ function DeviceFileView({
       name: string;
       size: string;
       createdAt: string;
+      description: string;
     }[]
   >([]);
 
@@ -716,11 +730,17 @@ function DeviceFileView({
         return;
       }
       const { files } = res.result as StorageFiles;
-      const formattedFiles = files.map(file => ({
-        name: file.filename,
-        size: formatters.bytes(file.size),
-        createdAt: formatters.date(new Date(file?.createdAt)),
-      }));
+      // Folders can't be mounted, their files are listed with the folder in the name
+      const formattedFiles = files
+        .filter(file => !file.isDir)
+        .map(file => ({
+          name: file.filename,
+          size: formatters.bytes(file.size),
+          createdAt: formatters.date(new Date(file?.createdAt)),
+          description: [file.image?.volumeLabel, file.image?.bootable && "bootable"]
+            .filter(Boolean)
+            .join(", "),
+        }));
 
       setOnStorageFiles(formattedFiles);
     });
@@ -743,8 +763,15 @@ function DeviceFileView({
   interface StorageFiles {
     files: {
       filename: string;
+      isDir?: boolean;
       size: number;
       createdAt: string;
+      sha256?: string;
+      image?: {
+        type?: "iso9660" | "gpt" | "mbr" | "fat";
+        volumeLabel?: string;
+        bootable: boolean;
+      };
     }[];
   }
 
@@ -830,6 +857,7 @@ function DeviceFileView({
                   name={file.name}
                   size={file.size}
                   uploadedAt={file.createdAt}
+                  description={file.description}
                   isIncomplete={file.name.endsWith(".incomplete")}
                   isSelected={selected === file.name}
                   onDelete={() => {
@@ -1026,11 +1054,30 @@ function UploadFileView({
 
     rtcDataChannel.onmessage = e => {
       try {
-        const { AlreadyUploadedBytes, Size } = JSON.parse(e.data) as {
+        const { AlreadyUploadedBytes, Size, Completed, Error } = JSON.parse(
+          e.data,
+        ) as {
           AlreadyUploadedBytes: number;
           Size: number;
+          Completed: boolean;
+          Error: string;
         };
 
+        // The device reports the result once the file is verified and stored
+        if (Error) {
+          console.error("Upload error:", Error);
+          setUploadError(Error);
+          setUploadState("idle");
+          rtcDataChannel.close();
+          return;
+        }
+        if (Completed) {
+          setUploadProgress(100);
+          setUploadState("success");
+          rtcDataChannel.close();
+          return;
+        }
+
         const now = Date.now();
         const timeDiff = (now - lastUpdateTime) / 1000; // in seconds
         const bytesDiff = AlreadyUploadedBytes - lastUploadedBytes;
@@ -1065,11 +1112,8 @@ function UploadFileView({
 
       let offset = alreadyUploadedBytes;
       const sendNextChunk = () => {
-        if (offset >= file.size) {
-          rtcDataChannel.close();
-          setUploadState("success");
-          return;
-        }
+        // Wait for the device to report the result after the last chunk
+        if (offset >= file.size) return;
 
         if (pauseSending) return;
 
@@ -1152,8 +1196,14 @@ function UploadFileView({
       if (xhr.status === 200) {
         setUploadState("success");
       } else {
-        console.error("Upload error:", xhr.statusText);
-        setUploadError(xhr.statusText);
+        let message = xhr.statusText;
+        try {
+          message = (JSON.parse(xhr.responseText) as { error: string }).error || message;
+        } catch {
+          // Not a JSON response, keep the status text
+        }
+        console.error("Upload error:", message);
+        setUploadError(message);
         setUploadState("idle");
       }
     };
@@ -1336,7 +1386,7 @@ function UploadFileView({
           type="file"
           onChange={handleFileChange}
           className="hidden"
-          accept=".iso, .img"
+          accept=".iso, .img, .gz, .xz, .zst, .bz2"
         />
         {fileError && <p className="mt-2 text-sm text-red-600 dark:text-red-400">{fileError}</p>}
       </div>
@@ -1424,6 +1474,7 @@ function PreUploadedImageItem({
   name,
   size,
   uploadedAt,
+  description,
   isSelected,
   isIncomplete,
   onSelect,
@@ -1433,6 +1484,7 @@ function PreUploadedImageItem({
   name: string;
   size: string;
   uploadedAt: string;
+  description?: string;
   isSelected: boolean;
   isIncomplete: boolean;
   onSelect: () => void;
@@ -1464,6 +1516,9 @@ function PreUploadedImageItem({
           <div className="text-sm font-semibold leading-none dark:text-white">
             {formatters.truncateMiddle(name, 45)}
           </div>
+          {description && (
+            <div className="text-xs text-slate-600 dark:text-slate-400">{description}</div>
+          )}
           <div className="flex items-center text-sm">
             <div className="flex items-center gap-x-1 text-slate-600 dark:text-slate-400">
               {formatters.date(new Date(uploadedAt), { month: "short" })}
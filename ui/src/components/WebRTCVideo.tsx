@@ -126,20 +126,17 @@ export default function WebRTCVideo() {
       // Define a scaling factor to adjust scrolling sensitivity
       const scrollSensitivity = 0.8; // Adjust this value to change scroll speed
 
-      // Calculate the scroll value
-      const scroll = e.deltaY * scrollSensitivity;
+      // Calculate the scroll value, clamp it to a reasonable range (e.g., -15 to 15)
+      // and round it to the nearest integer
+      const scaleScroll = (delta: number) =>
+        Math.round(Math.max(-4, Math.min(4, delta * scrollSensitivity)));
 
-      // Clamp the scroll value to a reasonable range (e.g., -15 to 15)
-      const clampedScroll = Math.max(-4, Math.min(4, scroll));
+      // Invert the vertical scroll value to match expected behavior
+      const invertedScroll = -scaleScroll(e.deltaY);
+      const horizontalScroll = scaleScroll(e.deltaX);
 
-      // Round to the nearest integer
-      const roundedScroll = Math.round(clampedScroll);
-
-      // Invert the scroll value to match expected behavior
-      const invertedScroll = -roundedScroll;
-
-      console.log("wheelReport", { wheelY: invertedScroll });
-      send("wheelReport", { wheelY: invertedScroll });
+      console.log("wheelReport", { wheelY: invertedScroll, wheelX: horizontalScroll });
+      send("wheelReport", { wheelY: invertedScroll, wheelX: horizontalScroll });
 
       setBlockWheelEvent(true);
       setTimeout(() => setBlockWheelEvent(false), 50);
@@ -4,7 +4,13 @@ import Card, { GridCard } from "@components/Card";
 import { PlusCircleIcon } from "@heroicons/react/20/solid";
 import { useMemo, forwardRef, useEffect, useCallback } from "react";
 import { formatters } from "@/utils";
-import { RemoteVirtualMediaState, useMountMediaStore, useRTCStore } from "@/hooks/stores";
+import {
+  findLunMediaState,
+  MOUNT_MEDIA_LUN,
+  RemoteVirtualMediaState,
+  useMountMediaStore,
+  useRTCStore,
+} from "@/hooks/stores";
 import { SectionHeader } from "@components/SectionHeader";
 import {
   LuArrowUpFromLine,
@@ -50,19 +56,21 @@ const MountPopopover = forwardRef<HTMLDivElement, object>((_props, ref) => {
   }, [diskDataChannelStats]);
 
   const syncRemoteVirtualMediaState = useCallback(() => {
-    send("getVirtualMediaState", {}, response => {
+    send("getVirtualMediaStates", {}, response => {
       if ("error" in response) {
         notifications.error(
           `Failed to get virtual media state: ${response.error.message}`,
         );
       } else {
-        setRemoteVirtualMediaState(response.result as unknown as RemoteVirtualMediaState);
+        setRemoteVirtualMediaState(
+          findLunMediaState(response.result as unknown as RemoteVirtualMediaState[]),
+        );
       }
     });
   }, [send, setRemoteVirtualMediaState]);
 
   const handleUnmount = () => {
-    send("unmountImage", {}, response => {
+    send("unmountImage", { lun: MOUNT_MEDIA_LUN }, response => {
       if ("error" in response) {
         notifications.error(`Failed to unmount image: ${response.error.message}`);
       } else {
@@ -215,7 +223,11 @@ const MountPopopover = forwardRef<HTMLDivElement, object>((_props, ref) => {
                     <div className="text-white select-none dark:text-slate-300">
                       <span>Mounted as</span>{" "}
                       <span className="font-semibold">
-                        {remoteVirtualMediaState.mode === "Disk" ? "Disk" : "CD-ROM"}
+                        {remoteVirtualMediaState.mode === "Disk"
+                          ? "Disk"
+                          : remoteVirtualMediaState.mode === "WritableDisk"
+                            ? "Writable Disk"
+                            : "CD-ROM"}
                       </span>
                     </div>
 
@@ -296,12 +296,28 @@ export const useSettingsStore = create(
 );
 
 export interface RemoteVirtualMediaState {
+  lun: number;
   source: "WebRTC" | "HTTP" | "Storage" | null;
-  mode: "CDROM" | "Disk" | null;
+  mode: "CDROM" | "Disk" | "WritableDisk" | null;
   filename: string | null;
   url: string | null;
   path: string | null;
   size: number | null;
+  cache?: {
+    hits: number;
+    diskHits: number;
+    misses: number;
+    readahead: number;
+    requests: number;
+    fetchedBytes: number;
+  };
+}
+
+// The mount dialog manages the first LUN, the device can expose more
+export const MOUNT_MEDIA_LUN = 0;
+
+export function findLunMediaState(states: RemoteVirtualMediaState[] | null) {
+  return states?.find(state => state.lun === MOUNT_MEDIA_LUN) ?? null;
 }
 
 export interface MountMediaState {
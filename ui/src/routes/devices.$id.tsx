@@ -394,19 +394,29 @@ export default function KvmIdRoute() {
   const file = useMountMediaStore(state => state.localFile)!;
   useEffect(() => {
     if (!diskChannel || !file) return;
+    // Several reads can be outstanding, replies carry the request id
     diskChannel.onmessage = async e => {
-      console.log("Received", e.data);
       const data = JSON.parse(e.data);
-      const blob = file.slice(data.start, data.end);
-      const buf = await blob.arrayBuffer();
-      const header = new ArrayBuffer(16);
+      let buf = new ArrayBuffer(0);
+      let status = 0;
+      try {
+        buf = await file.slice(data.start, data.end).arrayBuffer();
+      } catch (error) {
+        console.error(`Failed to read ${data.start}-${data.end}: ${error}`);
+        status = 1;
+      }
+      const header = new ArrayBuffer(24);
       const headerView = new DataView(header);
-      headerView.setBigUint64(0, BigInt(data.start), false); // start offset, big-endian
-      headerView.setBigUint64(8, BigInt(buf.byteLength), false); // length, big-endian
+      headerView.setUint32(0, data.id, false); // request id, big-endian
+      headerView.setUint32(4, status, false); // 0 when the read succeeded
+      headerView.setBigUint64(8, BigInt(data.start), false); // start offset, big-endian
+      headerView.setBigUint64(16, BigInt(buf.byteLength), false); // length, big-endian
       const fullData = new Uint8Array(header.byteLength + buf.byteLength);
       fullData.set(new Uint8Array(header), 0);
       fullData.set(new Uint8Array(buf), header.byteLength);
-      diskChannel.send(fullData);
+      if (diskChannel.readyState === "open") {
+        diskChannel.send(fullData);
+      }
     };
   }, [diskChannel, file]);
 
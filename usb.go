@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -17,8 +16,6 @@ import (
 
 const configFSPath = "/sys/kernel/config"
 const gadgetPath = "/sys/kernel/config/usb_gadget"
-const kvmGadgetPath = "/sys/kernel/config/usb_gadget/jetkvm"
-const configC1Path = "/sys/kernel/config/usb_gadget/jetkvm/configs/c.1"
 
 func mountConfigFS() error {
 	_, err := os.Stat(gadgetPath)
@@ -41,21 +38,49 @@ func init() {
 		return
 	}
 	udc = udcs[0]
-	_, err := os.Stat(kvmGadgetPath)
-	if err == nil {
-		logger.Info("usb gadget already exists, skipping usb gadget initialization")
-		return
+	if _, err := os.Stat(gadgetPath); os.IsNotExist(err) {
+		err = mountConfigFS()
+		if err != nil {
+			logger.Errorf("failed to mount configfs: %v, usb stack might not function properly", err)
+		}
 	}
-	err = mountConfigFS()
+
+	// the enabled functions depend on the config, which isn't loaded yet at init
+	LoadConfig()
+
+	usbGadget = NewUsbGadget(configFSPath, "jetkvm", udc)
+	err := usbGadget.Configure(currentUsbIdentity(), currentUsbDevices())
 	if err != nil {
-		logger.Errorf("failed to mount configfs: %v, usb stack might not function properly", err)
+		logger.Errorf("failed to start gadget: %v", err)
 	}
-	err = writeGadgetConfig()
+	err = startUsbNetwork()
 	if err != nil {
-		logger.Errorf("failed to start gadget: %v", err)
+		logger.Errorf("failed to start usb network: %v", err)
 	}
 
-	//TODO: read hid reports(capslock, numlock, etc) from keyboardHidFile
+	go startKeyboardLedListener()
+}
+
+const (
+	// hidg0 shows up a moment after the gadget is bound
+	keyboardLedListenerAttempts = 30
+	keyboardLedListenerRetry    = 2 * time.Second
+)
+
+// startKeyboardLedListener opens the keyboard early so LED reports sent by
+// the host are picked up before the first key is typed
+func startKeyboardLedListener() {
+	var err error
+	for attempt := 1; attempt <= keyboardLedListenerAttempts; attempt++ {
+		keyboardLock.Lock()
+		err = openKeyboardHidFile()
+		keyboardLock.Unlock()
+		if err == nil {
+			return
+		}
+		time.Sleep(keyboardLedListenerRetry)
+	}
+	usbLogger.Warnf("failed to start keyboard LED listener: %v", err)
 }
 
 func writeGadgetAttrs(basePath string, attrs [][]string) error {
@@ -69,193 +94,248 @@ func writeGadgetAttrs(basePath string, attrs [][]string) error {
 	return nil
 }
 
-func writeGadgetConfig() error {
-	if _, err := os.Stat(gadgetPath); os.IsNotExist(err) {
-		return fmt.Errorf("USB gadget path does not exist: %s", gadgetPath)
+// closeHidFiles drops every open HID device, they are recreated along with
+// the gadget and get reopened on the next report
+func closeHidFiles() {
+	hidFiles := []struct {
+		file **os.File
+		lock *sync.Mutex
+	}{
+		{&keyboardHidFile, &keyboardLock},
+		{&nkroKeyboardHidFile, &keyboardLock},
+		{&mouseHidFile, &mouseLock},
+		{&relMouseHidFile, &relMouseLock},
+		{&consumerHidFile, &consumerLock},
+		{&touchscreenHidFile, &touchscreenLock},
+	}
+	for _, hidFile := range hidFiles {
+		hidFile.lock.Lock()
+		if *hidFile.file != nil {
+			(*hidFile.file).Close()
+			*hidFile.file = nil
+		}
+		hidFile.lock.Unlock()
 	}
+}
 
-	err := os.MkdirAll(kvmGadgetPath, 0755)
-	if err != nil {
-		return err
+// openHidFile opens the device node of a HID function, wherever the kernel
+// numbered it
+func openHidFile(instance string) (*os.File, error) {
+	if usbGadget == nil {
+		return nil, errors.New("usb gadget is not available")
 	}
+	return usbGadget.OpenHidDevice(instance)
+}
 
-	err = writeGadgetAttrs(kvmGadgetPath, [][]string{
-		{"bcdUSB", "0x0200"},   //USB 2.0
-		{"idVendor", "0x1d6b"}, //The Linux Foundation
-		{"idProduct", "0104"},  //Multifunction Composite Gadget¬
-		{"bcdDevice", "0100"},
-	})
+func rebindUsb() error {
+	err := os.WriteFile("/sys/bus/platform/drivers/dwc3/unbind", []byte(udc), 0644)
 	if err != nil {
 		return err
 	}
-
-	gadgetStringsPath := filepath.Join(kvmGadgetPath, "strings", "0x409")
-	err = os.MkdirAll(gadgetStringsPath, 0755)
+	err = os.WriteFile("/sys/bus/platform/drivers/dwc3/bind", []byte(udc), 0644)
 	if err != nil {
 		return err
 	}
+	return nil
+}
 
-	err = writeGadgetAttrs(gadgetStringsPath, [][]string{
-		{"serialnumber", GetDeviceID()},
-		{"manufacturer", "JetKVM"},
-		{"product", "JetKVM USB Emulation Device"},
-	})
-	if err != nil {
-		return err
-	}
+var keyboardHidFile *os.File
+var keyboardLock = sync.Mutex{}
+var mouseHidFile *os.File
+var mouseLock = sync.Mutex{}
+var lastAbsMouseX, lastAbsMouseY int
 
-	configC1StringsPath := path.Join(configC1Path, "strings", "0x409")
-	err = os.MkdirAll(configC1StringsPath, 0755)
-	if err != nil {
-		return err
+// openKeyboardHidFile must be called with keyboardLock held
+func openKeyboardHidFile() error {
+	if keyboardHidFile != nil {
+		return nil
 	}
-
-	err = writeGadgetAttrs(configC1Path, [][]string{
-		{"MaxPower", "250"}, //in unit of 2mA
-	})
+	var err error
+	keyboardHidFile, err = openHidFile("hid.usb0")
 	if err != nil {
 		return err
 	}
+	go listenKeyboardLedState(keyboardHidFile)
+	return nil
+}
 
-	err = writeGadgetAttrs(configC1StringsPath, [][]string{
-		{"configuration", "Config 1: HID"},
-	})
-	if err != nil {
-		return err
-	}
+type KeyboardLedState struct {
+	NumLock    bool `json:"numLock"`
+	CapsLock   bool `json:"capsLock"`
+	ScrollLock bool `json:"scrollLock"`
+	Compose    bool `json:"compose"`
+	Kana       bool `json:"kana"`
+}
 
-	//keyboard HID
-	hid0Path := path.Join(kvmGadgetPath, "functions", "hid.usb0")
-	err = os.MkdirAll(hid0Path, 0755)
-	if err != nil {
-		return err
-	}
-	err = writeGadgetAttrs(hid0Path, [][]string{
-		{"protocol", "1"},
-		{"subclass", "0"},
-		{"report_length", "8"},
-	})
-	if err != nil {
-		return err
-	}
+var keyboardLedState KeyboardLedState
+var keyboardLedStateLock = sync.Mutex{}
 
-	err = os.WriteFile(path.Join(hid0Path, "report_desc"), KeyboardReportDesc, 0644)
-	if err != nil {
-		return err
+// listenKeyboardLedState decodes the LED output reports the host writes to
+// the keyboard, it exits once the file gets closed
+func listenKeyboardLedState(file *os.File) {
+	buf := make([]byte, 8)
+	for {
+		n, err := file.Read(buf)
+		if err != nil {
+			usbLogger.Debugf("keyboard LED listener exited: %v", err)
+			return
+		}
+		if n < 1 {
+			continue
+		}
+		newState := KeyboardLedState{
+			NumLock:    buf[0]&0x01 != 0,
+			CapsLock:   buf[0]&0x02 != 0,
+			ScrollLock: buf[0]&0x04 != 0,
+			Compose:    buf[0]&0x08 != 0,
+			Kana:       buf[0]&0x10 != 0,
+		}
+		keyboardLedStateLock.Lock()
+		changed := newState != keyboardLedState
+		keyboardLedState = newState
+		keyboardLedStateLock.Unlock()
+		if changed {
+			usbLogger.Infof("keyboard LED state changed to %+v", newState)
+			triggerKeyboardLedStateUpdate()
+		}
 	}
+}
 
-	//mouse HID
-	hid1Path := path.Join(kvmGadgetPath, "functions", "hid.usb1")
-	err = os.MkdirAll(hid1Path, 0755)
-	if err != nil {
-		return err
+func triggerKeyboardLedStateUpdate() {
+	go func() {
+		if currentSession == nil {
+			return
+		}
+		writeJSONRPCEvent("keyboardLedState", rpcGetKeyboardLedState(), currentSession)
+	}()
+}
+
+func rpcGetKeyboardLedState() KeyboardLedState {
+	keyboardLedStateLock.Lock()
+	defer keyboardLedStateLock.Unlock()
+	return keyboardLedState
+}
+
+const (
+	KeyboardModeBoot = "boot"
+	KeyboardModeNKRO = "nkro"
+)
+
+// highest usage the boot keyboard descriptor declares
+const bootKeyboardMaxUsage = 0x65
+
+// highest usage covered by the NKRO bitmap, keeps International1-9 reachable
+const nkroMaxUsage = 0x9F
+
+var nkroKeyboardHidFile *os.File
+
+// openNkroKeyboardHidFile must be called with keyboardLock held
+func openNkroKeyboardHidFile() error {
+	if nkroKeyboardHidFile != nil {
+		return nil
 	}
-	err = writeGadgetAttrs(hid1Path, [][]string{
-		{"protocol", "2"},
-		{"subclass", "0"},
-		{"report_length", "6"},
-	})
+	var err error
+	nkroKeyboardHidFile, err = openHidFile("hid.usb4")
 	if err != nil {
 		return err
 	}
+	go listenKeyboardLedState(nkroKeyboardHidFile)
+	return nil
+}
 
-	err = os.WriteFile(path.Join(hid1Path, "report_desc"), CombinedMouseReportDesc, 0644)
-	if err != nil {
-		return err
+func rpcKeyboardReport(modifier uint8, keys []uint8) error {
+	keyboardLock.Lock()
+	defer keyboardLock.Unlock()
+	var err error
+	if config.KeyboardMode == KeyboardModeNKRO {
+		err = writeNkroKeyboardReport(modifier, keys)
+	} else {
+		err = writeBootKeyboardReport(modifier, keys)
 	}
-	//mass storage
-	massStoragePath := path.Join(kvmGadgetPath, "functions", "mass_storage.usb0")
-	err = os.MkdirAll(massStoragePath, 0755)
 	if err != nil {
 		return err
 	}
+	setHidPressed(hidDeviceKeyboard, anyKeyPressed(modifier, keys))
+	resetUserInputTime()
+	return nil
+}
 
-	err = writeGadgetAttrs(massStoragePath, [][]string{
-		{"stall", "1"},
-	})
+// writeNkroKeyboardReport must be called with keyboardLock held
+func writeNkroKeyboardReport(modifier uint8, keys []uint8) error {
+	err := openNkroKeyboardHidFile()
 	if err != nil {
 		return err
 	}
-	lun0Path := path.Join(massStoragePath, "lun.0")
-	err = os.MkdirAll(lun0Path, 0755)
-	if err != nil {
-		return err
+	report := make([]byte, 1+(nkroMaxUsage+1)/8)
+	report[0] = modifier
+	for _, key := range keys {
+		if key == 0 || key > nkroMaxUsage {
+			continue
+		}
+		report[1+key/8] |= 1 << (key % 8)
 	}
-	err = writeGadgetAttrs(lun0Path, [][]string{
-		{"cdrom", "1"},
-		{"ro", "1"},
-		{"removable", "1"},
-		{"file", "\n"},
-		{"inquiry_string", "JetKVM Virtual Media"},
-	})
+	_, err = nkroKeyboardHidFile.Write(report)
 	if err != nil {
+		nkroKeyboardHidFile.Close()
+		nkroKeyboardHidFile = nil
 		return err
 	}
+	return nil
+}
 
-	err = os.Symlink(hid0Path, path.Join(configC1Path, "hid.usb0"))
+// writeBootKeyboardReport must be called with keyboardLock held
+func writeBootKeyboardReport(modifier uint8, keys []uint8) error {
+	err := openKeyboardHidFile()
 	if err != nil {
 		return err
 	}
-
-	err = os.Symlink(hid1Path, path.Join(configC1Path, "hid.usb1"))
-	if err != nil {
-		return err
+	if len(keys) > 6 {
+		keys = keys[:6]
 	}
-
-	err = os.Symlink(massStoragePath, path.Join(configC1Path, "mass_storage.usb0"))
-	if err != nil {
-		return err
+	if len(keys) < 6 {
+		keys = append(keys, make([]uint8, 6-len(keys))...)
 	}
-
-	err = os.WriteFile(path.Join(kvmGadgetPath, "UDC"), []byte(udc), 0644)
+	_, err = keyboardHidFile.Write([]byte{modifier, 0, keys[0], keys[1], keys[2], keys[3], keys[4], keys[5]})
 	if err != nil {
+		keyboardHidFile.Close()
+		keyboardHidFile = nil
 		return err
 	}
-
 	return nil
 }
 
-func rebindUsb() error {
-	err := os.WriteFile("/sys/bus/platform/drivers/dwc3/unbind", []byte(udc), 0644)
-	if err != nil {
-		return err
+func rpcGetKeyboardMode() string {
+	if config.KeyboardMode == KeyboardModeNKRO {
+		return KeyboardModeNKRO
 	}
-	err = os.WriteFile("/sys/bus/platform/drivers/dwc3/bind", []byte(udc), 0644)
-	if err != nil {
-		return err
-	}
-	return nil
+	return KeyboardModeBoot
 }
 
-var keyboardHidFile *os.File
-var keyboardLock = sync.Mutex{}
-var mouseHidFile *os.File
-var mouseLock = sync.Mutex{}
-
-func rpcKeyboardReport(modifier uint8, keys []uint8) error {
+func rpcSetKeyboardMode(mode string) error {
+	if mode != KeyboardModeBoot && mode != KeyboardModeNKRO {
+		return fmt.Errorf("invalid keyboard mode: %s", mode)
+	}
 	keyboardLock.Lock()
 	defer keyboardLock.Unlock()
-	if keyboardHidFile == nil {
-		var err error
-		keyboardHidFile, err = os.OpenFile("/dev/hidg0", os.O_RDWR, 0666)
-		if err != nil {
-			return fmt.Errorf("failed to open hidg0: %w", err)
-		}
-	}
-	if len(keys) > 6 {
-		keys = keys[:6]
-	}
-	if len(keys) < 6 {
-		keys = append(keys, make([]uint8, 6-len(keys))...)
+	if rpcGetKeyboardMode() == mode {
+		return nil
+	}
+	// release everything on the keyboard we switch away from, otherwise keys
+	// held during the switch stay pressed on the host
+	var err error
+	if mode == KeyboardModeNKRO {
+		err = writeBootKeyboardReport(0, nil)
+	} else {
+		err = writeNkroKeyboardReport(0, nil)
 	}
-	_, err := keyboardHidFile.Write([]byte{modifier, 0, keys[0], keys[1], keys[2], keys[3], keys[4], keys[5]})
 	if err != nil {
-		keyboardHidFile.Close()
-		keyboardHidFile = nil
-		return err
+		usbLogger.Warnf("failed to release keys before switching keyboard mode: %v", err)
 	}
-	resetUserInputTime()
-	return err
+	config.KeyboardMode = mode
+	if err := SaveConfig(); err != nil {
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
 }
 
 func rpcAbsMouseReport(x, y int, buttons uint8) error {
@@ -263,9 +343,9 @@ func rpcAbsMouseReport(x, y int, buttons uint8) error {
 	defer mouseLock.Unlock()
 	if mouseHidFile == nil {
 		var err error
-		mouseHidFile, err = os.OpenFile("/dev/hidg1", os.O_RDWR, 0666)
+		mouseHidFile, err = openHidFile("hid.usb1")
 		if err != nil {
-			return fmt.Errorf("failed to open hidg1: %w", err)
+			return err
 		}
 	}
 	resetUserInputTime()
@@ -282,38 +362,150 @@ func rpcAbsMouseReport(x, y int, buttons uint8) error {
 		mouseHidFile = nil
 		return err
 	}
+	lastAbsMouseX, lastAbsMouseY = x, y
+	setHidPressed(hidDeviceAbsMouse, buttons != 0)
 	return nil
 }
 
-var accumulatedWheelY float64 = 0
+var relMouseHidFile *os.File
+var relMouseLock = sync.Mutex{}
 
-func rpcWheelReport(wheelY int8) error {
-	if mouseHidFile == nil {
-		return errors.New("hid not initialized")
+func rpcRelMouseReport(dx, dy int8, buttons uint8) error {
+	relMouseLock.Lock()
+	defer relMouseLock.Unlock()
+	if relMouseHidFile == nil {
+		var err error
+		relMouseHidFile, err = openHidFile("hid.usb2")
+		if err != nil {
+			return err
+		}
 	}
+	resetUserInputTime()
+	_, err := relMouseHidFile.Write([]byte{
+		buttons,  // Buttons
+		byte(dx), // X (signed)
+		byte(dy), // Y (signed)
+		0,        // Wheel (signed)
+		0,        // AC Pan (signed)
+	})
+	if err != nil {
+		relMouseHidFile.Close()
+		relMouseHidFile = nil
+		return err
+	}
+	setHidPressed(hidDeviceRelMouse, buttons != 0)
+	return nil
+}
 
-	// Accumulate the wheelY value
-	accumulatedWheelY += float64(wheelY) / 8.0
+var consumerHidFile *os.File
+var consumerLock = sync.Mutex{}
 
-	// Only send a report if the accumulated value is significant
-	if abs(accumulatedWheelY) >= 1.0 {
-		scaledWheelY := int8(accumulatedWheelY)
+func writeConsumerHidReport(report []byte) error {
+	consumerLock.Lock()
+	defer consumerLock.Unlock()
+	if consumerHidFile == nil {
+		var err error
+		consumerHidFile, err = openHidFile("hid.usb3")
+		if err != nil {
+			return err
+		}
+	}
+	resetUserInputTime()
+	_, err := consumerHidFile.Write(report)
+	if err != nil {
+		consumerHidFile.Close()
+		consumerHidFile = nil
+		return err
+	}
+	return nil
+}
 
-		_, err := mouseHidFile.Write([]byte{
-			2,                  // Report ID 2
-			byte(scaledWheelY), // Scaled Wheel Y (signed)
-		})
+// rpcConsumerReport presses a usage of the Consumer page (e.g. 0xE2 Mute,
+// 0xCD Play/Pause), usage 0 releases it
+func rpcConsumerReport(usage uint16) error {
+	if usage > 0x3FF {
+		return fmt.Errorf("consumer usage out of range: %#x", usage)
+	}
+	err := writeConsumerHidReport([]byte{
+		1,                 // Report ID 1
+		uint8(usage),      // Usage Low Byte
+		uint8(usage >> 8), // Usage High Byte
+	})
+	if err != nil {
+		return err
+	}
+	setHidPressed(hidDeviceConsumer, usage != 0)
+	return nil
+}
 
-		// Reset the accumulator, keeping any remainder
-		accumulatedWheelY -= float64(scaledWheelY)
+const (
+	SystemControlPowerDown = 0x81
+	SystemControlSleep     = 0x82
+	SystemControlWakeUp    = 0x83
+)
 
-		resetUserInputTime()
+// rpcSystemControlReport presses a Generic Desktop System Control usage
+// (0x81 Power Down, 0x82 Sleep, 0x83 Wake Up), usage 0 releases it
+func rpcSystemControlReport(usage uint8) error {
+	var buttons uint8
+	switch usage {
+	case 0:
+	case SystemControlPowerDown, SystemControlSleep, SystemControlWakeUp:
+		buttons = 1 << (usage - SystemControlPowerDown)
+	default:
+		return fmt.Errorf("unsupported system control usage: %#x", usage)
+	}
+	err := writeConsumerHidReport([]byte{
+		2,       // Report ID 2
+		buttons, // Power Down, Sleep, Wake Up bits
+		0,
+	})
+	if err != nil {
 		return err
 	}
-
+	setHidPressed(hidDeviceSystemControl, buttons != 0)
 	return nil
 }
 
+var accumulatedWheelY float64 = 0
+var accumulatedWheelX float64 = 0
+
+// accumulateWheel adds a scroll delta to the accumulator and returns the whole
+// steps ready to be sent, keeping any remainder for the next report
+func accumulateWheel(accumulated *float64, delta int8) int8 {
+	*accumulated += float64(delta) / 8.0
+	if abs(*accumulated) < 1.0 {
+		return 0
+	}
+	steps := int8(*accumulated)
+	*accumulated -= float64(steps)
+	return steps
+}
+
+func rpcWheelReport(wheelY int8, wheelX int8) error {
+	mouseLock.Lock()
+	defer mouseLock.Unlock()
+	if mouseHidFile == nil {
+		return errors.New("hid not initialized")
+	}
+
+	scaledWheelY := accumulateWheel(&accumulatedWheelY, wheelY)
+	scaledWheelX := accumulateWheel(&accumulatedWheelX, wheelX)
+
+	// Only send a report if the accumulated value is significant
+	if scaledWheelY == 0 && scaledWheelX == 0 {
+		return nil
+	}
+
+	_, err := mouseHidFile.Write([]byte{
+		2,                  // Report ID 2
+		byte(scaledWheelY), // Scaled Wheel Y (signed)
+		byte(scaledWheelX), // Scaled AC Pan (signed)
+	})
+	resetUserInputTime()
+	return err
+}
+
 // Helper function to get absolute value of float64
 func abs(x float64) float64 {
 	if x < 0 {
@@ -395,6 +587,40 @@ var KeyboardReportDesc = []byte{
 	0xc0, /* END_COLLECTION                         */
 }
 
+// N-key rollover keyboard with a modifier byte followed by a bitmap of usages
+// 0x00-0x9F, the boot keyboard on hidg0 stays available for BIOS
+var NkroKeyboardReportDesc = []byte{
+	0x05, 0x01, /* USAGE_PAGE (Generic Desktop)	          */
+	0x09, 0x06, /* USAGE (Keyboard)                       */
+	0xa1, 0x01, /* COLLECTION (Application)               */
+	0x05, 0x07, /*   USAGE_PAGE (Keyboard)                */
+	0x19, 0xe0, /*   USAGE_MINIMUM (Keyboard LeftControl) */
+	0x29, 0xe7, /*   USAGE_MAXIMUM (Keyboard Right GUI)   */
+	0x15, 0x00, /*   LOGICAL_MINIMUM (0)                  */
+	0x25, 0x01, /*   LOGICAL_MAXIMUM (1)                  */
+	0x75, 0x01, /*   REPORT_SIZE (1)                      */
+	0x95, 0x08, /*   REPORT_COUNT (8)                     */
+	0x81, 0x02, /*   INPUT (Data,Var,Abs)                 */
+	0x95, 0x05, /*   REPORT_COUNT (5)                     */
+	0x75, 0x01, /*   REPORT_SIZE (1)                      */
+	0x05, 0x08, /*   USAGE_PAGE (LEDs)                    */
+	0x19, 0x01, /*   USAGE_MINIMUM (Num Lock)             */
+	0x29, 0x05, /*   USAGE_MAXIMUM (Kana)                 */
+	0x91, 0x02, /*   OUTPUT (Data,Var,Abs)                */
+	0x95, 0x01, /*   REPORT_COUNT (1)                     */
+	0x75, 0x03, /*   REPORT_SIZE (3)                      */
+	0x91, 0x03, /*   OUTPUT (Cnst,Var,Abs)                */
+	0x05, 0x07, /*   USAGE_PAGE (Keyboard)                */
+	0x19, 0x00, /*   USAGE_MINIMUM (Reserved)             */
+	0x29, 0x9f, /*   USAGE_MAXIMUM (0x9F)                 */
+	0x15, 0x00, /*   LOGICAL_MINIMUM (0)                  */
+	0x25, 0x01, /*   LOGICAL_MAXIMUM (1)                  */
+	0x75, 0x01, /*   REPORT_SIZE (1)                      */
+	0x96, 0xa0, 0x00, /*   REPORT_COUNT (160)             */
+	0x81, 0x02, /*   INPUT (Data,Var,Abs)                 */
+	0xc0, /* END_COLLECTION                         */
+}
+
 // Combined absolute and relative mouse report descriptor with report ID
 var CombinedMouseReportDesc = []byte{
 	0x05, 0x01, // Usage Page (Generic Desktop Ctrls)
@@ -407,14 +633,14 @@ var CombinedMouseReportDesc = []byte{
 	0xA1, 0x00, //     Collection (Physical)
 	0x05, 0x09, //         Usage Page (Button)
 	0x19, 0x01, //         Usage Minimum (0x01)
-	0x29, 0x03, //         Usage Maximum (0x03)
+	0x29, 0x05, //         Usage Maximum (0x05)
 	0x15, 0x00, //         Logical Minimum (0)
 	0x25, 0x01, //         Logical Maximum (1)
 	0x75, 0x01, //         Report Size (1)
-	0x95, 0x03, //         Report Count (3)
+	0x95, 0x05, //         Report Count (5)
 	0x81, 0x02, //         Input (Data, Var, Abs)
 	0x95, 0x01, //         Report Count (1)
-	0x75, 0x05, //         Report Size (5)
+	0x75, 0x03, //         Report Size (3)
 	0x81, 0x03, //         Input (Cnst, Var, Abs)
 	0x05, 0x01, //         Usage Page (Generic Desktop Ctrls)
 	0x09, 0x30, //         Usage (X)
@@ -436,6 +662,82 @@ var CombinedMouseReportDesc = []byte{
 	0x75, 0x08, //     Report Size (8)
 	0x95, 0x01, //     Report Count (1)
 	0x81, 0x06, //     Input (Data, Var, Rel)
+	0x05, 0x0C, //     Usage Page (Consumer)
+	0x0A, 0x38, 0x02, //     Usage (AC Pan)
+	0x15, 0x81, //     Logical Minimum (-127)
+	0x25, 0x7F, //     Logical Maximum (127)
+	0x75, 0x08, //     Report Size (8)
+	0x95, 0x01, //     Report Count (1)
+	0x81, 0x06, //     Input (Data, Var, Rel)
 
 	0xC0, // End Collection
 }
+
+// Relative mouse report descriptor without report ID, so the first three bytes
+// stay compatible with the boot protocol mouse report
+var RelativeMouseReportDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop Ctrls)
+	0x09, 0x02, // Usage (Mouse)
+	0xA1, 0x01, // Collection (Application)
+	0x09, 0x01, //     Usage (Pointer)
+	0xA1, 0x00, //     Collection (Physical)
+	0x05, 0x09, //         Usage Page (Button)
+	0x19, 0x01, //         Usage Minimum (0x01)
+	0x29, 0x05, //         Usage Maximum (0x05)
+	0x15, 0x00, //         Logical Minimum (0)
+	0x25, 0x01, //         Logical Maximum (1)
+	0x75, 0x01, //         Report Size (1)
+	0x95, 0x05, //         Report Count (5)
+	0x81, 0x02, //         Input (Data, Var, Abs)
+	0x95, 0x01, //         Report Count (1)
+	0x75, 0x03, //         Report Size (3)
+	0x81, 0x03, //         Input (Cnst, Var, Abs)
+	0x05, 0x01, //         Usage Page (Generic Desktop Ctrls)
+	0x09, 0x30, //         Usage (X)
+	0x09, 0x31, //         Usage (Y)
+	0x09, 0x38, //         Usage (Wheel)
+	0x15, 0x81, //         Logical Minimum (-127)
+	0x25, 0x7F, //         Logical Maximum (127)
+	0x75, 0x08, //         Report Size (8)
+	0x95, 0x03, //         Report Count (3)
+	0x81, 0x06, //         Input (Data, Var, Rel)
+	0x05, 0x0C, //         Usage Page (Consumer)
+	0x0A, 0x38, 0x02, //         Usage (AC Pan)
+	0x95, 0x01, //         Report Count (1)
+	0x81, 0x06, //         Input (Data, Var, Rel)
+	0xC0, //     End Collection
+	0xC0, // End Collection
+}
+
+// Consumer page and system control report descriptor with report ID
+var ConsumerSystemControlReportDesc = []byte{
+	// Report ID 1: Consumer Control
+	0x05, 0x0C, // Usage Page (Consumer)
+	0x09, 0x01, // Usage (Consumer Control)
+	0xA1, 0x01, // Collection (Application)
+	0x85, 0x01, //     Report ID (1)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x26, 0xFF, 0x03, //     Logical Maximum (1023)
+	0x19, 0x00, //     Usage Minimum (0)
+	0x2A, 0xFF, 0x03, //     Usage Maximum (1023)
+	0x75, 0x10, //     Report Size (16)
+	0x95, 0x01, //     Report Count (1)
+	0x81, 0x00, //     Input (Data, Array, Abs)
+	0xC0, // End Collection
+
+	// Report ID 2: System Control
+	0x05, 0x01, // Usage Page (Generic Desktop Ctrls)
+	0x09, 0x80, // Usage (Sys Control)
+	0xA1, 0x01, // Collection (Application)
+	0x85, 0x02, //     Report ID (2)
+	0x19, 0x81, //     Usage Minimum (Sys Power Down)
+	0x29, 0x83, //     Usage Maximum (Sys Wake Up)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x25, 0x01, //     Logical Maximum (1)
+	0x75, 0x01, //     Report Size (1)
+	0x95, 0x03, //     Report Count (3)
+	0x81, 0x02, //     Input (Data, Var, Abs)
+	0x95, 0x0D, //     Report Count (13)
+	0x81, 0x03, //     Input (Cnst, Var, Abs)
+	0xC0, // End Collection
+}
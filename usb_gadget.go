@@ -0,0 +1,651 @@
+package kvm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// UsbDevices is the declarative set of functions exposed to the host
+type UsbDevices struct {
+	Keyboard        bool `json:"keyboard"`
+	Mouse           bool `json:"mouse"`
+	ConsumerControl bool `json:"consumerControl"`
+	Touchscreen     bool `json:"touchscreen"`
+	MassStorage     bool `json:"massStorage"`
+	Serial          bool `json:"serial"`
+	Network         bool `json:"network"`
+}
+
+var defaultUsbDevices = UsbDevices{
+	Keyboard:        true,
+	Mouse:           true,
+	ConsumerControl: true,
+	MassStorage:     true,
+}
+
+func currentUsbDevices() UsbDevices {
+	if config == nil || config.UsbDevices == nil {
+		return defaultUsbDevices
+	}
+	return *config.UsbDevices
+}
+
+type gadgetFunction struct {
+	instance   string
+	enabled    func(devices *UsbDevices) bool
+	attrs      [][]string
+	attrsFunc  func() [][]string // attributes computed when the function is created
+	reportDesc []byte
+	// children holds the attributes of sub directories, like mass storage LUNs
+	children map[string][][]string
+}
+
+// gadgetFunctions are linked into the configuration in this order, which is
+// also the order of the interfaces the host sees
+var gadgetFunctions = []gadgetFunction{
+	{
+		instance: "hid.usb0", // boot keyboard
+		enabled:  func(d *UsbDevices) bool { return d.Keyboard },
+		attrs: [][]string{
+			{"protocol", "1"},
+			{"subclass", "0"},
+			{"report_length", "8"},
+		},
+		reportDesc: KeyboardReportDesc,
+	},
+	{
+		instance: "hid.usb1", // absolute mouse
+		enabled:  func(d *UsbDevices) bool { return d.Mouse },
+		attrs: [][]string{
+			{"protocol", "2"},
+			{"subclass", "0"},
+			{"report_length", "6"},
+		},
+		reportDesc: CombinedMouseReportDesc,
+	},
+	{
+		instance: "hid.usb2", // relative mouse
+		enabled:  func(d *UsbDevices) bool { return d.Mouse },
+		attrs: [][]string{
+			{"protocol", "2"},
+			{"subclass", "1"}, //boot interface, so BIOS setup screens can use it
+			{"report_length", "5"},
+		},
+		reportDesc: RelativeMouseReportDesc,
+	},
+	{
+		instance: "hid.usb3", // consumer and system control
+		enabled:  func(d *UsbDevices) bool { return d.ConsumerControl },
+		attrs: [][]string{
+			{"protocol", "0"},
+			{"subclass", "0"},
+			{"report_length", "3"},
+		},
+		reportDesc: ConsumerSystemControlReportDesc,
+	},
+	{
+		instance: "hid.usb4", // n-key rollover keyboard
+		enabled:  func(d *UsbDevices) bool { return d.Keyboard },
+		attrs: [][]string{
+			{"protocol", "1"},
+			{"subclass", "0"},
+			{"report_length", "21"},
+		},
+		reportDesc: NkroKeyboardReportDesc,
+	},
+	{
+		instance: "hid.usb5", // multi-touch digitizer
+		enabled:  func(d *UsbDevices) bool { return d.Touchscreen },
+		attrs: [][]string{
+			{"protocol", "0"},
+			{"subclass", "0"},
+			{"report_length", strconv.Itoa(touchReportLength)},
+		},
+		reportDesc: TouchscreenReportDesc,
+	},
+	{
+		instance: "mass_storage.usb0",
+		enabled:  func(d *UsbDevices) bool { return d.MassStorage },
+		attrs: [][]string{
+			{"stall", "1"},
+		},
+		children: massStorageLunAttrs(),
+	},
+	{
+		instance: "acm.usb0", // serial console
+		enabled:  func(d *UsbDevices) bool { return d.Serial },
+	},
+	{
+		instance: "ecm.usb0", // ethernet
+		enabled: func(d *UsbDevices) bool {
+			return d.Network && currentUsbNetworkConfig().Protocol != UsbNetworkProtocolNCM
+		},
+		attrsFunc: usbNetworkAttrs,
+	},
+	{
+		instance: "ncm.usb0", // ethernet with packet aggregation, faster on hosts that support it
+		enabled: func(d *UsbDevices) bool {
+			return d.Network && currentUsbNetworkConfig().Protocol == UsbNetworkProtocolNCM
+		},
+		attrsFunc: usbNetworkAttrs,
+	},
+}
+
+// massStorageLunAttrs lun.0 comes with the function, the other LUNs are
+// created next to it
+func massStorageLunAttrs() map[string][][]string {
+	luns := make(map[string][][]string)
+	for lun := 0; lun < massStorageLunCount; lun++ {
+		luns[fmt.Sprintf("lun.%d", lun)] = [][]string{
+			{"cdrom", "1"},
+			{"ro", "1"},
+			{"removable", "1"},
+			{"file", "\n"},
+		}
+	}
+	return luns
+}
+
+// UsbGadget manages a configfs USB gadget, the configfs root is configurable
+// so it can run against a plain directory
+type UsbGadget struct {
+	configfsPath string
+	name         string
+	udc          string
+	functions    []gadgetFunction
+	lock         sync.Mutex
+	// hidLock is held for writing while the functions are rebuilt, HID
+	// devices can't be opened then
+	hidLock sync.RWMutex
+}
+
+func NewUsbGadget(configfsPath string, name string, udc string) *UsbGadget {
+	return &UsbGadget{
+		configfsPath: configfsPath,
+		name:         name,
+		udc:          udc,
+		functions:    gadgetFunctions,
+	}
+}
+
+func (g *UsbGadget) gadgetPath() string {
+	return path.Join(g.configfsPath, "usb_gadget", g.name)
+}
+
+func (g *UsbGadget) configPath() string {
+	return path.Join(g.gadgetPath(), "configs", "c.1")
+}
+
+func (g *UsbGadget) functionPath(instance string) string {
+	return path.Join(g.gadgetPath(), "functions", instance)
+}
+
+func readGadgetAttr(filePath string) string {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// sameGadgetNumber compares numeric attributes the way configfs parses them,
+// it reads back 0x1d6b for a written 0x1D6B
+func sameGadgetNumber(a string, b string) bool {
+	x, errA := strconv.ParseUint(a, 0, 16)
+	y, errB := strconv.ParseUint(b, 0, 16)
+	return errA == nil && errB == nil && x == y
+}
+
+// linkedFunctions returns the function instances linked into the configuration
+func (g *UsbGadget) linkedFunctions() ([]string, error) {
+	entries, err := os.ReadDir(g.configPath())
+	if err != nil {
+		return nil, err
+	}
+	linked := make([]string, 0)
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink != 0 {
+			linked = append(linked, entry.Name())
+		}
+	}
+	return linked, nil
+}
+
+func (g *UsbGadget) enabledFunctions(devices UsbDevices) []gadgetFunction {
+	enabled := make([]gadgetFunction, 0, len(g.functions))
+	for _, function := range g.functions {
+		if function.enabled(&devices) {
+			enabled = append(enabled, function)
+		}
+	}
+	return enabled
+}
+
+// isConfigured reports whether the bound gadget already matches, so an app
+// restart doesn't make the host re-enumerate the device
+func (g *UsbGadget) isConfigured(identity UsbIdentityProfile, devices UsbDevices) bool {
+	gadgetPath := g.gadgetPath()
+	if readGadgetAttr(path.Join(gadgetPath, "UDC")) != g.udc {
+		return false
+	}
+	if !sameGadgetNumber(readGadgetAttr(path.Join(gadgetPath, "idVendor")), identity.VendorId) ||
+		!sameGadgetNumber(readGadgetAttr(path.Join(gadgetPath, "idProduct")), identity.ProductId) ||
+		!sameGadgetNumber(readGadgetAttr(path.Join(gadgetPath, "bcdDevice")), identity.DeviceVersion) {
+		return false
+	}
+	stringsPath := path.Join(gadgetPath, "strings", "0x409")
+	if readGadgetAttr(path.Join(stringsPath, "serialnumber")) != identity.SerialNumber ||
+		readGadgetAttr(path.Join(stringsPath, "manufacturer")) != identity.Manufacturer ||
+		readGadgetAttr(path.Join(stringsPath, "product")) != identity.Product {
+		return false
+	}
+
+	linked, err := g.linkedFunctions()
+	if err != nil {
+		return false
+	}
+	enabled := g.enabledFunctions(devices)
+	if len(linked) != len(enabled) {
+		return false
+	}
+	linkedSet := make(map[string]bool)
+	for _, instance := range linked {
+		linkedSet[instance] = true
+	}
+	for _, function := range enabled {
+		if !linkedSet[function.instance] || !g.functionMatches(function) {
+			return false
+		}
+		for child := range function.children {
+			childPath := path.Join(g.functionPath(function.instance), child)
+			if _, err := os.Stat(childPath); err != nil {
+				return false
+			}
+			// the inquiry string is part of the identity, not of the function
+			if function.instance == massStorageName &&
+				readGadgetAttr(path.Join(childPath, "inquiry_string")) != strings.TrimSpace(identity.InquiryString) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// functionMatches reports whether the attributes and the report descriptor of
+// an existing function are the ones it would be created with
+func (g *UsbGadget) functionMatches(function gadgetFunction) bool {
+	functionPath := g.functionPath(function.instance)
+	for _, attr := range function.attrs {
+		if readGadgetAttr(path.Join(functionPath, attr[0])) != attr[1] {
+			return false
+		}
+	}
+	if function.reportDesc != nil {
+		reportDesc, err := os.ReadFile(path.Join(functionPath, "report_desc"))
+		if err != nil || !bytes.Equal(reportDesc, function.reportDesc) {
+			return false
+		}
+	}
+	return true
+}
+
+// Configure brings the gadget in line with the identity and the enabled
+// devices. The UDC is unbound while functions are added or removed and bound
+// again afterwards, which the host sees as an unplug and replug.
+func (g *UsbGadget) Configure(identity UsbIdentityProfile, devices UsbDevices) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if g.isConfigured(identity, devices) {
+		usbLogger.Info("usb gadget is already configured")
+		return nil
+	}
+
+	gadgetPath := g.gadgetPath()
+	if _, err := os.Stat(path.Dir(gadgetPath)); os.IsNotExist(err) {
+		return fmt.Errorf("USB gadget path does not exist: %s", path.Dir(gadgetPath))
+	}
+	err := os.MkdirAll(gadgetPath, 0755)
+	if err != nil {
+		return err
+	}
+
+	if readGadgetAttr(path.Join(gadgetPath, "UDC")) != "" {
+		err = g.unbind()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = g.writeIdentity(identity)
+	if err != nil {
+		return err
+	}
+
+	err = g.syncFunctions(identity, devices)
+	if err != nil {
+		return err
+	}
+
+	return g.bind()
+}
+
+func (g *UsbGadget) bind() error {
+	err := os.WriteFile(path.Join(g.gadgetPath(), "UDC"), []byte(g.udc), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to bind gadget to %s: %w", g.udc, err)
+	}
+	return nil
+}
+
+func (g *UsbGadget) unbind() error {
+	err := os.WriteFile(path.Join(g.gadgetPath(), "UDC"), []byte("\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to unbind gadget: %w", err)
+	}
+	return nil
+}
+
+func (g *UsbGadget) writeIdentity(identity UsbIdentityProfile) error {
+	gadgetPath := g.gadgetPath()
+	err := writeGadgetAttrs(gadgetPath, [][]string{
+		{"bcdUSB", "0x0200"}, //USB 2.0
+		{"idVendor", identity.VendorId},
+		{"idProduct", identity.ProductId},
+		{"bcdDevice", identity.DeviceVersion},
+	})
+	if err != nil {
+		return err
+	}
+
+	gadgetStringsPath := path.Join(gadgetPath, "strings", "0x409")
+	err = os.MkdirAll(gadgetStringsPath, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = writeGadgetAttrs(gadgetStringsPath, [][]string{
+		{"serialnumber", identity.SerialNumber},
+		{"manufacturer", identity.Manufacturer},
+		{"product", identity.Product},
+	})
+	if err != nil {
+		return err
+	}
+
+	configStringsPath := path.Join(g.configPath(), "strings", "0x409")
+	err = os.MkdirAll(configStringsPath, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = writeGadgetAttrs(g.configPath(), [][]string{
+		{"MaxPower", "250"}, //in unit of 2mA
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeGadgetAttrs(configStringsPath, [][]string{
+		{"configuration", "Config 1: HID"},
+	})
+}
+
+// syncFunctions must be called with the gadget unbound. All links are
+// recreated so the interface order stays stable when functions come and go.
+func (g *UsbGadget) syncFunctions(identity UsbIdentityProfile, devices UsbDevices) error {
+	linked, err := g.linkedFunctions()
+	if err != nil {
+		return err
+	}
+	for _, instance := range linked {
+		err = os.Remove(path.Join(g.configPath(), instance))
+		if err != nil {
+			return fmt.Errorf("failed to unlink %s: %w", instance, err)
+		}
+	}
+
+	for _, function := range g.functions {
+		functionPath := g.functionPath(function.instance)
+		if !function.enabled(&devices) {
+			err = g.removeFunction(function)
+			if err != nil {
+				return fmt.Errorf("failed to remove %s: %w", function.instance, err)
+			}
+			continue
+		}
+
+		if _, err := os.Stat(functionPath); os.IsNotExist(err) {
+			err = g.createFunction(function)
+			if err != nil {
+				return fmt.Errorf("failed to create %s: %w", function.instance, err)
+			}
+		} else {
+			// a newer version may come with other descriptors
+			err = g.writeFunctionAttrs(function)
+			if err == nil {
+				err = g.createChildren(function, true)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to update %s: %w", function.instance, err)
+			}
+		}
+
+		if function.instance == massStorageName {
+			for lun := range function.children {
+				err = writeGadgetAttrs(path.Join(functionPath, lun), [][]string{
+					{"inquiry_string", identity.InquiryString},
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err = os.Symlink(functionPath, path.Join(g.configPath(), function.instance))
+		if err != nil {
+			return fmt.Errorf("failed to link %s: %w", function.instance, err)
+		}
+	}
+	return nil
+}
+
+// removeFunction removes the sub directories of a function before the
+// function itself, configfs doesn't remove directories recursively
+func (g *UsbGadget) removeFunction(function gadgetFunction) error {
+	functionPath := g.functionPath(function.instance)
+	if _, err := os.Stat(functionPath); os.IsNotExist(err) {
+		return nil
+	}
+	for child := range function.children {
+		err := removeGadgetDir(path.Join(functionPath, child))
+		// lun.0 is created by the kernel and only goes with the function
+		if err != nil && !os.IsNotExist(err) && child != "lun.0" {
+			return err
+		}
+	}
+	return removeGadgetDir(functionPath)
+}
+
+// removeGadgetDir removes a configfs directory without sub directories.
+// configfs drops the attributes along with it, removing them first only
+// matters on a plain directory.
+func removeGadgetDir(dirPath string) error {
+	err := os.Remove(dirPath)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	entries, readErr := os.ReadDir(dirPath)
+	if readErr != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			os.Remove(path.Join(dirPath, entry.Name()))
+		}
+	}
+	return os.Remove(dirPath)
+}
+
+func (g *UsbGadget) createFunction(function gadgetFunction) error {
+	functionPath := g.functionPath(function.instance)
+	err := os.MkdirAll(functionPath, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = g.writeFunctionAttrs(function)
+	if err != nil {
+		return err
+	}
+
+	if function.attrsFunc != nil {
+		err = writeGadgetAttrs(functionPath, function.attrsFunc())
+		if err != nil {
+			return err
+		}
+	}
+
+	return g.createChildren(function, false)
+}
+
+// writeFunctionAttrs writes the fixed attributes and the report descriptor,
+// configfs only takes them while the function isn't linked
+func (g *UsbGadget) writeFunctionAttrs(function gadgetFunction) error {
+	functionPath := g.functionPath(function.instance)
+	err := writeGadgetAttrs(functionPath, function.attrs)
+	if err != nil {
+		return err
+	}
+	if function.reportDesc != nil {
+		err = os.WriteFile(path.Join(functionPath, "report_desc"), function.reportDesc, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createChildren sets up the sub directories of a function. With onlyMissing
+// set, existing ones are left alone, which covers functions created by an
+// older version with fewer of them.
+func (g *UsbGadget) createChildren(function gadgetFunction, onlyMissing bool) error {
+	for child, attrs := range function.children {
+		childPath := path.Join(g.functionPath(function.instance), child)
+		if _, err := os.Stat(childPath); err == nil && onlyMissing {
+			continue
+		}
+		err := os.MkdirAll(childPath, 0755)
+		if err != nil {
+			return err
+		}
+		err = writeGadgetAttrs(childPath, attrs)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenHidDevice opens the device node of a HID function. It fails instead of
+// waiting while the gadget is rebuilt, callers hold their device lock, which
+// the rebuild takes to close the devices.
+func (g *UsbGadget) OpenHidDevice(instance string) (*os.File, error) {
+	if !g.hidLock.TryRLock() {
+		return nil, errors.New("usb gadget is being reconfigured")
+	}
+	defer g.hidLock.RUnlock()
+	devicePath, err := g.HidDevicePath(instance)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(devicePath, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", devicePath, err)
+	}
+	return file, nil
+}
+
+// HidDevicePath resolves the /dev/hidgN node of a HID function, the number
+// depends on which functions were created before it
+func (g *UsbGadget) HidDevicePath(instance string) (string, error) {
+	data, err := os.ReadFile(path.Join(g.functionPath(instance), "dev"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%s is not enabled", instance)
+		}
+		return "", err
+	}
+	_, minor, found := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !found {
+		return "", fmt.Errorf("unexpected device number for %s: %s", instance, data)
+	}
+	return "/dev/hidg" + minor, nil
+}
+
+var usbGadget *UsbGadget
+
+// applyUsbGadgetConfig reconfigures the gadget from the current config
+func applyUsbGadgetConfig() error {
+	if usbGadget == nil {
+		return fmt.Errorf("usb gadget is not available")
+	}
+	err := releaseAllKeys()
+	if err != nil {
+		usbLogger.Warnf("failed to release keys before reconfiguring gadget: %v", err)
+	}
+	// nothing may reopen the HID devices until the gadget is rebuilt
+	usbGadget.hidLock.Lock()
+	closeHidFiles()
+	stopUsbNetwork()
+	err = usbGadget.Configure(currentUsbIdentity(), currentUsbDevices())
+	usbGadget.hidLock.Unlock()
+	if err != nil {
+		return err
+	}
+	go startKeyboardLedListener()
+	return startUsbNetwork()
+}
+
+func rpcGetUsbDevices() UsbDevices {
+	return currentUsbDevices()
+}
+
+func rpcSetUsbDevices(devices UsbDevices) error {
+	previous := currentUsbDevices()
+	if devices == previous {
+		return nil
+	}
+	if devices == (UsbDevices{}) {
+		return fmt.Errorf("at least one usb device must be enabled")
+	}
+	if previous.MassStorage && !devices.MassStorage {
+		if isVirtualMediaMounted() {
+			return fmt.Errorf("unmount the virtual media before disabling mass storage")
+		}
+	}
+	if previous.Touchscreen && !devices.Touchscreen {
+		err := liftAllTouchContacts()
+		if err != nil {
+			usbLogger.Warnf("failed to lift touch contacts: %v", err)
+		}
+	}
+
+	config.UsbDevices = &devices
+	err := applyUsbGadgetConfig()
+	if err != nil {
+		config.UsbDevices = &previous
+		if restoreErr := applyUsbGadgetConfig(); restoreErr != nil {
+			usbLogger.Errorf("failed to restore usb devices: %v", restoreErr)
+		}
+		return fmt.Errorf("failed to apply usb devices: %w", err)
+	}
+	logger.Infof("usb devices changed to %+v", devices)
+	return SaveConfig()
+}
@@ -0,0 +1,247 @@
+package kvm
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"testing"
+)
+
+const testUdc = "fe980000.usb"
+
+func newTestUsbGadget(t *testing.T) *UsbGadget {
+	t.Helper()
+	configfsPath := t.TempDir()
+	if err := os.MkdirAll(path.Join(configfsPath, "usb_gadget"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return NewUsbGadget(configfsPath, "jetkvm", testUdc)
+}
+
+func testUsbIdentity() UsbIdentityProfile {
+	identity := defaultUsbIdentityProfile
+	identity.SerialNumber = "test-serial"
+	return identity
+}
+
+func assertLinkedFunctions(t *testing.T, g *UsbGadget, expected ...string) {
+	t.Helper()
+	linked, err := g.linkedFunctions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(linked)
+	slices.Sort(expected)
+	if !slices.Equal(linked, expected) {
+		t.Fatalf("linked functions: got %v, want %v", linked, expected)
+	}
+	for _, instance := range linked {
+		target, err := os.Readlink(path.Join(g.configPath(), instance))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if target != g.functionPath(instance) {
+			t.Fatalf("%s links to %s", instance, target)
+		}
+	}
+}
+
+func assertFunctionExists(t *testing.T, g *UsbGadget, instance string, exists bool) {
+	t.Helper()
+	_, err := os.Stat(g.functionPath(instance))
+	if exists && err != nil {
+		t.Fatalf("%s should exist: %v", instance, err)
+	}
+	if !exists && !os.IsNotExist(err) {
+		t.Fatalf("%s should be removed", instance)
+	}
+}
+
+func TestUsbGadgetConfigureDefaults(t *testing.T) {
+	g := newTestUsbGadget(t)
+	identity := testUsbIdentity()
+	if err := g.Configure(identity, defaultUsbDevices); err != nil {
+		t.Fatal(err)
+	}
+
+	assertLinkedFunctions(t, g, "hid.usb0", "hid.usb1", "hid.usb2", "hid.usb3", "hid.usb4", massStorageName)
+	assertFunctionExists(t, g, "hid.usb5", false)
+	assertFunctionExists(t, g, "acm.usb0", false)
+	if udc := readGadgetAttr(path.Join(g.gadgetPath(), "UDC")); udc != testUdc {
+		t.Fatalf("UDC: got %q, want %q", udc, testUdc)
+	}
+	if product := readGadgetAttr(path.Join(g.gadgetPath(), "strings", "0x409", "product")); product != identity.Product {
+		t.Fatalf("product: got %q", product)
+	}
+	reportDesc, err := os.ReadFile(path.Join(g.functionPath("hid.usb0"), "report_desc"))
+	if err != nil || !bytes.Equal(reportDesc, KeyboardReportDesc) {
+		t.Fatalf("keyboard report descriptor not written: %v", err)
+	}
+	for lun := 0; lun < massStorageLunCount; lun++ {
+		lunPath := path.Join(g.functionPath(massStorageName), fmt.Sprintf("lun.%d", lun))
+		if inquiry := readGadgetAttr(path.Join(lunPath, "inquiry_string")); inquiry != identity.InquiryString {
+			t.Fatalf("lun %d inquiry string: got %q", lun, inquiry)
+		}
+	}
+	if !g.isConfigured(identity, defaultUsbDevices) {
+		t.Fatal("gadget should be reported as configured")
+	}
+}
+
+func TestUsbGadgetConfigureChangesFunctions(t *testing.T) {
+	g := newTestUsbGadget(t)
+	identity := testUsbIdentity()
+	if err := g.Configure(identity, defaultUsbDevices); err != nil {
+		t.Fatal(err)
+	}
+
+	devices := UsbDevices{Mouse: true, Touchscreen: true, Serial: true}
+	if g.isConfigured(identity, devices) {
+		t.Fatal("gadget should need reconfiguring")
+	}
+	if err := g.Configure(identity, devices); err != nil {
+		t.Fatal(err)
+	}
+	assertLinkedFunctions(t, g, "hid.usb1", "hid.usb2", "hid.usb5", "acm.usb0")
+	for _, instance := range []string{"hid.usb0", "hid.usb3", "hid.usb4", massStorageName} {
+		assertFunctionExists(t, g, instance, false)
+	}
+	if length := readGadgetAttr(path.Join(g.functionPath("hid.usb5"), "report_length")); length != "32" {
+		t.Fatalf("touchscreen report length: got %q", length)
+	}
+
+	if err := g.Configure(identity, defaultUsbDevices); err != nil {
+		t.Fatal(err)
+	}
+	assertLinkedFunctions(t, g, "hid.usb0", "hid.usb1", "hid.usb2", "hid.usb3", "hid.usb4", massStorageName)
+	assertFunctionExists(t, g, "hid.usb5", false)
+	assertFunctionExists(t, g, "acm.usb0", false)
+}
+
+func TestUsbGadgetConfigureIdentity(t *testing.T) {
+	g := newTestUsbGadget(t)
+	identity := testUsbIdentity()
+	if err := g.Configure(identity, defaultUsbDevices); err != nil {
+		t.Fatal(err)
+	}
+
+	identity.VendorId = "0x046d"
+	identity.Product = "Keyboard"
+	if g.isConfigured(identity, defaultUsbDevices) {
+		t.Fatal("gadget should need reconfiguring")
+	}
+	if err := g.Configure(identity, defaultUsbDevices); err != nil {
+		t.Fatal(err)
+	}
+	if vendor := readGadgetAttr(path.Join(g.gadgetPath(), "idVendor")); vendor != "0x046d" {
+		t.Fatalf("idVendor: got %q", vendor)
+	}
+	// configfs reads numbers back in its own format
+	if err := os.WriteFile(path.Join(g.gadgetPath(), "idVendor"), []byte("0x046D\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !g.isConfigured(identity, defaultUsbDevices) {
+		t.Fatal("gadget should be reported as configured")
+	}
+
+	// profiles may differ only in what the mass storage reports
+	identity.InquiryString = "Other Virtual Media"
+	if g.isConfigured(identity, defaultUsbDevices) {
+		t.Fatal("changed inquiry string should need reconfiguring")
+	}
+	if err := g.Configure(identity, defaultUsbDevices); err != nil {
+		t.Fatal(err)
+	}
+	for lun := 0; lun < massStorageLunCount; lun++ {
+		lunPath := path.Join(g.functionPath(massStorageName), fmt.Sprintf("lun.%d", lun))
+		if inquiry := readGadgetAttr(path.Join(lunPath, "inquiry_string")); inquiry != identity.InquiryString {
+			t.Fatalf("lun %d inquiry string: got %q", lun, inquiry)
+		}
+	}
+	if !g.isConfigured(identity, defaultUsbDevices) {
+		t.Fatal("gadget should be reported as configured")
+	}
+}
+
+func TestUsbGadgetRewritesChangedDescriptors(t *testing.T) {
+	g := newTestUsbGadget(t)
+	identity := testUsbIdentity()
+	if err := g.Configure(identity, defaultUsbDevices); err != nil {
+		t.Fatal(err)
+	}
+
+	// a newer version with another keyboard descriptor and report length
+	g.functions = slices.Clone(g.functions)
+	newReportDesc := append(slices.Clone(KeyboardReportDesc), 0xc0)
+	g.functions[0].reportDesc = newReportDesc
+	g.functions[0].attrs = [][]string{
+		{"protocol", "1"},
+		{"subclass", "0"},
+		{"report_length", "9"},
+	}
+	if g.isConfigured(identity, defaultUsbDevices) {
+		t.Fatal("changed descriptor should need reconfiguring")
+	}
+	if err := g.Configure(identity, defaultUsbDevices); err != nil {
+		t.Fatal(err)
+	}
+	reportDesc, err := os.ReadFile(path.Join(g.functionPath("hid.usb0"), "report_desc"))
+	if err != nil || !bytes.Equal(reportDesc, newReportDesc) {
+		t.Fatalf("report descriptor not rewritten: %v", err)
+	}
+	if length := readGadgetAttr(path.Join(g.functionPath("hid.usb0"), "report_length")); length != "9" {
+		t.Fatalf("report length: got %q", length)
+	}
+	if !g.isConfigured(identity, defaultUsbDevices) {
+		t.Fatal("gadget should be reported as configured")
+	}
+}
+
+func TestUsbGadgetHidDevicePath(t *testing.T) {
+	g := newTestUsbGadget(t)
+	if err := g.Configure(testUsbIdentity(), defaultUsbDevices); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(g.functionPath("hid.usb4"), "dev"), []byte("236:4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	devicePath, err := g.HidDevicePath("hid.usb4")
+	if err != nil || devicePath != "/dev/hidg4" {
+		t.Fatalf("got %q, %v", devicePath, err)
+	}
+	if _, err := g.HidDevicePath("hid.usb5"); err == nil {
+		t.Fatal("disabled function should have no device")
+	}
+}
+
+func TestUsbGadgetRemovesFunctionsLikeConfigfs(t *testing.T) {
+	g := newTestUsbGadget(t)
+	identity := testUsbIdentity()
+	if err := g.Configure(identity, defaultUsbDevices); err != nil {
+		t.Fatal(err)
+	}
+	massStorage := g.functions[slices.IndexFunc(g.functions, func(f gadgetFunction) bool {
+		return f.instance == massStorageName
+	})]
+	// only the known LUNs are removed, nothing below them
+	unknown := path.Join(g.functionPath(massStorageName), "lun.9", "extra")
+	if err := os.MkdirAll(unknown, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.removeFunction(massStorage); err == nil {
+		t.Fatal("function with unknown sub directories removed recursively")
+	}
+	for lun := range massStorage.children {
+		assertFunctionExists(t, g, path.Join(massStorageName, lun), false)
+	}
+
+	if err := os.RemoveAll(path.Join(g.functionPath(massStorageName), "lun.9")); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.removeFunction(massStorage); err != nil {
+		t.Fatal(err)
+	}
+	assertFunctionExists(t, g, massStorageName, false)
+}
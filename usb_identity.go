@@ -0,0 +1,153 @@
+package kvm
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const defaultUsbIdentityProfileName = "default"
+
+// UsbIdentityProfile is how the gadget presents itself to the host
+type UsbIdentityProfile struct {
+	Name          string `json:"name"`
+	VendorId      string `json:"vendorId"`
+	ProductId     string `json:"productId"`
+	DeviceVersion string `json:"deviceVersion"`
+	Manufacturer  string `json:"manufacturer"`
+	Product       string `json:"product"`
+	SerialNumber  string `json:"serialNumber,omitempty"` // empty uses the device ID
+	InquiryString string `json:"inquiryString"`
+}
+
+var defaultUsbIdentityProfile = UsbIdentityProfile{
+	Name:          defaultUsbIdentityProfileName,
+	VendorId:      "0x1d6b", //The Linux Foundation
+	ProductId:     "0104",   //Multifunction Composite Gadget
+	DeviceVersion: "0100",
+	Manufacturer:  "JetKVM",
+	Product:       "JetKVM USB Emulation Device",
+	InquiryString: "JetKVM Virtual Media",
+}
+
+func (p *UsbIdentityProfile) validate() error {
+	if p.Name == "" {
+		return errors.New("profile name is required")
+	}
+	ids := map[string]string{
+		"vendor id":      p.VendorId,
+		"product id":     p.ProductId,
+		"device version": p.DeviceVersion,
+	}
+	for field, value := range ids {
+		// configfs parses these the same way, with base prefix detection
+		if _, err := strconv.ParseUint(value, 0, 16); err != nil {
+			return fmt.Errorf("invalid %s %q in profile %s", field, value, p.Name)
+		}
+	}
+	if len(p.InquiryString) > 28 {
+		return fmt.Errorf("inquiry string in profile %s is longer than 28 characters", p.Name)
+	}
+	return nil
+}
+
+func findUsbIdentityProfile(name string) (*UsbIdentityProfile, error) {
+	if name == "" || name == defaultUsbIdentityProfileName {
+		return &defaultUsbIdentityProfile, nil
+	}
+	for i := range config.UsbIdentityProfiles {
+		if config.UsbIdentityProfiles[i].Name == name {
+			return &config.UsbIdentityProfiles[i], nil
+		}
+	}
+	return nil, fmt.Errorf("usb identity profile not found: %s", name)
+}
+
+// currentUsbIdentity returns the selected profile, falling back to the
+// default one if it went missing from the config
+func currentUsbIdentity() UsbIdentityProfile {
+	profile, err := findUsbIdentityProfile(config.UsbIdentityProfile)
+	if err != nil {
+		usbLogger.Warnf("%v, using default usb identity", err)
+		profile = &defaultUsbIdentityProfile
+	}
+	identity := *profile
+	if identity.SerialNumber == "" {
+		identity.SerialNumber = GetDeviceID()
+	}
+	return identity
+}
+
+func rpcGetUsbIdentityProfiles() []UsbIdentityProfile {
+	profiles := []UsbIdentityProfile{defaultUsbIdentityProfile}
+	return append(profiles, config.UsbIdentityProfiles...)
+}
+
+type SetUsbIdentityProfilesParams struct {
+	Profiles []UsbIdentityProfile `json:"profiles"`
+}
+
+// rpcSetUsbIdentityProfiles replaces the custom profiles, the gadget is rebuilt
+// if the selected profile changed
+func rpcSetUsbIdentityProfiles(params SetUsbIdentityProfilesParams) error {
+	names := make(map[string]bool)
+	for i := range params.Profiles {
+		profile := &params.Profiles[i]
+		if err := profile.validate(); err != nil {
+			return err
+		}
+		if profile.Name == defaultUsbIdentityProfileName {
+			return errors.New("the default profile can't be changed")
+		}
+		if names[profile.Name] {
+			return fmt.Errorf("duplicate profile name: %s", profile.Name)
+		}
+		names[profile.Name] = true
+	}
+
+	selected := config.UsbIdentityProfile
+	if selected != "" && selected != defaultUsbIdentityProfileName && !names[selected] {
+		return fmt.Errorf("profile %s is in use, select another profile before removing it", selected)
+	}
+
+	previousIdentity := currentUsbIdentity()
+	previousProfiles := config.UsbIdentityProfiles
+	config.UsbIdentityProfiles = params.Profiles
+	if currentUsbIdentity() != previousIdentity {
+		if err := applyUsbGadgetConfig(); err != nil {
+			config.UsbIdentityProfiles = previousProfiles
+			if restoreErr := applyUsbGadgetConfig(); restoreErr != nil {
+				usbLogger.Errorf("failed to restore usb identity: %v", restoreErr)
+			}
+			return fmt.Errorf("failed to apply usb identity: %w", err)
+		}
+	}
+	return SaveConfig()
+}
+
+func rpcGetUsbIdentityProfile() string {
+	if config.UsbIdentityProfile == "" {
+		return defaultUsbIdentityProfileName
+	}
+	return config.UsbIdentityProfile
+}
+
+func rpcSetUsbIdentityProfile(name string) error {
+	if _, err := findUsbIdentityProfile(name); err != nil {
+		return err
+	}
+	if rpcGetUsbIdentityProfile() == name {
+		return nil
+	}
+	previous := config.UsbIdentityProfile
+	config.UsbIdentityProfile = name
+	if err := applyUsbGadgetConfig(); err != nil {
+		config.UsbIdentityProfile = previous
+		if restoreErr := applyUsbGadgetConfig(); restoreErr != nil {
+			usbLogger.Errorf("failed to restore usb identity: %v", restoreErr)
+		}
+		return fmt.Errorf("failed to apply usb identity: %w", err)
+	}
+	logger.Infof("usb identity profile changed to %s", name)
+	return SaveConfig()
+}
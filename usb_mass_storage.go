@@ -1,10 +1,12 @@
 package kvm
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"kvm/resource"
 	"log"
 	"net/http"
@@ -26,61 +28,100 @@ import (
 
 const massStorageName = "mass_storage.usb0"
 
+// massStorageLunCount LUNs are exposed so e.g. an installer ISO and a driver
+// disk can be mounted at the same time
+const massStorageLunCount = 2
+
 var massStorageFunctionPath = path.Join(gadgetPath, "jetkvm", "functions", massStorageName)
 
+func massStorageLunPath(lun int) string {
+	return path.Join(massStorageFunctionPath, fmt.Sprintf("lun.%d", lun))
+}
+
+func checkMassStorageLun(lun int) error {
+	if lun < 0 || lun >= massStorageLunCount {
+		return fmt.Errorf("invalid LUN: %d", lun)
+	}
+	return nil
+}
+
 func writeFile(path string, data string) error {
 	return os.WriteFile(path, []byte(data), 0644)
 }
 
-func setMassStorageImage(imagePath string) error {
-	err := writeFile(path.Join(massStorageFunctionPath, "lun.0", "file"), imagePath)
+func setMassStorageImage(lun int, imagePath string) error {
+	err := writeFile(path.Join(massStorageLunPath(lun), "file"), imagePath)
 	if err != nil {
 		return fmt.Errorf("failed to set image path: %w", err)
 	}
 	return nil
 }
 
-func setMassStorageMode(cdrom bool) error {
+func setMassStorageMode(lun int, cdrom bool) error {
 	mode := "0"
 	if cdrom {
 		mode = "1"
 	}
-	err := writeFile(path.Join(massStorageFunctionPath, "lun.0", "cdrom"), mode)
+	err := writeFile(path.Join(massStorageLunPath(lun), "cdrom"), mode)
 	if err != nil {
 		return fmt.Errorf("failed to set cdrom mode: %w", err)
 	}
 	return nil
 }
 
+func setMassStorageReadOnly(lun int, readOnly bool) error {
+	ro := "0"
+	if readOnly {
+		ro = "1"
+	}
+	err := writeFile(path.Join(massStorageLunPath(lun), "ro"), ro)
+	if err != nil {
+		return fmt.Errorf("failed to set read-only mode: %w", err)
+	}
+	return nil
+}
+
+// applyMassStorageMode must be called while the LUN has no file, the kernel
+// refuses mode changes with media loaded
+func applyMassStorageMode(lun int, mode VirtualMediaMode) error {
+	err := setMassStorageMode(lun, mode == CDROM)
+	if err != nil {
+		return err
+	}
+	return setMassStorageReadOnly(lun, mode != WritableDisk)
+}
+
 func onDiskMessage(msg webrtc.DataChannelMessage) {
-	fmt.Println("Disk Message, len:", len(msg.Data))
-	diskReadChan <- msg.Data
+	logger.Debugf("disk message, len: %d", len(msg.Data))
+	webRTCDiskReader.handleReply(msg.Data)
 }
 
-func mountImage(imagePath string) error {
-	err := setMassStorageImage("")
+func mountImage(lun int, imagePath string) error {
+	err := setMassStorageImage(lun, "")
 	if err != nil {
-		return fmt.Errorf("Remove Mass Storage Image Error", err)
+		return fmt.Errorf("failed to remove mass storage image: %w", err)
 	}
-	err = setMassStorageImage(imagePath)
+	err = setMassStorageImage(lun, imagePath)
 	if err != nil {
-		return fmt.Errorf("Set Mass Storage Image Error", err)
+		return fmt.Errorf("failed to set mass storage image: %w", err)
 	}
 	return nil
 }
 
-var nbdDevice *NBDDevice
-
-const imagesFolder = "/userdata/jetkvm/images"
+// imagesFolder is a variable so tests can store images elsewhere
+var imagesFolder = "/userdata/jetkvm/images"
 
-func rpcMountBuiltInImage(filename string) error {
+func rpcMountBuiltInImage(filename string, lun int) error {
 	log.Println("Mount Built-In Image", filename)
+	if err := checkMassStorageLun(lun); err != nil {
+		return err
+	}
 	_ = os.MkdirAll(imagesFolder, 0755)
 	imagePath := filepath.Join(imagesFolder, filename)
 
 	// Check if the file exists in the imagesFolder
 	if _, err := os.Stat(imagePath); err == nil {
-		return mountImage(imagePath)
+		return mountImage(lun, imagePath)
 	}
 
 	// If not, try to find it in ResourceFS
@@ -104,11 +145,11 @@ func rpcMountBuiltInImage(filename string) error {
 	}
 
 	// Mount the newly created image
-	return mountImage(imagePath)
+	return mountImage(lun, imagePath)
 }
 
-func getMassStorageMode() (bool, error) {
-	data, err := os.ReadFile(path.Join(massStorageFunctionPath, "lun.0", "cdrom"))
+func getMassStorageMode(lun int) (bool, error) {
+	data, err := os.ReadFile(path.Join(massStorageLunPath(lun), "cdrom"))
 	if err != nil {
 		return false, fmt.Errorf("failed to read cdrom mode: %w", err)
 	}
@@ -120,13 +161,10 @@ func getMassStorageMode() (bool, error) {
 }
 
 type VirtualMediaUrlInfo struct {
-	Usable bool
-	Reason string //only populated if Usable is false
-	Size   int64
-}
-
-func rpcCheckMountUrl(url string) (*VirtualMediaUrlInfo, error) {
-	return nil, errors.New("not implemented")
+	Usable    bool   `json:"usable"`
+	Reason    string `json:"reason,omitempty"` //only populated if Usable is false
+	Size      int64  `json:"size"`
+	ImageType string `json:"imageType,omitempty"` // iso9660, gpt or mbr when recognized
 }
 
 type VirtualMediaSource string
@@ -142,125 +180,358 @@ type VirtualMediaMode string
 const (
 	CDROM VirtualMediaMode = "CDROM"
 	Disk  VirtualMediaMode = "Disk"
+	// WritableDisk keeps the writes of the host in an overlay, the image
+	// itself is never modified
+	WritableDisk VirtualMediaMode = "WritableDisk"
 )
 
+func (m VirtualMediaMode) validate() error {
+	switch m {
+	case CDROM, Disk, WritableDisk:
+		return nil
+	}
+	return fmt.Errorf("invalid virtual media mode: %s", m)
+}
+
 type VirtualMediaState struct {
+	Lun      int                `json:"lun"`
 	Source   VirtualMediaSource `json:"source"`
 	Mode     VirtualMediaMode   `json:"mode"`
 	Filename string             `json:"filename,omitempty"`
 	URL      string             `json:"url,omitempty"`
 	Size     int64              `json:"size"`
+	Cache    *MediaCacheStats   `json:"cache,omitempty"` // HTTP media only
+	// compression undone while reading, Size is the decompressed size then
+	Compression string `json:"compression,omitempty"`
 }
 
-var currentVirtualMediaState *VirtualMediaState
+// virtualMediaLun is the media mounted on a LUN and what backs it
+type virtualMediaLun struct {
+	state           *VirtualMediaState
+	nbdDevice       *NBDDevice
+	httpRangeReader *httpreadat.RangeReader
+	httpCache       *mediaReadCache
+	image           *seekableImage // decompresses compressed media
+	overlay         *cowOverlay
+}
+
+var virtualMediaLuns [massStorageLunCount]virtualMediaLun
 var virtualMediaStateMutex sync.RWMutex
 
+// virtualMediaLunState must be called with virtualMediaStateMutex held
+func virtualMediaLunState(lun int) *VirtualMediaState {
+	mounted := virtualMediaLuns[lun]
+	if mounted.state == nil {
+		return nil
+	}
+	state := *mounted.state
+	if mounted.httpCache != nil {
+		stats := mounted.httpCache.Stats()
+		state.Cache = &stats
+	}
+	return &state
+}
+
+// rpcGetVirtualMediaState returns the media on LUN 0, as before there were
+// several LUNs
 func rpcGetVirtualMediaState() (*VirtualMediaState, error) {
 	virtualMediaStateMutex.RLock()
 	defer virtualMediaStateMutex.RUnlock()
-	return currentVirtualMediaState, nil
+	return virtualMediaLunState(0), nil
+}
+
+// rpcGetVirtualMediaStates returns the state of every LUN with media mounted
+func rpcGetVirtualMediaStates() ([]VirtualMediaState, error) {
+	virtualMediaStateMutex.RLock()
+	defer virtualMediaStateMutex.RUnlock()
+	states := make([]VirtualMediaState, 0)
+	for lun := range virtualMediaLuns {
+		if state := virtualMediaLunState(lun); state != nil {
+			states = append(states, *state)
+		}
+	}
+	return states, nil
+}
+
+func isVirtualMediaMounted() bool {
+	virtualMediaStateMutex.RLock()
+	defer virtualMediaStateMutex.RUnlock()
+	for _, mounted := range virtualMediaLuns {
+		if mounted.state != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// webRTCVirtualMediaState returns the media streamed from the browser, there
+// is a single disk channel so only one LUN can use it. Must be called with
+// virtualMediaStateMutex held.
+func webRTCVirtualMediaState() *VirtualMediaState {
+	for _, mounted := range virtualMediaLuns {
+		if mounted.state != nil && mounted.state.Source == WebRTC {
+			return mounted.state
+		}
+	}
+	return nil
 }
 
-func rpcUnmountImage() error {
+func rpcUnmountImage(lun int) error {
+	if err := checkMassStorageLun(lun); err != nil {
+		return err
+	}
+	// deferred first so it runs once the mutex is released
+	defer persistVirtualMedia()
 	virtualMediaStateMutex.Lock()
 	defer virtualMediaStateMutex.Unlock()
-	err := setMassStorageImage("\n")
+	err := setMassStorageImage(lun, "\n")
 	if err != nil {
 		fmt.Println("Remove Mass Storage Image Error", err)
 	}
 	//TODO: check if we still need it
 	time.Sleep(500 * time.Millisecond)
-	if nbdDevice != nil {
-		nbdDevice.Close()
-		nbdDevice = nil
+	if virtualMediaLuns[lun].nbdDevice != nil {
+		virtualMediaLuns[lun].nbdDevice.Close()
 	}
-	currentVirtualMediaState = nil
+	if virtualMediaLuns[lun].overlay != nil {
+		err = virtualMediaLuns[lun].overlay.Close()
+		if err != nil {
+			logger.Warnf("failed to close overlay of LUN %d: %v", lun, err)
+		}
+	}
+	closeVirtualMediaLunSources(lun)
+	virtualMediaLuns[lun] = virtualMediaLun{}
 	return nil
 }
 
-var httpRangeReader *httpreadat.RangeReader
+func unmountAllImages() error {
+	var errs []error
+	for lun := 0; lun < massStorageLunCount; lun++ {
+		virtualMediaStateMutex.RLock()
+		mounted := virtualMediaLuns[lun].state != nil
+		virtualMediaStateMutex.RUnlock()
+		if !mounted {
+			continue
+		}
+		if err := rpcUnmountImage(lun); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
 
-func rpcMountWithHTTP(url string, mode VirtualMediaMode) error {
+// reserveVirtualMediaLun claims a free LUN for the given media
+func reserveVirtualMediaLun(lun int, mounted virtualMediaLun) error {
+	if err := checkMassStorageLun(lun); err != nil {
+		return err
+	}
+	if err := mounted.state.Mode.validate(); err != nil {
+		return err
+	}
 	virtualMediaStateMutex.Lock()
-	if currentVirtualMediaState != nil {
-		virtualMediaStateMutex.Unlock()
-		return fmt.Errorf("another virtual media is already mounted")
+	defer virtualMediaStateMutex.Unlock()
+	if virtualMediaLuns[lun].state != nil {
+		return fmt.Errorf("another virtual media is already mounted on LUN %d", lun)
 	}
-	httpRangeReader = httpreadat.New(url)
-	n, err := httpRangeReader.Size()
-	if err != nil {
-		virtualMediaStateMutex.Unlock()
-		return fmt.Errorf("failed to use http url: %w", err)
+	if mounted.state.Source == WebRTC && webRTCVirtualMediaState() != nil {
+		return fmt.Errorf("another virtual media is already mounted from the browser")
 	}
-	logger.Infof("using remote url %s with size %d", url, n)
-	currentVirtualMediaState = &VirtualMediaState{
-		Source: HTTP,
-		Mode:   mode,
-		URL:    url,
-		Size:   n,
+	mounted.state.Lun = lun
+	virtualMediaLuns[lun] = mounted
+	return nil
+}
+
+func checkVirtualMediaLunFree(lun int) error {
+	virtualMediaStateMutex.RLock()
+	defer virtualMediaStateMutex.RUnlock()
+	if virtualMediaLuns[lun].state != nil {
+		return fmt.Errorf("another virtual media is already mounted on LUN %d", lun)
+	}
+	return nil
+}
+
+// closeVirtualMediaLunSources must be called with virtualMediaStateMutex held
+func closeVirtualMediaLunSources(lun int) {
+	if virtualMediaLuns[lun].image != nil {
+		virtualMediaLuns[lun].image.Close()
+	}
+	if virtualMediaLuns[lun].httpCache != nil {
+		virtualMediaLuns[lun].httpCache.Close()
+	}
+}
+
+func releaseVirtualMediaLun(lun int) {
+	virtualMediaStateMutex.Lock()
+	defer virtualMediaStateMutex.Unlock()
+	closeVirtualMediaLunSources(lun)
+	virtualMediaLuns[lun] = virtualMediaLun{}
+}
+
+// mountRemoteImage exposes a reserved LUN's media through its own NBD device,
+// writable disks get an overlay in between
+func mountRemoteImage(lun int, mode VirtualMediaMode) error {
+	writable := mode == WritableDisk
+	if writable {
+		err := attachOverlay(lun)
+		if err != nil {
+			releaseVirtualMediaLun(lun)
+			return err
+		}
 	}
-	virtualMediaStateMutex.Unlock()
 
 	logger.Debug("Starting nbd device")
-	nbdDevice = NewNBDDevice()
-	err = nbdDevice.Start()
+	nbdDevice := NewNBDDevice(lun, writable)
+	err := nbdDevice.Start()
 	if err != nil {
 		logger.Errorf("failed to start nbd device: %v", err)
+		nbdDevice.Close()
+		detachOverlay(lun)
+		releaseVirtualMediaLun(lun)
 		return err
 	}
+	virtualMediaStateMutex.Lock()
+	virtualMediaLuns[lun].nbdDevice = nbdDevice
+	virtualMediaStateMutex.Unlock()
 	logger.Debug("nbd device started")
 	//TODO: replace by polling on block device having right size
 	time.Sleep(1 * time.Second)
-	err = setMassStorageImage("/dev/nbd0")
+	nbdDevice.setQueueLimits()
+	err = applyMassStorageMode(lun, mode)
+	if err == nil {
+		err = setMassStorageImage(lun, nbdDevice.devicePath())
+	}
 	if err != nil {
+		logger.Errorf("failed to attach nbd device to LUN %d: %v", lun, err)
+		nbdDevice.Close()
+		detachOverlay(lun)
+		releaseVirtualMediaLun(lun)
 		return err
 	}
-	logger.Info("usb mass storage mounted")
+	logger.Infof("usb mass storage mounted on LUN %d", lun)
+	persistVirtualMedia()
 	return nil
 }
 
-func rpcMountWithWebRTC(filename string, size int64, mode VirtualMediaMode) error {
-	virtualMediaStateMutex.Lock()
-	if currentVirtualMediaState != nil {
-		virtualMediaStateMutex.Unlock()
-		return fmt.Errorf("another virtual media is already mounted")
+func attachOverlay(lun int) error {
+	virtualMediaStateMutex.RLock()
+	state := *virtualMediaLuns[lun].state
+	rangeReader := virtualMediaLuns[lun].httpRangeReader
+	image := virtualMediaLuns[lun].image
+	virtualMediaStateMutex.RUnlock()
+
+	var base io.ReaderAt = image
+	var baseCloser io.Closer
+	if image == nil {
+		var err error
+		base, baseCloser, err = openOverlayBase(lun, &state, rangeReader)
+		if err != nil {
+			return err
+		}
 	}
-	currentVirtualMediaState = &VirtualMediaState{
-		Source:   WebRTC,
-		Mode:     mode,
-		Filename: filename,
-		Size:     size,
+	overlay, err := openOverlay(lun, &state, base, baseCloser)
+	if err != nil {
+		if baseCloser != nil {
+			baseCloser.Close()
+		}
+		return err
 	}
+	virtualMediaStateMutex.Lock()
+	virtualMediaLuns[lun].overlay = overlay
 	virtualMediaStateMutex.Unlock()
-	logger.Debugf("currentVirtualMediaState is %v", currentVirtualMediaState)
-	logger.Debug("Starting nbd device")
-	nbdDevice = NewNBDDevice()
-	err := nbdDevice.Start()
+	return nil
+}
+
+func detachOverlay(lun int) {
+	virtualMediaStateMutex.Lock()
+	overlay := virtualMediaLuns[lun].overlay
+	virtualMediaLuns[lun].overlay = nil
+	virtualMediaStateMutex.Unlock()
+	if overlay != nil {
+		overlay.Close()
+	}
+}
+
+// rpcMountWithHTTP mounts url right away, or returns the download that
+// mounts it once stored when the image can't be read at random
+func rpcMountWithHTTP(url string, mode VirtualMediaMode, lun int) (*StorageDownload, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mountUrlCheckTimeout)
+	urlInfo := checkMountUrl(ctx, url)
+	cancel()
+	if !urlInfo.Usable {
+		return nil, fmt.Errorf("can't mount %s: %s", url, urlInfo.Reason)
+	}
+	n := urlInfo.Size
+	logger.Infof("using remote url %s with size %d", url, n)
+	compression, _ := imageCompression(urlFilename(url))
+	err := reserveVirtualMediaLun(lun, virtualMediaLun{
+		state: &VirtualMediaState{
+			Source:      HTTP,
+			Mode:        mode,
+			URL:         url,
+			Size:        n,
+			Compression: compression,
+		},
+	})
 	if err != nil {
-		logger.Errorf("failed to start nbd device: %v", err)
-		return err
+		return nil, err
 	}
-	logger.Debug("nbd device started")
-	//TODO: replace by polling on block device having right size
-	time.Sleep(1 * time.Second)
-	err = setMassStorageImage("/dev/nbd0")
+	// the disk cache file belongs to the LUN, create it once the LUN is ours
+	httpCache := newLunMediaReadCache(lun, n)
+	rangeReader := httpreadat.New(url, httpreadat.WithCacheHandler(httpCache))
+	virtualMediaStateMutex.Lock()
+	virtualMediaLuns[lun].httpCache = httpCache
+	virtualMediaLuns[lun].httpRangeReader = rangeReader
+	virtualMediaStateMutex.Unlock()
+
+	if compression != "" {
+		image, err := openSeekableImage(rangeReader, n, compression, nil)
+		if errors.Is(err, errImageNotSeekable) {
+			// read while the range reader is still open
+			size := decompressedSize(rangeReader, n, compression)
+			releaseVirtualMediaLun(lun)
+			return downloadAndMount(url, size, mode, lun)
+		}
+		if err != nil {
+			releaseVirtualMediaLun(lun)
+			return nil, fmt.Errorf("failed to open compressed image: %w", err)
+		}
+		virtualMediaStateMutex.Lock()
+		virtualMediaLuns[lun].image = image
+		virtualMediaLuns[lun].state.Size = image.Size()
+		virtualMediaStateMutex.Unlock()
+	}
+	return nil, mountRemoteImage(lun, mode)
+}
+
+func rpcMountWithWebRTC(filename string, size int64, mode VirtualMediaMode, lun int) error {
+	err := reserveVirtualMediaLun(lun, virtualMediaLun{
+		state: &VirtualMediaState{
+			Source:   WebRTC,
+			Mode:     mode,
+			Filename: filename,
+			Size:     size,
+		},
+	})
 	if err != nil {
 		return err
 	}
-	logger.Info("usb mass storage mounted")
-	return nil
+	return mountRemoteImage(lun, mode)
 }
 
-func rpcMountWithStorage(filename string, mode VirtualMediaMode) error {
-	filename, err := sanitizeFilename(filename)
+func rpcMountWithStorage(filename string, mode VirtualMediaMode, lun int) error {
+	filename, err := sanitizeStoragePath(filename)
 	if err != nil {
 		return err
 	}
+	if err := checkMassStorageLun(lun); err != nil {
+		return err
+	}
+	if err := mode.validate(); err != nil {
+		return err
+	}
 
-	virtualMediaStateMutex.Lock()
-	defer virtualMediaStateMutex.Unlock()
-	if currentVirtualMediaState != nil {
-		return fmt.Errorf("another virtual media is already mounted")
+	if compression, _ := imageCompression(filename); compression != "" {
+		return mountCompressedStorageFile(filename, compression, mode, lun)
 	}
 
 	fullPath := filepath.Join(imagesFolder, filename)
@@ -268,23 +539,51 @@ func rpcMountWithStorage(filename string, mode VirtualMediaMode) error {
 	if err != nil {
 		return fmt.Errorf("failed to get file info: %w", err)
 	}
-
-	err = setMassStorageImage(fullPath)
-	if err != nil {
-		return fmt.Errorf("failed to set mass storage image: %w", err)
-	}
-	currentVirtualMediaState = &VirtualMediaState{
+	state := &VirtualMediaState{
+		Lun:      lun,
 		Source:   Storage,
 		Mode:     mode,
 		Filename: filename,
 		Size:     fileInfo.Size(),
 	}
+
+	// writes must not reach the image, so writable disks go through NBD
+	if mode == WritableDisk {
+		err = reserveVirtualMediaLun(lun, virtualMediaLun{state: state})
+		if err != nil {
+			return err
+		}
+		return mountRemoteImage(lun, mode)
+	}
+
+	// deferred first so it runs once the mutex is released
+	defer persistVirtualMedia()
+	virtualMediaStateMutex.Lock()
+	defer virtualMediaStateMutex.Unlock()
+	if virtualMediaLuns[lun].state != nil {
+		return fmt.Errorf("another virtual media is already mounted on LUN %d", lun)
+	}
+
+	err = applyMassStorageMode(lun, mode)
+	if err != nil {
+		return err
+	}
+	err = setMassStorageImage(lun, fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to set mass storage image: %w", err)
+	}
+	virtualMediaLuns[lun] = virtualMediaLun{state: state}
 	return nil
 }
 
 type StorageSpace struct {
-	BytesUsed int64 `json:"bytesUsed"`
-	BytesFree int64 `json:"bytesFree"`
+	BytesUsed       int64              `json:"bytesUsed"`
+	BytesFree       int64              `json:"bytesFree"`
+	BytesReserved   int64              `json:"bytesReserved"`   // kept free for the system
+	BytesAvailable  int64              `json:"bytesAvailable"`  // free space left for images
+	BytesFiles      int64              `json:"bytesFiles"`      // taken by complete files
+	BytesIncomplete int64              `json:"bytesIncomplete"` // taken by partial uploads and downloads
+	Files           []StorageFileUsage `json:"files"`           // largest first
 }
 
 func rpcGetStorageSpace() (*StorageSpace, error) {
@@ -298,44 +597,77 @@ func rpcGetStorageSpace() (*StorageSpace, error) {
 	freeSpace := stat.Bfree * uint64(stat.Bsize)
 	usedSpace := totalSpace - freeSpace
 
+	reserved := int64(currentStorageSettings().ReserveMB) * 1024 * 1024
+	available := int64(stat.Bavail*uint64(stat.Bsize)) - reserved
+	filesBytes, incompleteBytes, files := storageUsage()
+
 	return &StorageSpace{
-		BytesUsed: int64(usedSpace),
-		BytesFree: int64(freeSpace),
+		BytesUsed:       int64(usedSpace),
+		BytesFree:       int64(freeSpace),
+		BytesReserved:   reserved,
+		BytesAvailable:  max(available, 0),
+		BytesFiles:      filesBytes,
+		BytesIncomplete: incompleteBytes,
+		Files:           files,
 	}, nil
 }
 
 type StorageFile struct {
-	Filename  string    `json:"filename"`
-	Size      int64     `json:"size"`
-	CreatedAt time.Time `json:"createdAt"`
+	Filename  string     `json:"filename"` // relative to the storage, folders included
+	IsDir     bool       `json:"isDir,omitempty"`
+	Size      int64      `json:"size"`
+	CreatedAt time.Time  `json:"createdAt"`
+	SHA256    string     `json:"sha256,omitempty"`
+	Image     *ImageInfo `json:"image,omitempty"`
 }
 
 type StorageFiles struct {
 	Files []StorageFile `json:"files"`
 }
 
+// rpcListStorageFiles lists files and folders of the whole storage, names of
+// entries in folders include the folder
 func rpcListStorageFiles() (*StorageFiles, error) {
-	files, err := os.ReadDir(imagesFolder)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read directory: %v", err)
-	}
-
 	storageFiles := make([]StorageFile, 0)
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	err := filepath.WalkDir(imagesFolder, func(fullPath string, file fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if fullPath == imagesFolder {
+			return nil
+		}
+		if strings.HasPrefix(file.Name(), ".") {
+			if file.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
 		info, err := file.Info()
 		if err != nil {
-			return nil, fmt.Errorf("failed to get file info: %v", err)
+			return fmt.Errorf("failed to get file info: %v", err)
 		}
 
-		storageFiles = append(storageFiles, StorageFile{
-			Filename:  file.Name(),
+		filename := storageRelativePath(fullPath)
+		storageFile := StorageFile{
+			Filename:  filename,
+			IsDir:     file.IsDir(),
 			Size:      info.Size(),
 			CreatedAt: info.ModTime(),
-		})
+		}
+		if file.IsDir() {
+			storageFile.Size = 0
+		} else if !strings.HasSuffix(filename, ".incomplete") {
+			if metadata := getImageMetadata(filename, info); metadata != nil {
+				storageFile.SHA256 = metadata.SHA256
+				storageFile.Image = &metadata.ImageInfo
+			}
+		}
+		storageFiles = append(storageFiles, storageFile)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %v", err)
 	}
 
 	return &StorageFiles{Files: storageFiles}, nil
@@ -353,22 +685,34 @@ func sanitizeFilename(filename string) (string, error) {
 	return sanitized, nil
 }
 
+// rpcDeleteStorageFile deletes a file or an empty folder
 func rpcDeleteStorageFile(filename string) error {
-	sanitizedFilename, err := sanitizeFilename(filename)
+	sanitizedFilename, err := sanitizeStoragePath(filename)
 	if err != nil {
 		return err
 	}
 
 	fullPath := filepath.Join(imagesFolder, sanitizedFilename)
 
-	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
+	fileInfo, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
 		return fmt.Errorf("file does not exist: %s", filename)
 	}
+	if isStorageFileMounted(sanitizedFilename) {
+		return fmt.Errorf("file is mounted: %s", filename)
+	}
+	if fileInfo != nil && fileInfo.IsDir() {
+		entries, err := os.ReadDir(fullPath)
+		if err == nil && len(entries) > 0 {
+			return fmt.Errorf("folder is not empty: %s", filename)
+		}
+	}
 
 	err = os.Remove(fullPath)
 	if err != nil {
 		return fmt.Errorf("failed to delete file: %v", err)
 	}
+	removeImageMetadata(sanitizedFilename)
 
 	return nil
 }
@@ -380,11 +724,20 @@ type StorageFileUpload struct {
 
 const uploadIdPrefix = "upload_"
 
-func rpcStartStorageFileUpload(filename string, size int64) (*StorageFileUpload, error) {
-	sanitizedFilename, err := sanitizeFilename(filename)
+// rpcStartStorageFileUpload continues a partial upload of the same file,
+// sha256 is optional and checked once the upload is complete
+func rpcStartStorageFileUpload(filename string, size int64, sha256sum string) (*StorageFileUpload, error) {
+	sanitizedFilename, err := sanitizeStoragePath(filename)
+	if err != nil {
+		return nil, err
+	}
+	sha256sum, err = normalizeSHA256(sha256sum)
 	if err != nil {
 		return nil, err
 	}
+	if size < 0 {
+		return nil, fmt.Errorf("invalid size: %d", size)
+	}
 
 	filePath := path.Join(imagesFolder, sanitizedFilename)
 	uploadPath := filePath + ".incomplete"
@@ -392,22 +745,59 @@ func rpcStartStorageFileUpload(filename string, size int64) (*StorageFileUpload,
 	if _, err := os.Stat(filePath); err == nil {
 		return nil, fmt.Errorf("file already exists: %s", sanitizedFilename)
 	}
+	// an upload that never got its transfer is replaced, a running one isn't
+	pendingUploadsMutex.Lock()
+	for id, upload := range pendingUploads {
+		if upload.File.Name() != uploadPath {
+			continue
+		}
+		upload.mutex.Lock()
+		active := upload.active
+		upload.mutex.Unlock()
+		if active {
+			pendingUploadsMutex.Unlock()
+			return nil, fmt.Errorf("file is already being uploaded: %s", sanitizedFilename)
+		}
+		upload.File.Close()
+		delete(pendingUploads, id)
+	}
+	pendingUploadsMutex.Unlock()
+	if isStorageFileBusy(sanitizedFilename) {
+		return nil, fmt.Errorf("file is already being written: %s", sanitizedFilename)
+	}
 
 	var alreadyUploadedBytes int64 = 0
 	if stat, err := os.Stat(uploadPath); err == nil {
 		alreadyUploadedBytes = stat.Size()
 	}
+	if alreadyUploadedBytes > size {
+		// left behind by an upload of some other file, start over
+		logger.Warnf("partial upload %s is larger than %d bytes, discarding it", uploadPath, size)
+		if err := os.Remove(uploadPath); err != nil {
+			return nil, fmt.Errorf("failed to remove partial upload: %w", err)
+		}
+		alreadyUploadedBytes = 0
+	}
+	if err := checkStorageSpace(size - alreadyUploadedBytes); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create folder: %w", err)
+	}
 
 	uploadId := uploadIdPrefix + uuid.New().String()
-	file, err := os.OpenFile(uploadPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	// readable too, resumed uploads hash what is already there
+	file, err := os.OpenFile(uploadPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file for upload: %v", err)
 	}
 	pendingUploadsMutex.Lock()
-	pendingUploads[uploadId] = pendingUpload{
+	pendingUploads[uploadId] = &pendingUpload{
+		id:                   uploadId,
 		File:                 file,
 		Size:                 size,
 		AlreadyUploadedBytes: alreadyUploadedBytes,
+		SHA256:               sha256sum,
 	}
 	pendingUploadsMutex.Unlock()
 	return &StorageFileUpload{
@@ -416,143 +806,119 @@ func rpcStartStorageFileUpload(filename string, size int64) (*StorageFileUpload,
 	}, nil
 }
 
-type pendingUpload struct {
-	File                 *os.File
-	Size                 int64
-	AlreadyUploadedBytes int64
-}
-
-var pendingUploads = make(map[string]pendingUpload)
-var pendingUploadsMutex sync.Mutex
-
-type UploadProgress struct {
-	Size                 int64
-	AlreadyUploadedBytes int64
+func sendUploadProgress(d *webrtc.DataChannel, progress UploadProgress) {
+	progressJSON, err := json.Marshal(progress)
+	if err != nil {
+		logger.Errorf("failed to marshal upload progress: %v", err)
+		return
+	}
+	err = d.SendText(string(progressJSON))
+	if err != nil {
+		logger.Errorf("failed to send upload progress: %v", err)
+	}
 }
 
 func handleUploadChannel(d *webrtc.DataChannel) {
 	defer d.Close()
 	uploadId := d.Label()
-	pendingUploadsMutex.Lock()
-	pendingUpload, ok := pendingUploads[uploadId]
-	pendingUploadsMutex.Unlock()
-	if !ok {
+	upload := getPendingUpload(uploadId)
+	if upload == nil {
 		logger.Warnf("upload channel opened for unknown upload: %s", uploadId)
 		return
 	}
-	totalBytesWritten := pendingUpload.AlreadyUploadedBytes
-	defer func() {
-		pendingUpload.File.Close()
-		if totalBytesWritten == pendingUpload.Size {
-			newName := strings.TrimSuffix(pendingUpload.File.Name(), ".incomplete")
-			err := os.Rename(pendingUpload.File.Name(), newName)
-			if err != nil {
-				logger.Errorf("failed to rename uploaded file: %v", err)
-			} else {
-				logger.Debugf("successfully renamed uploaded file to: %s", newName)
-			}
-		} else {
-			logger.Warnf("uploaded ended before the complete file received")
+	if err := upload.begin(); err != nil {
+		logger.Warnf("failed to start upload %s: %v", uploadId, err)
+		sendUploadProgress(d, UploadProgress{Error: err.Error()})
+		return
+	}
+
+	uploadDone := make(chan error, 1)
+	done := func(err error) {
+		select {
+		case uploadDone <- err:
+		default:
 		}
-		pendingUploadsMutex.Lock()
-		delete(pendingUploads, uploadId)
-		pendingUploadsMutex.Unlock()
-	}()
-	uploadComplete := make(chan struct{})
+	}
 	lastProgressTime := time.Now()
 	d.OnMessage(func(msg webrtc.DataChannelMessage) {
-		bytesWritten, err := pendingUpload.File.Write(msg.Data)
+		err := upload.write(msg.Data)
 		if err != nil {
-			logger.Errorf("failed to write to file: %v", err)
-			close(uploadComplete)
+			done(err)
 			return
 		}
-		totalBytesWritten += int64(bytesWritten)
-
-		sendProgress := false
-		if time.Since(lastProgressTime) >= 200*time.Millisecond {
-			sendProgress = true
-		}
-		if totalBytesWritten >= pendingUpload.Size {
-			sendProgress = true
-			close(uploadComplete)
+		if upload.complete() {
+			done(nil)
+			return
 		}
-
-		if sendProgress {
-			progress := UploadProgress{
-				Size:                 pendingUpload.Size,
-				AlreadyUploadedBytes: totalBytesWritten,
-			}
-			progressJSON, err := json.Marshal(progress)
-			if err != nil {
-				logger.Errorf("failed to marshal upload progress: %v", err)
-			} else {
-				err = d.SendText(string(progressJSON))
-				if err != nil {
-					logger.Errorf("failed to send upload progress: %v", err)
-				}
-			}
+		if time.Since(lastProgressTime) >= 200*time.Millisecond {
+			sendUploadProgress(d, upload.progress())
 			lastProgressTime = time.Now()
 		}
 	})
+	d.OnClose(func() {
+		done(errUploadInterrupted)
+	})
+	if upload.complete() {
+		// a resumed upload may have nothing left to send
+		done(nil)
+	}
 
 	// Block until upload is complete
-	<-uploadComplete
+	err := upload.finish(<-uploadDone)
+	progress := upload.progress()
+	if err != nil {
+		logger.Warnf("upload %s failed: %v", uploadId, err)
+		progress.Error = err.Error()
+	} else {
+		progress.Completed = true
+	}
+	sendUploadProgress(d, progress)
 }
 
 func handleUploadHttp(c *gin.Context) {
 	uploadId := c.Query("uploadId")
-	pendingUploadsMutex.Lock()
-	pendingUpload, ok := pendingUploads[uploadId]
-	pendingUploadsMutex.Unlock()
-	if !ok {
+	upload := getPendingUpload(uploadId)
+	if upload == nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
 		return
 	}
+	if err := upload.begin(); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 
-	totalBytesWritten := pendingUpload.AlreadyUploadedBytes
-	defer func() {
-		pendingUpload.File.Close()
-		if totalBytesWritten == pendingUpload.Size {
-			newName := strings.TrimSuffix(pendingUpload.File.Name(), ".incomplete")
-			err := os.Rename(pendingUpload.File.Name(), newName)
-			if err != nil {
-				logger.Errorf("failed to rename uploaded file: %v", err)
-			} else {
-				logger.Debugf("successfully renamed uploaded file to: %s", newName)
-			}
-		} else {
-			logger.Warnf("uploaded ended before the complete file received")
-		}
-		pendingUploadsMutex.Lock()
-		delete(pendingUploads, uploadId)
-		pendingUploadsMutex.Unlock()
-	}()
-
+	var transferErr error
 	reader := c.Request.Body
 	buffer := make([]byte, 32*1024)
 	for {
 		n, err := reader.Read(buffer)
-		if err != nil && err != io.EOF {
-			logger.Errorf("failed to read from request body: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read upload data"})
-			return
-		}
-
 		if n > 0 {
-			bytesWritten, err := pendingUpload.File.Write(buffer[:n])
-			if err != nil {
-				logger.Errorf("failed to write to file: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write upload data"})
-				return
+			if writeErr := upload.write(buffer[:n]); writeErr != nil {
+				transferErr = writeErr
+				break
 			}
-			totalBytesWritten += int64(bytesWritten)
 		}
-
 		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			transferErr = fmt.Errorf("failed to read upload data: %w", err)
+			break
+		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Upload completed"})
+	err := upload.finish(transferErr)
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"message": "Upload completed"})
+	case errors.Is(err, errUploadOverrun):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, errUploadChecksum):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, errUploadInterrupted):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		logger.Errorf("upload %s failed: %v", uploadId, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
 }
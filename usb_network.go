@@ -0,0 +1,242 @@
+package kvm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	UsbNetworkProtocolECM = "ecm"
+	UsbNetworkProtocolNCM = "ncm"
+)
+
+// port of the image file server, the web UI keeps port 80 on every interface
+const usbNetworkImagesPort = 8080
+
+type UsbNetworkConfig struct {
+	Protocol    string `json:"protocol"`
+	Address     string `json:"address"`     // KVM side in CIDR notation, the host gets the next address
+	ServeImages bool   `json:"serveImages"` // the server has no authentication, anything on the host can read the images
+}
+
+var defaultUsbNetworkConfig = UsbNetworkConfig{
+	Protocol: UsbNetworkProtocolECM,
+	Address:  "172.30.0.1/30",
+}
+
+func currentUsbNetworkConfig() UsbNetworkConfig {
+	if config == nil || config.UsbNetwork == nil {
+		return defaultUsbNetworkConfig
+	}
+	return *config.UsbNetwork
+}
+
+// addresses returns the KVM prefix and the address handed to the host
+func (c *UsbNetworkConfig) addresses() (netip.Prefix, netip.Addr, error) {
+	prefix, err := netip.ParsePrefix(c.Address)
+	if err != nil || !prefix.Addr().Is4() {
+		return netip.Prefix{}, netip.Addr{}, fmt.Errorf("invalid usb network address: %s", c.Address)
+	}
+	if prefix.Bits() > 30 {
+		return netip.Prefix{}, netip.Addr{}, fmt.Errorf("usb network prefix /%d leaves no room for the host", prefix.Bits())
+	}
+	addr := prefix.Addr().As4()
+	hostBits := binary.BigEndian.Uint32(addr[:]) & (1<<(32-prefix.Bits()) - 1)
+	// the network address, the host and the broadcast address must all differ
+	if hostBits == 0 || hostBits >= 1<<(32-prefix.Bits())-2 {
+		return netip.Prefix{}, netip.Addr{}, fmt.Errorf("usb network address %s leaves no room for the host", c.Address)
+	}
+	hostAddr := prefix.Addr().Next()
+	return prefix, hostAddr, nil
+}
+
+func (c *UsbNetworkConfig) validate() error {
+	if c.Protocol != UsbNetworkProtocolECM && c.Protocol != UsbNetworkProtocolNCM {
+		return fmt.Errorf("invalid usb network protocol: %s", c.Protocol)
+	}
+	_, _, err := c.addresses()
+	return err
+}
+
+func usbNetworkFunctionName(protocol string) string {
+	if protocol == UsbNetworkProtocolNCM {
+		return "ncm.usb0"
+	}
+	return "ecm.usb0"
+}
+
+// usbNetworkAttrs gives both ends stable locally administered MAC addresses
+// derived from the device ID, so the host keeps its interface settings
+// across reboots
+func usbNetworkAttrs() [][]string {
+	sum := sha256.Sum256([]byte(GetDeviceID()))
+	mac := func(side byte) string {
+		return net.HardwareAddr{0x02, sum[0], sum[1], sum[2], sum[3], side}.String()
+	}
+	return [][]string{
+		{"dev_addr", mac(0x01)},
+		{"host_addr", mac(0x02)},
+	}
+}
+
+var usbNetworkLock = sync.Mutex{}
+var usbDhcpServer *dhcpServer
+var usbImagesServer *http.Server
+
+// startUsbNetwork brings up the gadget network interface, if enabled, with
+// a DHCP server for the host and optionally the image file server
+func startUsbNetwork() error {
+	usbNetworkLock.Lock()
+	defer usbNetworkLock.Unlock()
+	stopUsbNetworkLocked()
+
+	if usbGadget == nil || !currentUsbDevices().Network {
+		return nil
+	}
+	networkConfig := currentUsbNetworkConfig()
+	prefix, hostAddr, err := networkConfig.addresses()
+	if err != nil {
+		return err
+	}
+
+	functionName := usbNetworkFunctionName(networkConfig.Protocol)
+	ifnameBytes, err := os.ReadFile(path.Join(usbGadget.functionPath(functionName), "ifname"))
+	if err != nil {
+		return fmt.Errorf("failed to get interface of %s: %w", functionName, err)
+	}
+	ifname := strings.TrimSpace(string(ifnameBytes))
+
+	link, err := netlink.LinkByName(ifname)
+	if err != nil {
+		return fmt.Errorf("failed to get %s interface: %w", ifname, err)
+	}
+	addr, err := netlink.ParseAddr(prefix.String())
+	if err != nil {
+		return err
+	}
+	err = netlink.AddrReplace(link, addr)
+	if err != nil {
+		return fmt.Errorf("failed to set address of %s: %w", ifname, err)
+	}
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		return fmt.Errorf("failed to bring up %s: %w", ifname, err)
+	}
+
+	usbDhcpServer, err = startDhcpServer(ifname, prefix.Addr(), hostAddr, prefix.Bits())
+	if err != nil {
+		return err
+	}
+	logger.Infof("usb network up on %s at %s, offering %s to the host", ifname, prefix, hostAddr)
+
+	if networkConfig.ServeImages {
+		// bound to the link address only, the images aren't exposed on the LAN
+		listenAddr := netip.AddrPortFrom(prefix.Addr(), usbNetworkImagesPort).String()
+		listener, err := net.Listen("tcp4", listenAddr)
+		if err != nil {
+			stopUsbNetworkLocked()
+			return fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
+		}
+		usbImagesServer = &http.Server{
+			Handler:           http.FileServer(storedImagesFS{http.Dir(imagesFolder)}),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func(server *http.Server) {
+			err := server.Serve(listener)
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Warnf("usb network image server stopped: %v", err)
+			}
+		}(usbImagesServer)
+	}
+	return nil
+}
+
+// storedImagesFS hides files that are still being uploaded or downloaded
+type storedImagesFS struct {
+	fs http.FileSystem
+}
+
+func (s storedImagesFS) Open(name string) (http.File, error) {
+	if strings.HasSuffix(name, ".incomplete") {
+		return nil, os.ErrNotExist
+	}
+	file, err := s.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return storedImagesFile{file}, nil
+}
+
+type storedImagesFile struct {
+	http.File
+}
+
+func (f storedImagesFile) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := f.File.Readdir(count)
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".incomplete") {
+			visible = append(visible, entry)
+		}
+	}
+	return visible, err
+}
+
+func stopUsbNetwork() {
+	usbNetworkLock.Lock()
+	defer usbNetworkLock.Unlock()
+	stopUsbNetworkLocked()
+}
+
+func stopUsbNetworkLocked() {
+	if usbDhcpServer != nil {
+		usbDhcpServer.Close()
+		usbDhcpServer = nil
+	}
+	if usbImagesServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		usbImagesServer.Shutdown(ctx)
+		usbImagesServer = nil
+	}
+}
+
+func rpcGetUsbNetworkConfig() UsbNetworkConfig {
+	return currentUsbNetworkConfig()
+}
+
+// rpcSetUsbNetworkConfig switching between ECM and NCM replaces the gadget
+// function, other changes only restart the services on the link
+func rpcSetUsbNetworkConfig(networkConfig UsbNetworkConfig) error {
+	if err := networkConfig.validate(); err != nil {
+		return err
+	}
+	previous := currentUsbNetworkConfig()
+	apply := startUsbNetwork
+	if previous.Protocol != networkConfig.Protocol && currentUsbDevices().Network {
+		apply = applyUsbGadgetConfig
+	}
+
+	config.UsbNetwork = &networkConfig
+	if err := apply(); err != nil {
+		config.UsbNetwork = &previous
+		if restoreErr := apply(); restoreErr != nil {
+			logger.Warnf("failed to restore usb network: %v", restoreErr)
+		}
+		return fmt.Errorf("failed to apply usb network config: %w", err)
+	}
+	return SaveConfig()
+}
@@ -0,0 +1,208 @@
+package kvm
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pojntfx/go-nbd/pkg/client"
+)
+
+const (
+	// the network may take a while after boot, HTTP media is retried
+	virtualMediaRestoreAttempts = 10
+	virtualMediaRestoreRetry    = 15 * time.Second
+)
+
+// SavedVirtualMedia is media mounted again after a restart, media streamed
+// from the browser can't be
+type SavedVirtualMedia struct {
+	Lun      int                `json:"lun"`
+	Source   VirtualMediaSource `json:"source"`
+	Mode     VirtualMediaMode   `json:"mode"`
+	Filename string             `json:"filename,omitempty"`
+	URL      string             `json:"url,omitempty"`
+}
+
+// restoringVirtualMedia stays in the config while it is being mounted again,
+// guarded by virtualMediaStateMutex
+var restoringVirtualMedia = make(map[int]SavedVirtualMedia)
+var virtualMediaConfigLock = sync.Mutex{}
+
+// persistVirtualMedia saves the mounted media to the config if it changed
+func persistVirtualMedia() {
+	saved := make([]SavedVirtualMedia, 0)
+	virtualMediaStateMutex.RLock()
+	for lun, mounted := range virtualMediaLuns {
+		if mounted.state == nil {
+			if media, ok := restoringVirtualMedia[lun]; ok {
+				saved = append(saved, media)
+			}
+			continue
+		}
+		if mounted.state.Source != Storage && mounted.state.Source != HTTP {
+			continue
+		}
+		saved = append(saved, SavedVirtualMedia{
+			Lun:      lun,
+			Source:   mounted.state.Source,
+			Mode:     mounted.state.Mode,
+			Filename: mounted.state.Filename,
+			URL:      mounted.state.URL,
+		})
+	}
+	virtualMediaStateMutex.RUnlock()
+
+	virtualMediaConfigLock.Lock()
+	defer virtualMediaConfigLock.Unlock()
+	if slices.Equal(saved, config.VirtualMedia) {
+		return
+	}
+	config.VirtualMedia = saved
+	if err := SaveConfig(); err != nil {
+		logger.Warnf("failed to save virtual media: %v", err)
+	}
+}
+
+func getMassStorageImage(lun int) (string, error) {
+	data, err := os.ReadFile(path.Join(massStorageLunPath(lun), "file"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read image path: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// resetNBDDevice disconnects a device left behind by an earlier run, its
+// server went away with that process
+func resetNBDDevice(devicePath string) {
+	dev, err := os.Open(devicePath)
+	if err != nil {
+		logger.Warnf("failed to open %s: %v", devicePath, err)
+		return
+	}
+	defer dev.Close()
+	if err := client.Disconnect(dev); err != nil {
+		logger.Debugf("failed to disconnect %s: %v", devicePath, err)
+	}
+}
+
+// adoptStorageMedia takes over a stored image that is still attached from
+// before the restart, the host doesn't notice anything then
+func adoptStorageMedia(media SavedVirtualMedia, attached string) bool {
+	if media.Source != Storage || media.Mode == WritableDisk {
+		return false
+	}
+	fullPath := filepath.Join(imagesFolder, media.Filename)
+	if attached != fullPath {
+		return false
+	}
+	cdrom, err := getMassStorageMode(media.Lun)
+	if err != nil || cdrom != (media.Mode == CDROM) {
+		return false
+	}
+	fileInfo, err := os.Stat(fullPath)
+	if err != nil {
+		return false
+	}
+	virtualMediaStateMutex.Lock()
+	defer virtualMediaStateMutex.Unlock()
+	virtualMediaLuns[media.Lun] = virtualMediaLun{
+		state: &VirtualMediaState{
+			Lun:      media.Lun,
+			Source:   Storage,
+			Mode:     media.Mode,
+			Filename: media.Filename,
+			Size:     fileInfo.Size(),
+		},
+	}
+	return true
+}
+
+func restoreVirtualMediaLun(media SavedVirtualMedia) error {
+	switch media.Source {
+	case Storage:
+		return rpcMountWithStorage(media.Filename, media.Mode, media.Lun)
+	case HTTP:
+		var err error
+		for attempt := 1; ; attempt++ {
+			_, err = rpcMountWithHTTP(media.URL, media.Mode, media.Lun)
+			if err == nil || attempt >= virtualMediaRestoreAttempts {
+				return err
+			}
+			logger.Warnf("failed to restore %s on LUN %d (attempt %d): %v", media.URL, media.Lun, attempt, err)
+			time.Sleep(virtualMediaRestoreRetry)
+			// something else may have been mounted in the meantime
+			if err := checkVirtualMediaLunFree(media.Lun); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("unsupported virtual media source: %s", media.Source)
+}
+
+// restoreVirtualMedia brings the LUNs back to the media saved in the config
+// and ejects whatever configfs still holds from an earlier run
+func restoreVirtualMedia() {
+	saved := make(map[int]SavedVirtualMedia)
+	for _, media := range config.VirtualMedia {
+		if checkMassStorageLun(media.Lun) == nil {
+			saved[media.Lun] = media
+		}
+	}
+
+	var wg sync.WaitGroup
+	restoring := false
+	for lun := 0; lun < massStorageLunCount; lun++ {
+		media, ok := saved[lun]
+		attached, err := getMassStorageImage(lun)
+		if err != nil {
+			logger.Warnf("failed to check LUN %d: %v", lun, err)
+			continue
+		}
+		if ok && adoptStorageMedia(media, attached) {
+			logger.Infof("took over %s still attached to LUN %d", media.Filename, lun)
+			continue
+		}
+		if attached != "" {
+			logger.Infof("ejecting %s left on LUN %d", attached, lun)
+			if err := setMassStorageImage(lun, "\n"); err != nil {
+				logger.Warnf("failed to eject LUN %d: %v", lun, err)
+			}
+			if strings.HasPrefix(attached, "/dev/nbd") {
+				resetNBDDevice(attached)
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		virtualMediaStateMutex.Lock()
+		restoringVirtualMedia[lun] = media
+		virtualMediaStateMutex.Unlock()
+		restoring = true
+		wg.Add(1)
+		go func(media SavedVirtualMedia) {
+			defer wg.Done()
+			err := restoreVirtualMediaLun(media)
+			virtualMediaStateMutex.Lock()
+			delete(restoringVirtualMedia, media.Lun)
+			virtualMediaStateMutex.Unlock()
+			if err != nil {
+				logger.Errorf("failed to restore virtual media on LUN %d: %v", media.Lun, err)
+				return
+			}
+			logger.Infof("restored virtual media on LUN %d", media.Lun)
+		}(media)
+	}
+	if !restoring {
+		return
+	}
+	wg.Wait()
+	// media that couldn't be restored is dropped
+	persistVirtualMedia()
+}
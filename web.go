@@ -128,6 +128,7 @@ func handleWebRTCSession(c *gin.Context) {
 		return
 	}
 	if currentSession != nil {
+		releaseStuckKeys("session replaced")
 		writeJSONRPCEvent("otherSessionConnected", nil, currentSession)
 		peerConn := currentSession.peerConnection
 		go func() {
@@ -81,11 +81,14 @@ func newSession() (*Session, error) {
 			triggerOTAStateUpdate()
 			triggerVideoStateUpdate()
 			triggerUSBStateUpdate()
+			triggerKeyboardLedStateUpdate()
 		case "disk":
 			session.DiskChannel = d
 			d.OnMessage(onDiskMessage)
 		case "terminal":
 			handleTerminalChannel(d)
+		case "serial":
+			handleSerialChannel(d)
 		default:
 			if strings.HasPrefix(d.Label(), uploadIdPrefix) {
 				go handleUploadChannel(d)
@@ -130,14 +133,18 @@ func newSession() (*Session, error) {
 		}
 		//state changes on closing browser tab disconnected->failed, we need to manually close it
 		if connectionState == webrtc.ICEConnectionStateFailed {
+			if session == currentSession {
+				releaseStuckKeys("session failed")
+			}
 			_ = peerConnection.Close()
 		}
 		if connectionState == webrtc.ICEConnectionStateClosed {
 			if session == currentSession {
+				releaseStuckKeys("session closed")
 				currentSession = nil
 			}
 			if session.shouldUmountVirtualMedia {
-				err := rpcUnmountImage()
+				err := unmountAllImages()
 				logger.Debugf("unmount image failed on connection close %v", err)
 			}
 			if isConnected {